@@ -0,0 +1,151 @@
+package httpfiles
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RequestIDHeader carries the id of a request, a valid id sent by the client
+// or a proxy is kept, otherwise a new one is generated.
+const RequestIDHeader = "X-Request-ID"
+
+// accessInfo is filled by the handlers for the access log.
+type accessInfo struct {
+	requestID string
+	hash      string
+}
+
+// RequestID returns the id of the request handled by FilesHandler.
+func RequestID(req *http.Request) string {
+	if info, ok := req.Context().Value(ctxAccessKey).(*accessInfo); ok {
+		return info.requestID
+	}
+	return ""
+}
+
+// setLogHash records the object hash of the request for the access log.
+func setLogHash(req *http.Request, h string) {
+	if info, ok := req.Context().Value(ctxAccessKey).(*accessInfo); ok {
+		info.hash = h
+	}
+}
+
+func withAccessInfo(ctx context.Context, req *http.Request) (context.Context, *accessInfo) {
+	info := &accessInfo{requestID: req.Header.Get(RequestIDHeader)}
+	if !validRequestID(info.requestID) {
+		info.requestID = newRequestID()
+	}
+	if id, ok := objectID(req); ok {
+		info.hash = id
+	}
+	return context.WithValue(ctx, ctxAccessKey, info), info
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logAccess writes the access log entry of a finished request. Successful
+// requests are sampled, failed ones are always logged.
+func (s *FilesHandler) logAccess(req *http.Request, rw *responseRecorder, info *accessInfo, duration time.Duration) {
+	status := rw.Status()
+	if status < http.StatusBadRequest && s.logSampling < 1 && mathrand.Float64() >= s.logSampling {
+		return
+	}
+
+	level := slog.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+
+	remoteIP := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		remoteIP = host
+	}
+
+	s.logger.LogAttrs(req.Context(), level, "access",
+		slog.String("request_id", info.requestID),
+		slog.String("method", req.Method),
+		slog.String("uri", req.URL.RequestURI()),
+		slog.Int("status", status),
+		slog.Int64("bytes", rw.bytes),
+		slog.Int64("request_bytes", req.ContentLength),
+		slog.Duration("duration", duration),
+		slog.String("remote_ip", remoteIP),
+		slog.String("user_agent", req.UserAgent()),
+		slog.String("hash", info.hash),
+	)
+}
+
+// responseRecorder captures the status and the size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Status returns the response status, 200 if nothing was written yet.
+func (w *responseRecorder) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *responseRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// ReadFrom keeps the io.ReaderFrom of the underlying writer, e.g. sendfile.
+func (w *responseRecorder) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
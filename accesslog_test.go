@@ -0,0 +1,123 @@
+package httpfiles_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"crypto/sha256"
+
+	"github.com/nameoffnv/httpfiles"
+	"github.com/nameoffnv/httpfiles/storage/memory"
+)
+
+func TestAccessLog(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := slog.New(slog.NewJSONHandler(buf, nil))
+
+	handler, err := httpfiles.New(memory.New(sha256.New), httpfiles.AccessLog(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testObj := []byte("hello world")
+	testHash := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+	t.Run("upload", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(testObj))
+		req.Header.Set("X-Request-ID", "test-request")
+		req.Header.Set("User-Agent", "tester")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Header().Get("X-Request-ID") != "test-request" {
+			t.Fatalf("bad request id header, excepted test-request, actual '%s'", rr.Header().Get("X-Request-ID"))
+		}
+
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("json decode log entry failed, error %v", err)
+		}
+
+		excepted := map[string]interface{}{
+			"request_id": "test-request",
+			"method":     "POST",
+			"status":     float64(http.StatusCreated),
+			"bytes":      float64(rr.Body.Len()),
+			"hash":       testHash,
+			"user_agent": "tester",
+			"remote_ip":  "192.0.2.1",
+		}
+		for k, v := range excepted {
+			if entry[k] != v {
+				t.Fatalf("bad log field %s, excepted %v, actual %v", k, v, entry[k])
+			}
+		}
+	})
+
+	t.Run("generated-request-id", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/"+testHash, nil))
+
+		if len(rr.Header().Get("X-Request-ID")) != 32 {
+			t.Fatalf("bad generated request id '%s'", rr.Header().Get("X-Request-ID"))
+		}
+	})
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := slog.New(slog.NewTextHandler(buf, nil))
+
+	handler, err := httpfiles.New(memory.New(sha256.New), httpfiles.AccessLog(logger), httpfiles.LogSampling(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("hello"))))
+	if buf.Len() != 0 {
+		t.Fatalf("successful request logged despite sampling, '%s'", buf.String())
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if !bytes.Contains(buf.Bytes(), []byte("status=404")) {
+		t.Fatalf("failed request not logged, '%s'", buf.String())
+	}
+}
+
+// deadlineWriter supports the write deadline of http.ResponseController.
+type deadlineWriter struct {
+	*httptest.ResponseRecorder
+	deadline time.Time
+}
+
+func (w *deadlineWriter) SetWriteDeadline(deadline time.Time) error {
+	w.deadline = deadline
+	return nil
+}
+
+func TestResponseController(t *testing.T) {
+	handler, err := httpfiles.New(memory.New(sha256.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Minute)
+	wrapped := handler.WithContext(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if err := http.NewResponseController(rw).SetWriteDeadline(deadline); err != nil {
+			t.Errorf("set write deadline failed, error %v", err)
+		}
+	}))
+
+	rw := &deadlineWriter{ResponseRecorder: httptest.NewRecorder()}
+	wrapped.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if !rw.deadline.Equal(deadline) {
+		t.Fatalf("bad write deadline, excepted %v, actual %v", deadline, rw.deadline)
+	}
+}
@@ -0,0 +1,471 @@
+// Package client is a Go client of httpfiles servers.
+package client
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nameoffnv/httpfiles/storage"
+)
+
+const (
+	defaultRetries    = 3
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Second
+)
+
+// Hashes are the algorithms the client can verify uploads with, they match
+// the ones of the server.
+var Hashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"md5":    md5.New,
+}
+
+// Client talks to a FilesHandler. Failed requests are retried with
+// exponential backoff on network errors, 429 and 5xx responses, uploads and
+// deletes are safe to retry as objects are addressed by their hash.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	header     http.Header
+
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// New creates a client of the server at baseURL, e.g. "http://localhost:8080".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse base url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("base url %s is not http or https", baseURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	c := &Client{
+		baseURL:    u,
+		httpClient: http.DefaultClient,
+		header:     make(http.Header),
+		retries:    defaultRetries,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+// UploadOptions are the optional parameters of an upload.
+type UploadOptions struct {
+	Filename    string
+	ContentType string
+
+	// TTL or ExpireAt schedule the removal of the object.
+	TTL      time.Duration
+	ExpireAt time.Time
+
+	// Hashes are computed before the upload and verified by the server,
+	// sha256 by default.
+	Hashes []string
+
+	// Progress is called with the number of bytes sent so far, it starts
+	// over on a retry.
+	Progress func(sent int64)
+}
+
+// Upload stores the content of r and returns its hash. The content is hashed
+// first, r is read twice if it is an io.Seeker, otherwise it is spooled to a
+// temporary file. The upload fails with *HashMismatchError if the content
+// changed in between.
+func (c *Client) Upload(ctx context.Context, r io.Reader, opts UploadOptions) (string, error) {
+	algorithms := opts.Hashes
+	if len(algorithms) == 0 {
+		algorithms = []string{"sha256"}
+	}
+
+	hashes := make(map[string]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, 0, len(algorithms)+1)
+	for _, algorithm := range algorithms {
+		newHash, ok := Hashes[algorithm]
+		if !ok {
+			return "", fmt.Errorf("unknown hash %s", algorithm)
+		}
+		hashes[algorithm] = newHash()
+		writers = append(writers, hashes[algorithm])
+	}
+
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		f, err := os.CreateTemp("", "httpfiles-upload-")
+		if err != nil {
+			return "", fmt.Errorf("create spool file: %w", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		writers = append(writers, f)
+		body = f
+	}
+
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", fmt.Errorf("seek upload: %w", err)
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return "", fmt.Errorf("hash upload: %w", err)
+	}
+	end, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", fmt.Errorf("seek upload: %w", err)
+	}
+
+	query := url.Values{}
+	for algorithm, h := range hashes {
+		query.Set(algorithm, fmt.Sprintf("%x", h.Sum(nil)))
+	}
+	if opts.TTL > 0 {
+		query.Set("ttl", opts.TTL.String())
+	}
+	if !opts.ExpireAt.IsZero() {
+		query.Set("expire_at", opts.ExpireAt.Format(time.RFC3339))
+	}
+
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		if _, err := body.Seek(start, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("seek upload: %w", err)
+		}
+
+		var reader io.Reader = io.LimitReader(body, end-start)
+		if opts.Progress != nil {
+			reader = &progressReader{Reader: reader, progress: opts.Progress}
+		}
+
+		req, err := c.newRequest(ctx, http.MethodPost, "/", query, io.NopCloser(reader))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = end - start
+		if opts.ContentType != "" {
+			req.Header.Set("Content-Type", opts.ContentType)
+		}
+		if opts.Filename != "" {
+			req.Header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": opts.Filename}))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	result := struct {
+		Hash string `json:"hash"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decode upload response: %w", err)
+	}
+
+	return result.Hash, nil
+}
+
+// Download writes the object to w. An interrupted transfer is resumed with a
+// Range request, the content is verified against the id if it is a known hash
+// and *HashMismatchError returned otherwise. It returns the number of bytes
+// written to w.
+func (c *Client) Download(ctx context.Context, id string, w io.Writer) (int64, error) {
+	var verify hash.Hash
+	switch len(id) {
+	case sha256.Size * 2:
+		verify = sha256.New()
+	case sha1.Size * 2:
+		verify = sha1.New()
+	case md5.Size * 2:
+		verify = md5.New()
+	}
+
+	dst := &trackedWriter{w: w}
+	if verify != nil {
+		dst.w = io.MultiWriter(w, verify)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.do(ctx, func() (*http.Request, error) {
+			req, err := c.newRequest(ctx, http.MethodGet, "/"+id, nil, nil)
+			if err != nil {
+				return nil, err
+			}
+			if dst.written > 0 {
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-", dst.written))
+			}
+			return req, nil
+		})
+		if err != nil {
+			return dst.written, err
+		}
+
+		err = c.readBody(resp, dst)
+		if err == nil {
+			break
+		}
+		if dst.err != nil {
+			return dst.written, dst.err
+		}
+
+		wait, ok := c.retry(ctx, err, attempt)
+		if !ok {
+			return dst.written, err
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return dst.written, err
+		}
+	}
+
+	if verify != nil {
+		if actual := fmt.Sprintf("%x", verify.Sum(nil)); actual != id {
+			return dst.written, &HashMismatchError{Algorithm: hashName(len(id)), Expected: id, Actual: actual}
+		}
+	}
+
+	return dst.written, nil
+}
+
+// readBody copies a full or partial response to dst, a full response to a
+// resumed request skips what was already written.
+func (c *Client) readBody(resp *http.Response, dst *trackedWriter) error {
+	defer resp.Body.Close()
+
+	if dst.written > 0 && resp.StatusCode != http.StatusPartialContent {
+		if _, err := io.CopyN(io.Discard, resp.Body, dst.written); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.Copy(dst, resp.Body)
+	return err
+}
+
+// Stat returns the object info without downloading it.
+func (c *Client) Stat(ctx context.Context, id string) (*storage.ObjectInfo, error) {
+	info := &storage.ObjectInfo{}
+	if err := c.getJSON(ctx, "/"+id, url.Values{"meta": {""}}, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// List returns a page of objects, pass the Next cursor of the page to
+// opts.Cursor to get the following one. A zero Limit uses the server default.
+func (c *Client) List(ctx context.Context, opts storage.ListOptions) (*storage.ListPage, error) {
+	query := url.Values{"list": {""}}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Sort != storage.SortDefault {
+		query.Set("sort", string(opts.Sort))
+	}
+	if opts.Desc {
+		query.Set("order", "desc")
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+	if !opts.From.IsZero() {
+		query.Set("from", opts.From.Format(time.RFC3339))
+	}
+	if !opts.To.IsZero() {
+		query.Set("to", opts.To.Format(time.RFC3339))
+	}
+
+	page := &storage.ListPage{}
+	if err := c.getJSON(ctx, "/", query, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Delete removes the object.
+func (c *Client) Delete(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return c.newRequest(ctx, http.MethodDelete, "/"+id, nil, nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return c.newRequest(ctx, http.MethodGet, path, query, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, body io.ReadCloser) (*http.Request, error) {
+	u := *c.baseURL
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	return req, nil
+}
+
+// do sends the request built by newReq until it succeeds or the retries are
+// exhausted. newReq is called for every attempt as a body can't be resent.
+func (c *Client) do(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err == nil {
+			if resp.StatusCode < http.StatusBadRequest {
+				return resp, nil
+			}
+			err = responseError(resp)
+		}
+
+		wait, ok := c.retry(ctx, err, attempt)
+		if !ok {
+			return nil, err
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retry decides whether a failed attempt is retried and how long to wait.
+func (c *Client) retry(ctx context.Context, err error, attempt int) (time.Duration, bool) {
+	if attempt >= c.retries || ctx.Err() != nil {
+		return 0, false
+	}
+
+	wait := c.backoff(attempt)
+
+	var statusErr *StatusError
+	var rateLimitErr *RateLimitError
+	switch {
+	case errors.As(err, &rateLimitErr):
+		if rateLimitErr.RetryAfter > wait {
+			wait = rateLimitErr.RetryAfter
+		}
+		return wait, true
+	case errors.As(err, &statusErr):
+		switch statusErr.StatusCode {
+		case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return wait, true
+		}
+		return 0, false
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrGone):
+		return 0, false
+	case errors.As(err, new(*HashMismatchError)):
+		return 0, false
+	}
+
+	// network and body read errors
+	return wait, true
+}
+
+// backoff doubles the wait with every attempt, with jitter to spread the
+// retries of concurrent clients.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.minBackoff << uint(attempt)
+	if d > c.maxBackoff || d <= 0 {
+		d = c.maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func hashName(hexLen int) string {
+	switch hexLen {
+	case sha256.Size * 2:
+		return "sha256"
+	case sha1.Size * 2:
+		return "sha1"
+	}
+	return "md5"
+}
+
+// trackedWriter counts the written bytes and keeps the error of the
+// destination apart from errors reading the response.
+type trackedWriter struct {
+	w       io.Writer
+	written int64
+	err     error
+}
+
+func (w *trackedWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+type progressReader struct {
+	io.Reader
+	progress func(int64)
+	read     int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	r.progress(r.read)
+	return n, err
+}
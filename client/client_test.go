@@ -0,0 +1,194 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nameoffnv/httpfiles"
+	"github.com/nameoffnv/httpfiles/client"
+	"github.com/nameoffnv/httpfiles/storage"
+	"github.com/nameoffnv/httpfiles/storage/memory"
+)
+
+func newTestClient(t *testing.T, handler http.Handler) *client.Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	c, err := client.New(srv.URL, client.Backoff(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClient(t *testing.T) {
+	handler, err := httpfiles.New(memory.New(sha256.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, handler)
+	ctx := context.Background()
+
+	data := "hello world"
+	var h string
+
+	t.Run("upload", func(t *testing.T) {
+		// a plain reader is spooled before the upload
+		var sent int64
+		h, err = c.Upload(ctx, strings.NewReader(data), client.UploadOptions{
+			Filename: "hello.txt",
+			Hashes:   []string{"sha256", "md5"},
+			Progress: func(n int64) { atomic.StoreInt64(&sent, n) },
+		})
+		if err != nil {
+			t.Fatalf("upload failed, error %v", err)
+		}
+		if sent := atomic.LoadInt64(&sent); sent != int64(len(data)) {
+			t.Fatalf("bad progress, excepted %d actual %d", len(data), sent)
+		}
+		if excepted := fmt.Sprintf("%x", sha256.Sum256([]byte(data))); h != excepted {
+			t.Fatalf("hash mismatch excepted %s actual %s", excepted, h)
+		}
+	})
+
+	t.Run("stat", func(t *testing.T) {
+		info, err := c.Stat(ctx, h)
+		if err != nil {
+			t.Fatalf("stat failed, error %v", err)
+		}
+		if info.Size != int64(len(data)) || info.Filename != "hello.txt" {
+			t.Fatalf("bad info, excepted size %d filename hello.txt, actual %d %s", len(data), info.Size, info.Filename)
+		}
+	})
+
+	t.Run("download", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		if _, err := c.Download(ctx, h, buf); err != nil {
+			t.Fatalf("download failed, error %v", err)
+		}
+		if buf.String() != data {
+			t.Fatalf("content mismatch excepted %s actual %s", data, buf.String())
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		page, err := c.List(ctx, storage.ListOptions{Prefix: h[:4]})
+		if err != nil {
+			t.Fatalf("list failed, error %v", err)
+		}
+		if len(page.Objects) != 1 || page.Objects[0].ID != h {
+			t.Fatalf("excepted only %s, actual %v", h, page.Objects)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := c.Delete(ctx, h); err != nil {
+			t.Fatalf("delete failed, error %v", err)
+		}
+		if _, err := c.Stat(ctx, h); err != client.ErrNotFound {
+			t.Fatalf("excepted not found after delete, actual %v", err)
+		}
+	})
+}
+
+func TestClientErrors(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("hash-mismatch", func(t *testing.T) {
+		c := newTestClient(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			http.Error(rw, "hash mismatch sha256, aa != bb", http.StatusBadRequest)
+		}))
+
+		_, err := c.Upload(ctx, strings.NewReader("data"), client.UploadOptions{})
+		mismatch := &client.HashMismatchError{}
+		if !errors.As(err, &mismatch) || mismatch.Algorithm != "sha256" || mismatch.Actual != "bb" {
+			t.Fatalf("excepted hash mismatch error, actual %v", err)
+		}
+	})
+
+	t.Run("rate-limited", func(t *testing.T) {
+		var requests int32
+		c := newTestClient(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			rw.Header().Set("Retry-After", "0")
+			http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		}))
+
+		_, err := c.Stat(ctx, "id")
+		rateLimited := &client.RateLimitError{}
+		if !errors.As(err, &rateLimited) {
+			t.Fatalf("excepted rate limit error, actual %v", err)
+		}
+		if requests != 4 {
+			t.Fatalf("bad number of attempts, excepted 4 actual %d", requests)
+		}
+	})
+
+	t.Run("retry-unavailable", func(t *testing.T) {
+		var requests int32
+		c := newTestClient(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&requests, 1) < 3 {
+				http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			rw.Write([]byte(`{"id":"id"}`))
+		}))
+
+		if _, err := c.Stat(ctx, "id"); err != nil {
+			t.Fatalf("excepted success after retries, actual %v", err)
+		}
+	})
+
+	t.Run("no-retry-bad-request", func(t *testing.T) {
+		var requests int32
+		c := newTestClient(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			http.Error(rw, "bad", http.StatusBadRequest)
+		}))
+
+		_, err := c.Stat(ctx, "id")
+		statusErr := &client.StatusError{}
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest || requests != 1 {
+			t.Fatalf("excepted a single 400, actual %v after %d requests", err, requests)
+		}
+	})
+}
+
+func TestClientDownloadResume(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	id := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	var ranges []string
+	c := newTestClient(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ranges = append(ranges, req.Header.Get("Range"))
+		if len(ranges) == 1 {
+			// announce the full length but break off halfway
+			rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			rw.Write(data[:len(data)/2])
+			return
+		}
+		http.ServeContent(rw, req, id, time.Time{}, bytes.NewReader(data))
+	}))
+
+	buf := &bytes.Buffer{}
+	n, err := c.Download(context.Background(), id, buf)
+	if err != nil {
+		t.Fatalf("download failed, error %v", err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("content mismatch excepted %d bytes actual %d", len(data), n)
+	}
+	if len(ranges) != 2 || ranges[1] != fmt.Sprintf("bytes=%d-", len(data)/2) {
+		t.Fatalf("excepted a resumed request, actual ranges %q", ranges)
+	}
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("httpfiles: object not found")
+	ErrGone     = errors.New("httpfiles: object expired")
+)
+
+// StatusError is returned for an unexpected response status.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("httpfiles: %d %s", e.StatusCode, e.Message)
+}
+
+// RateLimitError is returned when the server keeps rejecting requests with
+// 429 after all retries. RetryAfter is the wait the server asked for.
+type RateLimitError struct {
+	RetryAfter time.Duration
+	Message    string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("httpfiles: rate limited, retry after %s: %s", e.RetryAfter, e.Message)
+}
+
+// HashMismatchError is returned when the server rejects an upload whose
+// content doesn't match the hash computed by the client, or when downloaded
+// content doesn't match its id.
+type HashMismatchError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("httpfiles: hash mismatch %s, %s != %s", e.Algorithm, e.Expected, e.Actual)
+}
+
+// responseError reads and closes the body of a failed response.
+func responseError(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	message := strings.TrimSpace(string(b))
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusGone:
+		return ErrGone
+	case http.StatusTooManyRequests:
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return &RateLimitError{RetryAfter: time.Duration(seconds) * time.Second, Message: message}
+	case http.StatusBadRequest:
+		// the server reports "hash mismatch <algorithm>, <expected> != <actual>"
+		var algorithm, expected, actual string
+		if n, _ := fmt.Sscanf(message, "hash mismatch %s %s != %s", &algorithm, &expected, &actual); n == 3 {
+			return &HashMismatchError{
+				Algorithm: strings.TrimSuffix(algorithm, ","),
+				Expected:  expected,
+				Actual:    actual,
+			}
+		}
+	}
+
+	return &StatusError{StatusCode: resp.StatusCode, Message: message}
+}
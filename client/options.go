@@ -0,0 +1,48 @@
+package client
+
+import (
+	"net/http"
+	"time"
+)
+
+// Option configures a Client.
+type Option func(*Client)
+
+// HTTPClient sets the client sending the requests, http.DefaultClient is used
+// by default.
+func HTTPClient(c *http.Client) Option {
+	return func(client *Client) {
+		client.httpClient = c
+	}
+}
+
+// APIKey authenticates the requests with the X-API-Key header.
+func APIKey(key string) Option {
+	return func(client *Client) {
+		client.header.Set("X-API-Key", key)
+	}
+}
+
+// BearerToken authenticates the requests with a bearer token, e.g. a JWT.
+func BearerToken(token string) Option {
+	return func(client *Client) {
+		client.header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// Retries sets how many times a failed request is retried, zero disables
+// retries.
+func Retries(n int) Option {
+	return func(client *Client) {
+		client.retries = n
+	}
+}
+
+// Backoff sets the wait before the first retry, it doubles with every retry
+// up to max.
+func Backoff(min, max time.Duration) Option {
+	return func(client *Client) {
+		client.minBackoff = min
+		client.maxBackoff = max
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nameoffnv/httpfiles/client"
+	"github.com/nameoffnv/httpfiles/storage"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultServerURL = "http://localhost:5000"
+
+// ClientConfig is the connection of the client commands. It is read from the
+// config file, then overridden by the HTTPFILES_URL, HTTPFILES_API_KEY and
+// HTTPFILES_TOKEN env vars and finally by flags.
+type ClientConfig struct {
+	URL    string `yaml:"url"`
+	APIKey string `yaml:"api_key"`
+	Token  string `yaml:"token"`
+}
+
+// clientFlags are the flags shared by the client commands.
+type clientFlags struct {
+	flags      *flag.FlagSet
+	config     ClientConfig
+	configPath string
+	json       bool
+	quiet      bool
+}
+
+func newClientFlags(name, args string) *clientFlags {
+	c := &clientFlags{flags: flag.NewFlagSet(name, flag.ExitOnError)}
+	c.flags.StringVar(&c.config.URL, "url", "", "Server url (default "+defaultServerURL+")")
+	c.flags.StringVar(&c.config.APIKey, "apikey", "", "API key")
+	c.flags.StringVar(&c.config.Token, "token", "", "Bearer token")
+	c.flags.StringVar(&c.configPath, "config", "", "Client config file (default $HTTPFILES_CONFIG or <user config dir>/httpfiles/client.yaml)")
+	c.flags.BoolVar(&c.json, "json", false, "Print JSON")
+	c.flags.BoolVar(&c.quiet, "quiet", false, "Don't show progress")
+	c.flags.Usage = func() {
+		fmt.Fprintf(c.flags.Output(), "Usage: %s %s [flags] %s\n", os.Args[0], name, args)
+		c.flags.PrintDefaults()
+	}
+	return c
+}
+
+// parse parses the flags and requires at least minArgs arguments.
+func (c *clientFlags) parse(args []string, minArgs int) {
+	c.flags.Parse(args)
+	if c.flags.NArg() < minArgs {
+		c.flags.Usage()
+		os.Exit(2)
+	}
+}
+
+// client resolves the connection config and creates the client.
+func (c *clientFlags) client() (*client.Client, error) {
+	config, err := loadClientConfig(c.configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range []struct {
+		value *string
+		env   string
+		flag  string
+	}{
+		{&config.URL, "HTTPFILES_URL", c.config.URL},
+		{&config.APIKey, "HTTPFILES_API_KEY", c.config.APIKey},
+		{&config.Token, "HTTPFILES_TOKEN", c.config.Token},
+	} {
+		if v := os.Getenv(o.env); v != "" {
+			*o.value = v
+		}
+		if o.flag != "" {
+			*o.value = o.flag
+		}
+	}
+	if config.URL == "" {
+		config.URL = defaultServerURL
+	}
+
+	opts := []client.Option{}
+	if config.APIKey != "" {
+		opts = append(opts, client.APIKey(config.APIKey))
+	}
+	if config.Token != "" {
+		opts = append(opts, client.BearerToken(config.Token))
+	}
+	return client.New(config.URL, opts...)
+}
+
+// loadClientConfig reads the config file, a missing default file is not an
+// error.
+func loadClientConfig(path string) (ClientConfig, error) {
+	config := ClientConfig{}
+
+	explicit := path != ""
+	if !explicit {
+		path = os.Getenv("HTTPFILES_CONFIG")
+		explicit = path != ""
+	}
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return config, nil
+		}
+		path = filepath.Join(dir, "httpfiles", "client.yaml")
+	}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return config, nil
+	} else if err != nil {
+		return config, fmt.Errorf("read config: %w", err)
+	}
+
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return config, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+type fileResult struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// runUpload uploads files, directories are uploaded recursively.
+func runUpload(args []string) error {
+	var hashes stringsFlag
+
+	c := newClientFlags("upload", "<file or directory>...")
+	c.flags.Var(&hashes, "hash", "Hash verified by the server: sha256, sha1 or md5, may be repeated (default sha256)")
+	ttl := c.flags.Duration("ttl", 0, "Remove the files after that long")
+	expireAt := c.flags.String("expireat", "", "Remove the files at that time (RFC 3339)")
+	c.parse(args, 1)
+
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+
+	opts := client.UploadOptions{TTL: *ttl, Hashes: hashes}
+	if *expireAt != "" {
+		if opts.ExpireAt, err = time.Parse(time.RFC3339, *expireAt); err != nil {
+			return fmt.Errorf("invalid -expireat: %w", err)
+		}
+	}
+
+	paths := []string{}
+	for _, arg := range c.flags.Args() {
+		err := filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	results := []fileResult{}
+	for _, path := range paths {
+		result, err := uploadFile(cl, path, opts, c.quiet)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		results = append(results, *result)
+
+		if !c.json {
+			fmt.Printf("%s  %s\n", result.Hash, result.Path)
+		}
+	}
+
+	if c.json {
+		return printJSON(results)
+	}
+	return nil
+}
+
+func uploadFile(cl *client.Client, path string, opts client.UploadOptions, quiet bool) (*fileResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	bar := newProgressBar(filepath.Base(path), fi.Size(), quiet)
+	opts.Filename = filepath.Base(path)
+	opts.ContentType = mime.TypeByExtension(filepath.Ext(path))
+	opts.Progress = bar.Set
+
+	h, err := cl.Upload(context.Background(), f, opts)
+	bar.Done()
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileResult{Path: path, Hash: h, Size: fi.Size()}, nil
+}
+
+// runGet downloads a file to stdout or to the -o path, the content is
+// verified against the hash.
+func runGet(args []string) error {
+	c := newClientFlags("get", "<hash>")
+	output := c.flags.String("o", "", "Output file, stdout by default")
+	c.parse(args, 1)
+
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	id := c.flags.Arg(0)
+
+	if *output == "" {
+		_, err := cl.Download(ctx, id, os.Stdout)
+		return err
+	}
+
+	info, err := cl.Stat(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// written next to the output and renamed when complete
+	f, err := os.CreateTemp(filepath.Dir(*output), ".httpfiles-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	bar := newProgressBar(filepath.Base(*output), info.Size, c.quiet)
+	n, err := cl.Download(ctx, id, &teeWriter{f, bar})
+	bar.Done()
+	if err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), *output); err != nil {
+		return err
+	}
+
+	if c.json {
+		return printJSON(fileResult{Path: *output, Hash: id, Size: n})
+	}
+	return nil
+}
+
+// teeWriter reports the bytes written to w to the progress bar.
+type teeWriter struct {
+	w   *os.File
+	bar *progressBar
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	t.bar.Write(p[:n])
+	return n, err
+}
+
+func runRm(args []string) error {
+	c := newClientFlags("rm", "<hash>...")
+	c.parse(args, 1)
+
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+
+	removed := []string{}
+	for _, id := range c.flags.Args() {
+		if err := cl.Delete(context.Background(), id); err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		removed = append(removed, id)
+
+		if !c.json {
+			fmt.Println(id)
+		}
+	}
+
+	if c.json {
+		return printJSON(removed)
+	}
+	return nil
+}
+
+func runStat(args []string) error {
+	c := newClientFlags("stat", "<hash>...")
+	c.parse(args, 1)
+
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+
+	infos := []*storage.ObjectInfo{}
+	for _, id := range c.flags.Args() {
+		info, err := cl.Stat(context.Background(), id)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		infos = append(infos, info)
+	}
+
+	if c.json {
+		return printJSON(infos)
+	}
+
+	for i, info := range infos {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("hash:         %s\n", info.ID)
+		fmt.Printf("size:         %d\n", info.Size)
+		fmt.Printf("filename:     %s\n", info.Filename)
+		fmt.Printf("content type: %s\n", info.ContentType)
+		fmt.Printf("uploaded:     %s\n", info.UploadDate.Format(time.RFC3339))
+		fmt.Printf("downloads:    %d\n", info.DownloadCount)
+		if info.ExpireDate != nil {
+			fmt.Printf("expires:      %s\n", info.ExpireDate.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+func runLs(args []string) error {
+	c := newClientFlags("ls", "")
+	prefix := c.flags.String("prefix", "", "Only hashes with the prefix")
+	sort := c.flags.String("sort", "", "Sort by size or date")
+	desc := c.flags.Bool("desc", false, "Sort descending")
+	limit := c.flags.Int("limit", 0, "Files per page, the server default if 0")
+	cursor := c.flags.String("cursor", "", "Cursor of the page to list")
+	all := c.flags.Bool("all", false, "List all pages")
+	from := c.flags.String("from", "", "Only files uploaded since (RFC 3339)")
+	to := c.flags.String("to", "", "Only files uploaded before (RFC 3339)")
+	c.parse(args, 0)
+
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+
+	opts := storage.ListOptions{Prefix: *prefix, Desc: *desc, Limit: *limit, Cursor: *cursor}
+	if opts.Sort, err = storage.ParseListSort(*sort); err != nil {
+		return err
+	}
+	for _, t := range []struct {
+		value *time.Time
+		arg   string
+	}{{&opts.From, *from}, {&opts.To, *to}} {
+		if t.arg == "" {
+			continue
+		}
+		if *t.value, err = time.Parse(time.RFC3339, t.arg); err != nil {
+			return err
+		}
+	}
+
+	result := &storage.ListPage{Objects: []*storage.ObjectInfo{}}
+	for {
+		page, err := cl.List(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		result.Objects = append(result.Objects, page.Objects...)
+		result.Next = page.Next
+
+		if !*all || page.Next == "" {
+			break
+		}
+		opts.Cursor = page.Next
+	}
+
+	if c.json {
+		return printJSON(result)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HASH\tSIZE\tUPLOADED\tFILENAME")
+	for _, info := range result.Objects {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", info.ID, info.Size, info.UploadDate.Format(time.RFC3339), info.Filename)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if result.Next != "" {
+		fmt.Fprintf(os.Stderr, "more files, continue with -cursor %s\n", result.Next)
+	}
+	return nil
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nameoffnv/httpfiles"
+	"github.com/nameoffnv/httpfiles/middleware/auth"
+	"github.com/nameoffnv/httpfiles/middleware/limiter"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix prefixes the env var of every option, e.g. HTTPFILES_RATE for
+// the rate key of the config file.
+const envPrefix = "HTTPFILES_"
+
+// Options of the server, read from the config file, env vars and flags, in
+// increasing order of precedence. Options tagged reload are applied again on
+// SIGHUP, changes of the others require a restart.
+type Options struct {
+	Config string `yaml:"-" toml:"-"`
+
+	Addr         string        `yaml:"addr" toml:"addr"`
+	Backend      string        `yaml:"backend" toml:"backend"`
+	Hash         string        `yaml:"hash" toml:"hash"`
+	StorePath    string        `yaml:"path" toml:"path"`
+	MaxFileSize  int64         `yaml:"max_size" toml:"max_size" reload:"true"`
+	ReapInterval time.Duration `yaml:"reap_interval" toml:"reap_interval"`
+
+	TLSCert        string      `yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey         string      `yaml:"tls_key" toml:"tls_key"`
+	TLSClientCA    string      `yaml:"tls_client_ca" toml:"tls_client_ca"`
+	TLSClientAuth  string      `yaml:"tls_client_auth" toml:"tls_client_auth"`
+	CertPrincipals stringsFlag `yaml:"cert_principals" toml:"cert_principals" reload:"true"`
+	H2C            bool        `yaml:"h2c" toml:"h2c"`
+
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" toml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+	HTTPIdleTimeout   time.Duration `yaml:"http_idle_timeout" toml:"http_idle_timeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	TempMaxAge        time.Duration `yaml:"temp_max_age" toml:"temp_max_age"`
+
+	RedisHost     string `yaml:"redis" toml:"redis"`
+	RedisPassword string `yaml:"redis_password" toml:"redis_password"`
+	RedisDB       int    `yaml:"redis_db" toml:"redis_db"`
+	Reconcile     bool   `yaml:"reconcile" toml:"reconcile"`
+	SQLitePath    string `yaml:"sqlite" toml:"sqlite"`
+
+	S3Endpoint  string `yaml:"s3" toml:"s3"`
+	S3AccessKey string `yaml:"s3_access_key" toml:"s3_access_key"`
+	S3SecretKey string `yaml:"s3_secret_key" toml:"s3_secret_key"`
+	S3Region    string `yaml:"s3_region" toml:"s3_region"`
+	S3Bucket    string `yaml:"s3_bucket" toml:"s3_bucket"`
+	S3SSL       bool   `yaml:"s3_ssl" toml:"s3_ssl"`
+
+	Rate         float64       `yaml:"rate" toml:"rate" reload:"true"`
+	Burst        int           `yaml:"burst" toml:"burst" reload:"true"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout" toml:"idle_timeout" reload:"true"`
+	MaxClients   int           `yaml:"max_clients" toml:"max_clients" reload:"true"`
+	Quota        int64         `yaml:"quota" toml:"quota" reload:"true"`
+	QuotaWindow  time.Duration `yaml:"quota_window" toml:"quota_window" reload:"true"`
+	Bandwidth    int64         `yaml:"bandwidth" toml:"bandwidth" reload:"true"`
+	GlobalBW     int64         `yaml:"global_bandwidth" toml:"global_bandwidth" reload:"true"`
+	RedisLimit   bool          `yaml:"redis_limit" toml:"redis_limit"`
+	LimitFailure string        `yaml:"limit_failure" toml:"limit_failure"`
+	TrustedProxy string        `yaml:"trusted_proxies" toml:"trusted_proxies"`
+	IPv6Prefix   int           `yaml:"ipv6_prefix" toml:"ipv6_prefix"`
+	LimitBy      string        `yaml:"limit_by" toml:"limit_by"`
+
+	APIKeys     stringsFlag `yaml:"api_keys" toml:"api_keys" reload:"true"`
+	TokenSecret string      `yaml:"token_secret" toml:"token_secret" reload:"true"`
+	JWTSecret   string      `yaml:"jwt_secret" toml:"jwt_secret" reload:"true"`
+	JWKSPath    string      `yaml:"jwks" toml:"jwks" reload:"true"`
+	Anonymous   string      `yaml:"anonymous" toml:"anonymous" reload:"true"`
+	Methods     string      `yaml:"methods" toml:"methods" reload:"true"`
+	SignKeys    stringsFlag `yaml:"sign_keys" toml:"sign_keys" reload:"true"`
+
+	MetricsPath string `yaml:"metrics" toml:"metrics"`
+	MetricsAddr string `yaml:"metrics_addr" toml:"metrics_addr"`
+
+	LogFormat   string  `yaml:"log_format" toml:"log_format"`
+	LogSampling float64 `yaml:"log_sample" toml:"log_sample"`
+
+	Trace        string `yaml:"trace" toml:"trace"`
+	OTLPEndpoint string `yaml:"otlp_endpoint" toml:"otlp_endpoint"`
+	OTLPInsecure bool   `yaml:"otlp_insecure" toml:"otlp_insecure"`
+}
+
+func defaultOptions() Options {
+	return Options{
+		Addr:         ":5000",
+		StorePath:    "./store",
+		ReapInterval: time.Minute,
+
+		TLSClientAuth:     "require",
+		ReadHeaderTimeout: 10 * time.Second,
+		HTTPIdleTimeout:   2 * time.Minute,
+		ShutdownTimeout:   30 * time.Second,
+		TempMaxAge:        24 * time.Hour,
+
+		S3Bucket:     "httpfiles",
+		S3SSL:        true,
+		Rate:         1,
+		Burst:        1,
+		IdleTimeout:  10 * time.Minute,
+		MaxClients:   100000,
+		QuotaWindow:  24 * time.Hour,
+		LimitFailure: "local",
+		IPv6Prefix:   64,
+		LimitBy:      "ip",
+		MetricsPath:  "/metrics",
+		LogFormat:    "logfmt",
+		LogSampling:  1,
+		OTLPEndpoint: "localhost:4318",
+		OTLPInsecure: true,
+	}
+}
+
+// loadOptions resolves the options of the serve command. The config file is
+// set by -config or the HTTPFILES_SERVER_CONFIG env var.
+func loadOptions(args []string) (Options, error) {
+	// the flags are parsed twice, first only to find the config file
+	pre := defaultOptions()
+	serveFlags(&pre).Parse(args)
+
+	path := pre.Config
+	if path == "" {
+		path = os.Getenv(envPrefix + "SERVER_CONFIG")
+	}
+
+	opts := defaultOptions()
+	if path != "" {
+		if err := loadConfigFile(path, &opts); err != nil {
+			return opts, err
+		}
+	}
+	if err := loadEnv(&opts); err != nil {
+		return opts, err
+	}
+
+	serveFlags(&opts).Parse(args)
+	opts.Config = path
+
+	return opts, opts.Validate()
+}
+
+// loadConfigFile reads a YAML or TOML file, by extension. Unknown keys are
+// rejected to catch typos.
+func loadConfigFile(path string, opts *Options) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(opts); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("config %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(b), opts)
+		if err != nil {
+			return fmt.Errorf("config %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("config %s: unknown keys %v", path, undecoded)
+		}
+	default:
+		return fmt.Errorf("config %s: unknown format %s, excepted .yaml, .yml or .toml", path, ext)
+	}
+
+	return nil
+}
+
+// loadEnv overrides the options by HTTPFILES_<KEY> env vars, where KEY is the
+// upper cased key of the config file. Lists are comma separated.
+func loadEnv(opts *Options) error {
+	v := reflect.ValueOf(opts).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("yaml")
+		if key == "" || key == "-" {
+			continue
+		}
+
+		name := envPrefix + strings.ToUpper(key)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		if err := setField(v.Field(i), value); err != nil {
+			return fmt.Errorf("env %s: invalid value '%s'", name, value)
+		}
+	}
+
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case int, int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case stringsFlag:
+		values := stringsFlag{}
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+		field.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// backend returns the selected storage backend, without an explicit one it
+// follows from the configured connection like before the backend option.
+func (o Options) backend() string {
+	switch {
+	case o.Backend != "":
+		return o.Backend
+	case o.S3Endpoint != "":
+		return "s3"
+	case o.RedisHost != "":
+		return "redis_fs"
+	case o.SQLitePath != "":
+		return "sqlite_fs"
+	}
+	return "fs"
+}
+
+// hash returns the hash of the file ids, without an explicit one the fs
+// backend keeps md5 of the stores written before the hash option, the
+// others use sha256.
+func (o Options) hash() string {
+	switch {
+	case o.Hash != "":
+		return o.Hash
+	case o.backend() == "fs":
+		return "md5"
+	}
+	return "sha256"
+}
+
+// Validate reports all invalid options at once.
+func (o Options) Validate() error {
+	errs := []error{}
+	invalid := func(key, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	if o.Addr == "" {
+		invalid("addr", "listen address required")
+	}
+
+	if (o.TLSCert == "") != (o.TLSKey == "") {
+		invalid("tls_cert", "tls_cert and tls_key must be set together")
+	}
+	if o.TLSClientCA != "" && o.TLSCert == "" {
+		invalid("tls_client_ca", "requires tls_cert")
+	}
+	if o.TLSClientAuth != "request" && o.TLSClientAuth != "require" {
+		invalid("tls_client_auth", "unknown %s, excepted request or require", o.TLSClientAuth)
+	}
+	if len(o.CertPrincipals) > 0 && o.TLSClientCA == "" {
+		invalid("cert_principals", "requires tls_client_ca")
+	}
+	if o.H2C && o.TLSCert != "" {
+		invalid("h2c", "only for plain http, HTTP/2 is enabled with tls_cert anyway")
+	}
+	for _, timeout := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"read_header_timeout", o.ReadHeaderTimeout},
+		{"read_timeout", o.ReadTimeout},
+		{"write_timeout", o.WriteTimeout},
+		{"http_idle_timeout", o.HTTPIdleTimeout},
+		{"shutdown_timeout", o.ShutdownTimeout},
+		{"temp_max_age", o.TempMaxAge},
+	} {
+		if timeout.value < 0 {
+			invalid(timeout.key, "must not be negative")
+		}
+	}
+
+	switch backend := o.backend(); backend {
+	case "fs", "s3":
+		if backend == "s3" && (o.S3Endpoint == "" || o.S3Bucket == "") {
+			invalid("s3", "endpoint and bucket required by the s3 backend")
+		}
+	case "redis_fs", "sqlite_fs":
+		if backend == "redis_fs" && o.RedisHost == "" {
+			invalid("redis", "host required by the redis_fs backend")
+		}
+		if backend == "sqlite_fs" && o.SQLitePath == "" {
+			invalid("sqlite", "database path required by the sqlite_fs backend")
+		}
+		if o.hash() != "sha256" {
+			invalid("hash", "the %s backend only supports sha256", backend)
+		}
+	default:
+		invalid("backend", "unknown backend %s, excepted fs, redis_fs, sqlite_fs or s3", backend)
+	}
+	if _, ok := httpfiles.Hashes[o.hash()]; !ok {
+		invalid("hash", "unknown hash %s, excepted sha256, sha1 or md5", o.hash())
+	}
+
+	if o.MaxFileSize < 0 {
+		invalid("max_size", "must not be negative")
+	}
+	if o.ReapInterval < 0 {
+		invalid("reap_interval", "must not be negative")
+	}
+
+	if o.Rate <= 0 {
+		invalid("rate", "must be positive")
+	}
+	if o.Burst < 1 {
+		invalid("burst", "must be at least 1")
+	}
+	if o.IdleTimeout <= 0 {
+		invalid("idle_timeout", "must be positive")
+	}
+	if o.MaxClients < 1 {
+		invalid("max_clients", "must be at least 1")
+	}
+	if o.Quota < 0 {
+		invalid("quota", "must not be negative")
+	}
+	if o.QuotaWindow <= 0 {
+		invalid("quota_window", "must be positive")
+	}
+	if o.Bandwidth < 0 || o.GlobalBW < 0 {
+		invalid("bandwidth", "must not be negative")
+	}
+	if o.RedisLimit && o.RedisHost == "" {
+		invalid("redis_limit", "requires redis")
+	}
+	if _, err := limiter.ParseFailurePolicy(o.LimitFailure); err != nil {
+		invalid("limit_failure", "%v", err)
+	}
+	if _, err := limiter.ParseTrustedProxies(o.TrustedProxy); err != nil {
+		invalid("trusted_proxies", "%v", err)
+	}
+	if o.IPv6Prefix < 0 || o.IPv6Prefix > 128 {
+		invalid("ipv6_prefix", "must be between 0 and 128")
+	}
+	if o.LimitBy != "ip" && o.LimitBy != "principal" {
+		invalid("limit_by", "unknown %s, excepted ip or principal", o.LimitBy)
+	}
+
+	if _, err := newAuthenticators(o); err != nil {
+		invalid("auth", "%v", err)
+	}
+	if _, err := auth.ParsePermission(o.Anonymous); err != nil {
+		invalid("anonymous", "%v", err)
+	}
+	if _, err := auth.ParseMethods(o.Methods); err != nil {
+		invalid("methods", "%v", err)
+	}
+	if _, err := parseSigningKeys(o.SignKeys); err != nil {
+		invalid("sign_keys", "%v", err)
+	}
+
+	if o.MetricsPath != "" && !strings.HasPrefix(o.MetricsPath, "/") {
+		invalid("metrics", "path must start with /")
+	}
+	if o.LogFormat != "logfmt" && o.LogFormat != "json" {
+		invalid("log_format", "unknown %s, excepted logfmt or json", o.LogFormat)
+	}
+	if o.LogSampling < 0 || o.LogSampling > 1 {
+		invalid("log_sample", "must be between 0 and 1")
+	}
+	if o.Trace != "" && o.Trace != "otlp" && o.Trace != "stdout" {
+		invalid("trace", "unknown %s, excepted otlp or stdout", o.Trace)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid options\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// restartRequired returns the keys of changed options which are not applied
+// on reload.
+func restartRequired(old, new Options) []string {
+	keys := []string{}
+
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(new)
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("reload") == "true" || field.Tag.Get("yaml") == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			keys = append(keys, field.Tag.Get("yaml"))
+		}
+	}
+
+	return keys
+}
+
+// reloaded returns the running options after next was applied, the options
+// which require a restart keep their running values.
+func reloaded(running, next Options) Options {
+	rv, nv := reflect.ValueOf(&running).Elem(), reflect.ValueOf(next)
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("reload") == "true" {
+			rv.Field(i).Set(nv.Field(i))
+		}
+	}
+
+	return running
+}
+
+// serveFlags binds the flags of the serve command to opts, the current values
+// are the defaults.
+func serveFlags(opts *Options) *flag.FlagSet {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.StringVar(&opts.Config, "config", opts.Config, "YAML or TOML config file (default $HTTPFILES_SERVER_CONFIG), options are also read from HTTPFILES_<KEY> env vars")
+	flags.StringVar(&opts.Addr, "addr", opts.Addr, "Listen address")
+	flags.StringVar(&opts.TLSCert, "tlscert", opts.TLSCert, "TLS certificate file, enables https and HTTP/2, reloaded when changed")
+	flags.StringVar(&opts.TLSKey, "tlskey", opts.TLSKey, "TLS private key file")
+	flags.StringVar(&opts.TLSClientCA, "tlsclientca", opts.TLSClientCA, "CA file of client certificates, enables mutual TLS")
+	flags.StringVar(&opts.TLSClientAuth, "tlsclientauth", opts.TLSClientAuth, "Client certificates are required or only verified on request")
+	flags.Var(&replaceFlag{values: &opts.CertPrincipals}, "certprincipal", "Client certificate as commonname:permissions (ex. backup:read), may be repeated")
+	flags.BoolVar(&opts.H2C, "h2c", opts.H2C, "Accept HTTP/2 without TLS, for internal traffic")
+	flags.DurationVar(&opts.ReadHeaderTimeout, "readheadertimeout", opts.ReadHeaderTimeout, "Time to read the request headers, 0 means no limit")
+	flags.DurationVar(&opts.ReadTimeout, "readtimeout", opts.ReadTimeout, "Time to read the whole request including the upload, 0 means no limit")
+	flags.DurationVar(&opts.WriteTimeout, "writetimeout", opts.WriteTimeout, "Time to write the whole response including the download, 0 means no limit")
+	flags.DurationVar(&opts.HTTPIdleTimeout, "httpidletimeout", opts.HTTPIdleTimeout, "Time to keep idle connections open")
+	flags.DurationVar(&opts.ShutdownTimeout, "shutdowntimeout", opts.ShutdownTimeout, "Time running requests may take on SIGTERM or SIGINT before their connections are closed")
+	flags.DurationVar(&opts.TempMaxAge, "tempmaxage", opts.TempMaxAge, "Remove temp files of unfinished uploads and resumable uploads idle for longer than that on start, 0 disables it")
+
+	flags.StringVar(&opts.Backend, "backend", opts.Backend, "Storage backend: fs, redis_fs, sqlite_fs or s3, by default follows from -s3, -redis and -sqlite")
+	flags.StringVar(&opts.Hash, "hash", opts.Hash, "Hash of the file ids: sha256, sha1 or md5, by default md5 for fs and sha256 for the others, redis_fs and sqlite_fs only support sha256")
+	flags.StringVar(&opts.RedisHost, "redis", opts.RedisHost, "Redis host and port (ex. localhost:6379)")
+	flags.StringVar(&opts.RedisPassword, "redispassword", opts.RedisPassword, "Redis password")
+	flags.IntVar(&opts.RedisDB, "redisdb", opts.RedisDB, "Redis database")
+	flags.BoolVar(&opts.Reconcile, "reconcile", opts.Reconcile, "Repair differences between redis and stored files on start")
+	flags.StringVar(&opts.StorePath, "path", opts.StorePath, "Path to store files")
+	flags.StringVar(&opts.SQLitePath, "sqlite", opts.SQLitePath, "Path to SQLite metadata database (ex. ./store/meta.db)")
+	flags.StringVar(&opts.S3Endpoint, "s3", opts.S3Endpoint, "S3 endpoint (ex. localhost:9000), enables the S3 storage")
+	flags.StringVar(&opts.S3AccessKey, "s3accesskey", opts.S3AccessKey, "S3 access key")
+	flags.StringVar(&opts.S3SecretKey, "s3secretkey", opts.S3SecretKey, "S3 secret key")
+	flags.StringVar(&opts.S3Region, "s3region", opts.S3Region, "S3 region")
+	flags.StringVar(&opts.S3Bucket, "s3bucket", opts.S3Bucket, "S3 bucket")
+	flags.BoolVar(&opts.S3SSL, "s3ssl", opts.S3SSL, "Use https for S3")
+	flags.Int64Var(&opts.MaxFileSize, "maxsize", opts.MaxFileSize, "Max upload size in bytes, 0 means no limit")
+	flags.DurationVar(&opts.ReapInterval, "reap", opts.ReapInterval, "Interval to delete expired files, 0 disables it")
+	flags.Float64Var(&opts.Rate, "rate", opts.Rate, "Sustained requests per second allowed per client")
+	flags.IntVar(&opts.Burst, "burst", opts.Burst, "Requests a client may make at once")
+	flags.DurationVar(&opts.IdleTimeout, "idletimeout", opts.IdleTimeout, "Forget rate limits of clients idle for that long")
+	flags.IntVar(&opts.MaxClients, "maxclients", opts.MaxClients, "Max number of clients tracked by the rate limiter")
+	flags.Int64Var(&opts.Quota, "quota", opts.Quota, "Bytes a client may transfer per quota window, 0 means no quota")
+	flags.DurationVar(&opts.QuotaWindow, "quotawindow", opts.QuotaWindow, "Rolling window of the byte quota")
+	flags.Int64Var(&opts.Bandwidth, "bandwidth", opts.Bandwidth, "Bytes per second a client may transfer, 0 means no limit")
+	flags.Int64Var(&opts.GlobalBW, "globalbandwidth", opts.GlobalBW, "Bytes per second all clients together may transfer, 0 means no limit")
+	flags.BoolVar(&opts.RedisLimit, "redislimit", opts.RedisLimit, "Share rate limits between replicas in redis, requires -redis")
+	flags.StringVar(&opts.LimitFailure, "limitfailure", opts.LimitFailure, "Rate limiting while redis is unreachable: local, open or closed")
+	flags.StringVar(&opts.TrustedProxy, "trustedproxies", opts.TrustedProxy, "Comma separated CIDRs of proxies whose forwarding headers are trusted")
+	flags.IntVar(&opts.IPv6Prefix, "ipv6prefix", opts.IPv6Prefix, "Rate limit IPv6 clients by prefix of that length, 0 uses the full address")
+	flags.StringVar(&opts.LimitBy, "limitby", opts.LimitBy, "Rate limit clients by ip or by authenticated principal")
+	flags.Var(&replaceFlag{values: &opts.APIKeys}, "apikey", "API key as name:key:permissions (ex. ci:secret:rw), may be repeated")
+	flags.StringVar(&opts.TokenSecret, "tokensecret", opts.TokenSecret, "Secret of HMAC signed bearer tokens")
+	flags.StringVar(&opts.JWTSecret, "jwtsecret", opts.JWTSecret, "Secret of HS256 signed JWT")
+	flags.StringVar(&opts.JWKSPath, "jwks", opts.JWKSPath, "Path to JWKS file with RS256 JWT keys")
+	flags.StringVar(&opts.Anonymous, "anonymous", opts.Anonymous, "Permissions of requests without credentials when auth is enabled (ex. read)")
+	flags.StringVar(&opts.Methods, "methods", opts.Methods, "Permissions required by methods (ex. GET=read,DELETE=write+delete)")
+	flags.StringVar(&opts.MetricsPath, "metrics", opts.MetricsPath, "Path of the Prometheus metrics, empty disables them")
+	flags.StringVar(&opts.MetricsAddr, "metricsaddr", opts.MetricsAddr, "Separate listen address of the metrics (ex. :9100)")
+	flags.StringVar(&opts.LogFormat, "logformat", opts.LogFormat, "Access log format: logfmt or json")
+	flags.Float64Var(&opts.LogSampling, "logsample", opts.LogSampling, "Fraction of successful requests written to the access log")
+	flags.StringVar(&opts.Trace, "trace", opts.Trace, "Export traces to otlp or stdout, empty disables tracing")
+	flags.StringVar(&opts.OTLPEndpoint, "otlpendpoint", opts.OTLPEndpoint, "OTLP/HTTP collector endpoint")
+	flags.BoolVar(&opts.OTLPInsecure, "otlpinsecure", opts.OTLPInsecure, "Use http for the OTLP collector")
+	flags.Var(&replaceFlag{values: &opts.SignKeys}, "signkey", "Key of signed urls as id:secret, the first one signs, may be repeated for rotation")
+	return flags
+}
+
+// replaceFlag is a repeated flag which replaces the values of the config file
+// instead of adding to them.
+type replaceFlag struct {
+	values *stringsFlag
+	set    bool
+}
+
+func (f *replaceFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return f.values.String()
+}
+
+func (f *replaceFlag) Set(v string) error {
+	if !f.set {
+		*f.values, f.set = nil, true
+	}
+	return f.values.Set(v)
+}
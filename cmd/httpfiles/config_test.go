@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadEnv(t *testing.T) {
+	cases := []struct {
+		name     string
+		env      string
+		value    string
+		field    func(Options) interface{}
+		excepted interface{}
+	}{
+		{"string", "ADDR", ":6000", func(o Options) interface{} { return o.Addr }, ":6000"},
+		{"bool", "H2C", "true", func(o Options) interface{} { return o.H2C }, true},
+		{"int", "BURST", "5", func(o Options) interface{} { return o.Burst }, 5},
+		{"int64", "MAX_SIZE", "1024", func(o Options) interface{} { return o.MaxFileSize }, int64(1024)},
+		{"float64", "RATE", "2.5", func(o Options) interface{} { return o.Rate }, 2.5},
+		{"duration", "IDLE_TIMEOUT", "1m30s", func(o Options) interface{} { return o.IdleTimeout }, 90 * time.Second},
+		{"list", "API_KEYS", "ci:secret:rw, ,ops:key:r", func(o Options) interface{} { return o.APIKeys }, stringsFlag{"ci:secret:rw", "ops:key:r"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv(envPrefix+c.env, c.value)
+
+			opts := defaultOptions()
+			if err := loadEnv(&opts); err != nil {
+				t.Fatalf("load env failed, error %v", err)
+			}
+
+			if actual := c.field(opts); !reflect.DeepEqual(actual, c.excepted) {
+				t.Fatalf("bad %s, excepted %v, actual %v", c.env, c.excepted, actual)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, env := range []string{"H2C", "BURST", "MAX_SIZE", "RATE", "IDLE_TIMEOUT"} {
+			t.Setenv(envPrefix+env, "abc")
+
+			opts := defaultOptions()
+			err := loadEnv(&opts)
+			if err == nil || !strings.Contains(err.Error(), envPrefix+env) {
+				t.Fatalf("excepted an error of %s, actual %v", env, err)
+			}
+			t.Setenv(envPrefix+env, "1")
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		if err := defaultOptions().Validate(); err != nil {
+			t.Fatalf("excepted valid defaults, actual %v", err)
+		}
+	})
+
+	t.Run("joined", func(t *testing.T) {
+		opts := defaultOptions()
+		opts.Addr = ""
+		opts.Rate = 0
+		opts.MaxFileSize = -1
+		opts.LogFormat = "xml"
+
+		err := opts.Validate()
+		if err == nil {
+			t.Fatal("excepted an error")
+		}
+		for _, key := range []string{"addr:", "rate:", "max_size:", "log_format:"} {
+			if !strings.Contains(err.Error(), key) {
+				t.Fatalf("excepted an error of %s, actual %v", key, err)
+			}
+		}
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		cases := []struct {
+			name     string
+			opts     func(*Options)
+			excepted string
+			valid    bool
+		}{
+			{"fs-default", func(o *Options) {}, "md5", true},
+			{"fs-explicit", func(o *Options) { o.Hash = "sha1" }, "sha1", true},
+			{"sqlite-default", func(o *Options) { o.SQLitePath = "meta.db" }, "sha256", true},
+			{"sqlite-md5", func(o *Options) { o.SQLitePath = "meta.db"; o.Hash = "md5" }, "md5", false},
+			{"unknown", func(o *Options) { o.Hash = "crc32" }, "crc32", false},
+		}
+
+		for _, c := range cases {
+			opts := defaultOptions()
+			c.opts(&opts)
+
+			if opts.hash() != c.excepted {
+				t.Fatalf("bad hash of %s, excepted %s, actual %s", c.name, c.excepted, opts.hash())
+			}
+			if err := opts.Validate(); (err == nil) != c.valid {
+				t.Fatalf("bad validation of %s, excepted valid %v, actual %v", c.name, c.valid, err)
+			}
+		}
+	})
+}
+
+func TestReload(t *testing.T) {
+	cases := []struct {
+		name    string
+		change  func(*Options)
+		restart []string
+	}{
+		{"rate", func(o *Options) { o.Rate = 10 }, []string{}},
+		{"max-size", func(o *Options) { o.MaxFileSize = 1024 }, []string{}},
+		{"sign-keys", func(o *Options) { o.SignKeys = stringsFlag{"k:secret"} }, []string{}},
+		{"addr", func(o *Options) { o.Addr = ":6000" }, []string{"addr"}},
+		{"mixed", func(o *Options) { o.Backend = "s3"; o.Burst = 3; o.LogFormat = "json" }, []string{"backend", "log_format"}},
+		{"config", func(o *Options) { o.Config = "other.yaml" }, []string{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			running := defaultOptions()
+			next := defaultOptions()
+			c.change(&next)
+
+			if keys := restartRequired(running, next); !reflect.DeepEqual(keys, c.restart) {
+				t.Fatalf("bad restart keys, excepted %v, actual %v", c.restart, keys)
+			}
+
+			// the applied options only differ from next by the keys which
+			// need a restart, a second reload reports them again
+			applied := reloaded(running, next)
+			if keys := restartRequired(applied, next); !reflect.DeepEqual(keys, c.restart) {
+				t.Fatalf("bad restart keys after reload, excepted %v, actual %v", c.restart, keys)
+			}
+			if keys := restartRequired(running, applied); len(keys) > 0 {
+				t.Fatalf("excepted the restart options to keep their running values, actual changes %v", keys)
+			}
+		})
+	}
+}
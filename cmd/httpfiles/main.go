@@ -1,73 +1,295 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"log"
+	"log/slog"
 	"net/http"
 
-	"crypto/md5"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/go-redis/redis"
 	"github.com/nameoffnv/httpfiles"
+	"github.com/nameoffnv/httpfiles/metrics"
+	"github.com/nameoffnv/httpfiles/middleware/auth"
 	"github.com/nameoffnv/httpfiles/middleware/limiter"
 	"github.com/nameoffnv/httpfiles/storage"
 	"github.com/nameoffnv/httpfiles/storage/fs"
 	"github.com/nameoffnv/httpfiles/storage/redis_fs"
+	"github.com/nameoffnv/httpfiles/storage/s3"
+	"github.com/nameoffnv/httpfiles/storage/sqlite_fs"
+	"github.com/nameoffnv/httpfiles/tlscert"
+	"github.com/nameoffnv/httpfiles/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
-type Options struct {
-	RedisHost     string
-	RedisPassword string
-	RedisDB       int
-	StorePath     string
+// stringsFlag collects the values of a repeated flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
 }
 
+const usage = `Usage: %[1]s <command> [flags] [args]
+
+Commands:
+  serve    start the server, the default without a command
+  upload   upload files and directories
+  get      download a file
+  rm       remove files
+  stat     show file info
+  ls       list files
+  sign     print a signed url
+
+Run "%[1]s <command> -h" for the flags of a command.
+`
+
 func main() {
-	opts := Options{}
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "serve":
+		runServe(args)
+	case "sign":
+		err = runSign(args)
+	case "upload":
+		err = runUpload(args)
+	case "get":
+		err = runGet(args)
+	case "rm":
+		err = runRm(args)
+	case "stat":
+		err = runStat(args)
+	case "ls":
+		err = runLs(args)
+	case "help":
+		fmt.Printf(usage, os.Args[0])
+	default:
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: %v\n", os.Args[0], command, err)
+		os.Exit(1)
+	}
+}
 
-	flag.StringVar(&opts.RedisHost, "redis", "", "Redis host and port (ex. localhost:6379)")
-	flag.StringVar(&opts.RedisPassword, "redispassword", "", "Redis password")
-	flag.IntVar(&opts.RedisDB, "redisdb", 0, "Redis database")
-	flag.StringVar(&opts.StorePath, "path", "./store", "Path to store files")
-	flag.Parse()
+// runServe starts the server, it only returns on a fatal error.
+func runServe(args []string) {
+	opts, err := loadOptions(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signingKeys, err := parseSigningKeys(opts.SignKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	var s storage.Storage
-	if opts.RedisHost != "" {
+	backend := opts.backend()
+	switch backend {
+	case "s3":
+		s3Storage, err := s3.New(s3.Options{
+			Endpoint:  opts.S3Endpoint,
+			AccessKey: opts.S3AccessKey,
+			SecretKey: opts.S3SecretKey,
+			Region:    opts.S3Region,
+			Bucket:    opts.S3Bucket,
+			UseSSL:    opts.S3SSL,
+		}, httpfiles.Hashes[opts.hash()])
+		if err != nil {
+			log.Fatal(err)
+		}
+		s = s3Storage
+	case "redis_fs":
 		redisStorage, err := redis_fs.New(opts.RedisHost, opts.RedisPassword, opts.RedisDB, opts.StorePath)
 		if err != nil {
 			log.Fatal(err)
 		}
+		if opts.Reconcile {
+			report, err := redisStorage.(*redis_fs.RedisFileStorage).Reconcile()
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("reconcile: registered %d, removed %d, unregistered %d",
+				len(report.Registered), len(report.Removed), len(report.Unregistered))
+		}
 		s = redisStorage
+	case "sqlite_fs":
+		sqliteStorage, err := sqlite_fs.New(opts.SQLitePath, opts.StorePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s = sqliteStorage
+	default:
+		s = fs.New(opts.StorePath, httpfiles.Hashes[opts.hash()])
+	}
+
+	// the innermost storage is closed on shutdown
+	closers := []io.Closer{}
+	if closer, ok := s.(io.Closer); ok {
+		closers = append(closers, closer)
+	}
+
+	if sweeper, ok := s.(storage.Sweeper); ok && opts.TempMaxAge > 0 {
+		if n, err := sweeper.SweepTemp(opts.TempMaxAge); err != nil {
+			log.Printf("sweep temp files: %v", err)
+		} else if n > 0 {
+			log.Printf("removed %d temp files and uploads older than %s", n, opts.TempMaxAge)
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	m := metrics.New(reg)
+	if counter, ok := s.(storage.Counter); ok {
+		m.RegisterTotals(counter, time.Minute)
+	}
+	s = m.InstrumentStorage(s, backend)
+
+	tp, err := newTracerProvider(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tp != nil {
+		defer tp.Shutdown(context.Background())
+		otel.SetTracerProvider(tp)
+		// outermost, so FilesHandler can bind it to the request context
+		s = tracing.InstrumentStorage(s, tp, backend)
+	}
+
+	trustedProxies, err := limiter.ParseTrustedProxies(opts.TrustedProxy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	limitKey := limiter.IPKey(trustedProxies, opts.IPv6Prefix)
+	if opts.LimitBy == "principal" {
+		ipKey := limitKey
+		limitKey = func(req *http.Request) string {
+			if principal := auth.FromContext(req.Context()); principal != nil {
+				return "principal:" + principal.Name
+			}
+			return ipKey(req)
+		}
+	}
+
+	limitOptions := func(opts Options) limiter.Options {
+		// validated by loadOptions
+		failure, _ := limiter.ParseFailurePolicy(opts.LimitFailure)
+		return limiter.Options{
+			KeyFunc:     limitKey,
+			Rate:        opts.Rate,
+			Burst:       opts.Burst,
+			IdleTimeout: opts.IdleTimeout,
+			MaxClients:  opts.MaxClients,
+			Failure:     failure,
+			OnReject:    m.LimiterRejected,
+
+			MaxBytesPerIP:        opts.Quota,
+			QuotaWindow:          opts.QuotaWindow,
+			BytesPerSecond:       opts.Bandwidth,
+			GlobalBytesPerSecond: opts.GlobalBW,
+		}
+	}
+
+	var limit interface {
+		limiter.Backend
+		io.Closer
+		SetOptions(limiter.Options)
+	}
+	if opts.RedisLimit {
+		limitClient := redis.NewClient(&redis.Options{
+			Addr:     opts.RedisHost,
+			Password: opts.RedisPassword,
+			DB:       opts.RedisDB,
+		})
+		closers = append(closers, limitClient)
+		limit = limiter.NewRedis(limitClient, limitOptions(opts))
 	} else {
-		s = fs.New(opts.StorePath, md5.New)
+		localLimit := limiter.New(limitOptions(opts))
+		m.RegisterLimiter(localLimit)
+		limit = localLimit
+	}
+
+	var logHandler slog.Handler
+	switch opts.LogFormat {
+	case "json":
+		logHandler = slog.NewJSONHandler(os.Stderr, nil)
+	default:
+		logHandler = slog.NewTextHandler(os.Stderr, nil)
+	}
+
+	fileOpts := []httpfiles.Option{
+		httpfiles.MaxFileSize(opts.MaxFileSize),
+		httpfiles.ReapInterval(opts.ReapInterval),
+		httpfiles.AccessLog(slog.New(logHandler)),
+		httpfiles.LogSampling(opts.LogSampling),
+	}
+	if tp != nil {
+		fileOpts = append(fileOpts, httpfiles.Tracing(tp))
+	}
+	var signer *httpfiles.Signer
+	if len(signingKeys) > 0 {
+		signer = httpfiles.NewSigner(signingKeys...)
+		fileOpts = append(fileOpts, httpfiles.SignedURLs(signer))
 	}
 
-	limit := limiter.New(limiter.Options{MaxRequestPerSecond: 1})
-	filesMux, err := httpfiles.New(s)
+	filesMux, err := httpfiles.New(s, fileOpts...)
 	if err != nil {
 		log.Fatal(err)
 	}
+	closers = append([]io.Closer{filesMux, limit}, closers...)
+	filesMux.OnHashMismatch = m.HashMismatch
 
 	// stat func
 	filesMux.Handle("/stat", filesMux.WithContext(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		if opts.RedisHost == "" {
-			rw.WriteHeader(http.StatusNotImplemented)
-			return
-		}
-
 		ctxStorage := filesMux.GetStorage(req)
 		if ctxStorage == nil {
 			http.Error(rw, "storage not found", http.StatusInternalServerError)
 			return
 		}
 
-		redisStorage, ok := ctxStorage.(*redis_fs.RedisFileStorage)
-		if !ok {
-			http.Error(rw, "storage cast to redis storage failed", http.StatusInternalServerError)
+		var stats interface{}
+		var err error
+		switch st := storage.Unwrap(ctxStorage).(type) {
+		case *redis_fs.RedisFileStorage:
+			stats, err = st.StatAll()
+		case *sqlite_fs.SQLiteFileStorage:
+			query := req.URL.Query()
+			stats, err = st.StatAll(sqlite_fs.Filter{
+				FilenamePrefix: query.Get("prefix"),
+				SortBy:         query.Get("sort"),
+				Desc:           query.Get("desc") != "",
+			})
+		default:
+			rw.WriteHeader(http.StatusNotImplemented)
 			return
 		}
 
-		stats, err := redisStorage.StatAll()
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
@@ -76,8 +298,370 @@ func main() {
 		json.NewEncoder(rw).Encode(stats)
 	})))
 
-	log.Printf("start listening :5000")
-	if err := http.ListenAndServe(":5000", limit.LimitMiddleware(filesMux)); err != nil {
+	var handler http.Handler = filesMux
+
+	// the principal is only known inside the auth middleware
+	if opts.LimitBy == "principal" {
+		handler = limiter.Middleware(limit, limitKey, handler)
+	}
+
+	authenticators, err := serveAuthenticators(opts, signer)
+	if err != nil {
 		log.Fatal(err)
 	}
+	var authMiddleware *auth.Auth
+	if len(authenticators) > 0 {
+		authMiddleware = auth.New(authOptions(opts), authenticators...)
+		handler = authMiddleware.AuthMiddleware(handler)
+	}
+
+	if opts.LimitBy != "principal" {
+		handler = limiter.Middleware(limit, limitKey, handler)
+	}
+
+	handler = m.Middleware(handler)
+
+	if opts.MetricsPath != "" {
+		metricsHandler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+		if opts.MetricsAddr != "" {
+			metricsMux := http.NewServeMux()
+			metricsMux.Handle(opts.MetricsPath, metricsHandler)
+			metricsSrv := newServer(opts, opts.MetricsAddr, metricsMux)
+			// closed last, a scrape may still see the shutdown
+			closers = append(closers, metricsSrv)
+			go func() {
+				log.Printf("metrics listening %s", opts.MetricsAddr)
+				if err := metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+					log.Fatal(err)
+				}
+			}()
+		} else {
+			// scrapes bypass auth and the limiter
+			rootMux := http.NewServeMux()
+			rootMux.Handle(opts.MetricsPath, metricsHandler)
+			rootMux.Handle("/", handler)
+			handler = rootMux
+		}
+	}
+
+	srv := newServer(opts, opts.Addr, handler)
+	var certs *tlscert.Reloader
+	if opts.TLSCert != "" {
+		if certs, err = tlscert.New(opts.TLSCert, opts.TLSKey); err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+		if opts.TLSClientCA != "" {
+			if srv.TLSConfig.ClientCAs, err = tlscert.LoadCertPool(opts.TLSClientCA); err != nil {
+				log.Fatal(err)
+			}
+			srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			if opts.TLSClientAuth == "request" {
+				srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+		}
+	}
+
+	go reloadOnHangup(args, opts, func(next Options) error {
+		if certs != nil {
+			if err := certs.Reload(); err != nil {
+				return err
+			}
+		}
+		signingKeys, err := parseSigningKeys(next.SignKeys)
+		if err != nil {
+			return err
+		}
+		if (signer == nil) != (len(signingKeys) == 0) {
+			return fmt.Errorf("enabling or disabling signed urls requires a restart")
+		}
+		authenticators, err := serveAuthenticators(next, signer)
+		if err != nil {
+			return err
+		}
+		if (authMiddleware == nil) != (len(authenticators) == 0) {
+			return fmt.Errorf("enabling or disabling auth requires a restart")
+		}
+
+		limit.SetOptions(limitOptions(next))
+		filesMux.SetFileSizeLimit(next.MaxFileSize)
+		if signer != nil {
+			signer.SetKeys(signingKeys...)
+		}
+		if authMiddleware != nil {
+			authMiddleware.SetOptions(authOptions(next))
+			authMiddleware.SetAuthenticators(authenticators...)
+		}
+		return nil
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		shutdown(srv, opts.ShutdownTimeout)
+		close(stopped)
+	}()
+
+	log.Printf("start listening %s", opts.Addr)
+	if certs != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-stopped
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}
+	log.Print("stopped")
+}
+
+// shutdown waits for SIGTERM or SIGINT, stops accepting connections and waits
+// up to timeout for running requests. The connections of requests still
+// running then are closed, as on a second signal.
+func shutdown(srv *http.Server, timeout time.Duration) {
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	sig := <-stop
+	log.Printf("shutdown: %s, draining requests for %s", sig, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-stop:
+			log.Printf("shutdown: %s, closing connections", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v, closing connections", err)
+		srv.Close()
+	}
+}
+
+// newServer returns a server with the timeouts of the options, they keep slow
+// clients from holding connections open.
+func newServer(opts Options, addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		ReadTimeout:       opts.ReadTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.HTTPIdleTimeout,
+	}
+	if opts.H2C {
+		srv.Protocols = &http.Protocols{}
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return srv
+}
+
+// reloadOnHangup reads the options again on SIGHUP and applies the reloadable
+// ones, on error the current options are kept. Changes of the others are
+// logged, they need a restart.
+func reloadOnHangup(args []string, opts Options, apply func(Options) error) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for range hangup {
+		next, err := loadOptions(args)
+		if err != nil {
+			log.Printf("reload: %v", err)
+			continue
+		}
+		if err := apply(next); err != nil {
+			log.Printf("reload: %v", err)
+			continue
+		}
+		if keys := restartRequired(opts, next); len(keys) > 0 {
+			log.Printf("reload: restart to apply %s", strings.Join(keys, ", "))
+		}
+		opts = reloaded(opts, next)
+		log.Printf("reload: applied %s", next.Config)
+	}
+}
+
+// serveAuthenticators returns the authenticators of the options, signed urls
+// are checked first.
+func serveAuthenticators(opts Options, signer *httpfiles.Signer) ([]auth.Authenticator, error) {
+	authenticators, err := newAuthenticators(opts)
+	if err != nil {
+		return nil, err
+	}
+	if signer != nil {
+		authenticators = append([]auth.Authenticator{signedURLs{signer}}, authenticators...)
+	}
+	return authenticators, nil
+}
+
+// authOptions returns the auth options, validated by loadOptions.
+func authOptions(opts Options) auth.Options {
+	authOpts := auth.Options{}
+	authOpts.Anonymous, _ = auth.ParsePermission(opts.Anonymous)
+	authOpts.Methods, _ = auth.ParseMethods(opts.Methods)
+	return authOpts
+}
+
+func newAuthenticators(opts Options) ([]auth.Authenticator, error) {
+	authenticators := []auth.Authenticator{}
+
+	if len(opts.APIKeys) > 0 {
+		keys := auth.StaticKeys{}
+		for _, def := range opts.APIKeys {
+			key, principal, err := auth.ParseStaticKey(def)
+			if err != nil {
+				return nil, err
+			}
+			keys[key] = principal
+		}
+		authenticators = append(authenticators, keys)
+	}
+
+	if opts.TokenSecret != "" {
+		authenticators = append(authenticators, auth.HMACTokens{Secret: []byte(opts.TokenSecret)})
+	}
+
+	if opts.JWTSecret != "" || opts.JWKSPath != "" {
+		j := &auth.JWT{Secret: []byte(opts.JWTSecret)}
+		if opts.JWKSPath != "" {
+			keys, err := auth.LoadJWKS(opts.JWKSPath)
+			if err != nil {
+				return nil, err
+			}
+			j.Keys = keys
+		}
+		authenticators = append(authenticators, j)
+	}
+
+	if len(opts.CertPrincipals) > 0 {
+		certs := auth.ClientCerts{}
+		for _, def := range opts.CertPrincipals {
+			name, principal, err := auth.ParseClientCert(def)
+			if err != nil {
+				return nil, err
+			}
+			certs[name] = principal
+		}
+		authenticators = append(authenticators, certs)
+	}
+
+	return authenticators, nil
+}
+
+// signedURLs lets requests with a valid url signature pass the auth
+// middleware, FilesHandler verifies them again and applies the upload policy.
+type signedURLs struct {
+	signer *httpfiles.Signer
+}
+
+func (s signedURLs) Authenticate(req *http.Request) (*auth.Principal, error) {
+	if !httpfiles.IsSigned(req) {
+		return nil, nil
+	}
+
+	if err := s.signer.Verify(req); err != nil {
+		return nil, err
+	}
+
+	perm := auth.PermRead
+	if req.Method == http.MethodPost {
+		perm = auth.PermWrite
+	}
+	return &auth.Principal{Name: "signed-url", Permissions: perm}, nil
+}
+
+func parseSigningKeys(defs []string) ([]httpfiles.SigningKey, error) {
+	keys := make([]httpfiles.SigningKey, 0, len(defs))
+	for _, def := range defs {
+		parts := strings.SplitN(def, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid signing key '%s', excepted id:secret", def)
+		}
+		keys = append(keys, httpfiles.SigningKey{ID: parts[0], Secret: []byte(parts[1])})
+	}
+	return keys, nil
+}
+
+// runSign prints a signed download url for the given hash, or a signed upload
+// url with -upload.
+func runSign(args []string) error {
+	var keys stringsFlag
+	var hashes stringsFlag
+
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	fs.Var(&keys, "signkey", "Key as id:secret, the first one signs")
+	upload := fs.Bool("upload", false, "Sign an upload url instead of a download url")
+	maxSize := fs.Int64("maxsize", 0, "Max size of the uploaded file in bytes")
+	fs.Var(&hashes, "hash", "Expected hash of the uploaded file as algorithm=hash (ex. sha256=...), may be repeated")
+	expires := fs.Duration("expires", time.Hour, "Lifetime of the url")
+	baseURL := fs.String("url", "http://localhost:5000", "Base url of the server")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s sign [flags] [hash]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	signingKeys, err := parseSigningKeys(keys)
+	if err != nil {
+		return err
+	}
+	signer := httpfiles.NewSigner(signingKeys...)
+	expireDate := time.Now().Add(*expires)
+
+	var signed string
+	if *upload {
+		policy := httpfiles.UploadPolicy{MaxSize: *maxSize, Hashes: map[string]string{}}
+		for _, h := range hashes {
+			parts := strings.SplitN(h, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid hash '%s', excepted algorithm=hash", h)
+			}
+			policy.Hashes[parts[0]] = parts[1]
+		}
+		signed, err = signer.SignUpload(policy, expireDate)
+	} else {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		signed, err = signer.SignDownload(fs.Arg(0), expireDate)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(strings.TrimSuffix(*baseURL, "/") + signed)
+	return nil
+}
+
+func newTracerProvider(opts Options) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch opts.Trace {
+	case "":
+		return nil, nil
+	case "otlp":
+		exporter, err = tracing.NewOTLPExporter(context.Background(), opts.OTLPEndpoint, opts.OTLPInsecure)
+	case "stdout":
+		exporter, err = tracing.NewStdoutExporter(os.Stdout)
+	default:
+		return nil, fmt.Errorf("unknown -trace %s", opts.Trace)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tracing.NewProvider(exporter, "httpfiles"), nil
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const progressWidth = 30
+
+// progressBar draws the progress of a transfer on a single terminal line, it
+// draws nothing if the output is not a terminal.
+type progressBar struct {
+	w       io.Writer
+	label   string
+	total   int64
+	started time.Time
+
+	lock    sync.Mutex
+	current int64
+	drawn   time.Time
+}
+
+func newProgressBar(label string, total int64, quiet bool) *progressBar {
+	p := &progressBar{label: label, total: total, started: time.Now()}
+	if fi, err := os.Stderr.Stat(); !quiet && err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		p.w = os.Stderr
+	}
+	return p
+}
+
+// Set updates the transferred bytes, it may be called from another goroutine.
+func (p *progressBar) Set(n int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.current = n
+	if time.Since(p.drawn) >= 100*time.Millisecond {
+		p.draw()
+	}
+}
+
+func (p *progressBar) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	n := p.current + int64(len(b))
+	p.lock.Unlock()
+
+	p.Set(n)
+	return len(b), nil
+}
+
+// Done draws the final state and ends the line.
+func (p *progressBar) Done() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.w == nil {
+		return
+	}
+	p.draw()
+	fmt.Fprintln(p.w)
+}
+
+func (p *progressBar) draw() {
+	p.drawn = time.Now()
+	if p.w == nil {
+		return
+	}
+
+	filled := progressWidth
+	percent := 100
+	if p.total > 0 {
+		filled = int(p.current * progressWidth / p.total)
+		percent = int(p.current * 100 / p.total)
+	}
+	if filled > progressWidth {
+		filled = progressWidth
+	}
+
+	var rate int64
+	if elapsed := time.Since(p.started).Seconds(); elapsed > 0 {
+		rate = int64(float64(p.current) / elapsed)
+	}
+
+	fmt.Fprintf(p.w, "\r%-24.24s [%s%s] %3d%% %s/%s %s/s\x1b[K", p.label,
+		strings.Repeat("#", filled), strings.Repeat(".", progressWidth-filled),
+		percent, formatBytes(p.current), formatBytes(p.total), formatBytes(rate))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,102 @@
+package httpfiles
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nameoffnv/httpfiles/storage"
+)
+
+// requestExpireDate reads the object lifetime from the ttl (duration like
+// "24h" or seconds) or expire_at (RFC 3339) url params, or from the X-TTL and
+// X-Expire-At headers. It returns nil when the object never expires.
+func requestExpireDate(req *http.Request, now time.Time) (*time.Time, error) {
+	query := req.URL.Query()
+
+	ttl := query.Get("ttl")
+	if ttl == "" {
+		ttl = req.Header.Get("X-TTL")
+	}
+
+	expireAt := query.Get("expire_at")
+	if expireAt == "" {
+		expireAt = req.Header.Get("X-Expire-At")
+	}
+
+	var expireDate time.Time
+	switch {
+	case ttl != "" && expireAt != "":
+		return nil, fmt.Errorf("ttl and expire_at are mutually exclusive")
+	case ttl != "":
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			seconds, serr := strconv.ParseInt(ttl, 10, 64)
+			if serr != nil {
+				return nil, fmt.Errorf("invalid ttl '%s'", ttl)
+			}
+			d = time.Duration(seconds) * time.Second
+		}
+		expireDate = now.Add(d)
+	case expireAt != "":
+		t, err := time.Parse(time.RFC3339, expireAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expire_at '%s'", expireAt)
+		}
+		expireDate = t
+	default:
+		return nil, nil
+	}
+
+	if !expireDate.After(now) {
+		return nil, fmt.Errorf("expire date %s is in the past", expireDate.Format(time.RFC3339))
+	}
+
+	expireDate = expireDate.UTC()
+	return &expireDate, nil
+}
+
+// expireDate reads the requested expire date like requestExpireDate, it is
+// rejected if the storage can not find expired objects, e.g. s3 and fs, as
+// the object would never be deleted.
+func (s *FilesHandler) expireDate(req *http.Request) (*time.Time, error) {
+	expireDate, err := requestExpireDate(req, time.Now())
+	if err != nil || expireDate == nil {
+		return expireDate, err
+	}
+
+	if _, ok := s.storage.(storage.Expirer); !ok {
+		return nil, fmt.Errorf("ttl and expire_at are not supported by the storage")
+	}
+	return expireDate, nil
+}
+
+// reap deletes expired objects every interval until Close is called.
+func (s *FilesHandler) reap(expirer storage.Expirer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.deleteExpired(expirer, now)
+		}
+	}
+}
+
+func (s *FilesHandler) deleteExpired(expirer storage.Expirer, now time.Time) {
+	ids, err := expirer.Expired(now)
+	if err != nil {
+		s.logger.Error("reaper: list expired", "error", err)
+		return
+	}
+
+	for _, id := range ids {
+		if err := s.storage.Delete(id); err != nil && err != storage.ErrNotFound {
+			s.logger.Error("reaper: delete", "hash", id, "error", err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package httpfiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/nameoffnv/httpfiles/storage"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// handleList serves "GET /?list", a page of stored objects as JSON. The page
+// is selected by the prefix, from, to (RFC 3339 or unix seconds), sort (size
+// or date), order (asc or desc), limit and cursor url params, the cursor of
+// the next page is returned in the "next" field.
+func (s *FilesHandler) handleList(rw http.ResponseWriter, req *http.Request) {
+	lister, ok := s.requestStorage(req).(storage.Lister)
+	if !ok {
+		http.Error(rw, "listing not supported by storage", http.StatusNotImplemented)
+		return
+	}
+
+	opts, err := listOptions(req.URL.Query())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := lister.List(opts)
+	switch err {
+	case nil:
+	case storage.ErrInvalidCursor:
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	case storage.ErrNotSupported:
+		http.Error(rw, "listing not supported by storage", http.StatusNotImplemented)
+		return
+	default:
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(page); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func listOptions(query url.Values) (storage.ListOptions, error) {
+	opts := storage.ListOptions{
+		Prefix: query.Get("prefix"),
+		Cursor: query.Get("cursor"),
+		Limit:  defaultListLimit,
+	}
+
+	var err error
+	if opts.Sort, err = storage.ParseListSort(query.Get("sort")); err != nil {
+		return opts, err
+	}
+
+	switch order := query.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, fmt.Errorf("invalid order '%s'", order)
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > maxListLimit {
+			return opts, fmt.Errorf("invalid limit '%s', 1 to %d", limit, maxListLimit)
+		}
+		opts.Limit = n
+	}
+
+	if opts.From, err = parseListTime(query.Get("from")); err != nil {
+		return opts, fmt.Errorf("invalid from '%s'", query.Get("from"))
+	}
+	if opts.To, err = parseListTime(query.Get("to")); err != nil {
+		return opts, fmt.Errorf("invalid to '%s'", query.Get("to"))
+	}
+
+	return opts, nil
+}
+
+func parseListTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
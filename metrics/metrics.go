@@ -0,0 +1,249 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nameoffnv/httpfiles"
+	"github.com/nameoffnv/httpfiles/middleware/limiter"
+	"github.com/nameoffnv/httpfiles/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "httpfiles"
+
+// Metrics collects the Prometheus metrics of the file server.
+type Metrics struct {
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	uploadedBytes     prometheus.Counter
+	downloadedBytes   prometheus.Counter
+	hashMismatches    *prometheus.CounterVec
+	limiterRejections *prometheus.CounterVec
+	storageDuration   *prometheus.HistogramVec
+
+	registerer prometheus.Registerer
+}
+
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Handled HTTP requests by method and status.",
+		}, []string{"method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Latency of HTTP requests by method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "status"}),
+		uploadedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "uploaded_bytes_total",
+			Help:      "Bytes read from request bodies.",
+		}),
+		downloadedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "downloaded_bytes_total",
+			Help:      "Bytes written to response bodies.",
+		}),
+		hashMismatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "hash_mismatches_total",
+			Help:      "Uploads rejected because of a client provided hash by algorithm.",
+		}, []string{"algorithm"}),
+		limiterRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "limiter_rejections_total",
+			Help:      "Requests rejected by the limiter by reason.",
+		}, []string{"reason"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Latency of storage operations by backend, operation and result.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"backend", "operation", "result"}),
+		registerer: reg,
+	}
+
+	reg.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.uploadedBytes,
+		m.downloadedBytes,
+		m.hashMismatches,
+		m.limiterRejections,
+		m.storageDuration,
+	)
+
+	return m
+}
+
+// Middleware counts the requests and transferred bytes of next.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		mrw := &responseWriter{ResponseWriter: rw}
+		if req.Body != nil {
+			body := &bodyReader{ReadCloser: req.Body}
+			req.Body = body
+			defer func() { m.uploadedBytes.Add(float64(body.n)) }()
+		}
+
+		next.ServeHTTP(mrw, req)
+
+		status := mrw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		labels := prometheus.Labels{"method": methodLabel(req.Method), "status": strconv.Itoa(status)}
+		m.requests.With(labels).Inc()
+		m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+		m.downloadedBytes.Add(float64(mrw.n))
+	})
+}
+
+// methodLabel keeps the method label bounded, clients may send any method.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// HashMismatch is meant for FilesHandler.OnHashMismatch.
+func (m *Metrics) HashMismatch(req *http.Request, err *httpfiles.HashMismatchError) {
+	m.hashMismatches.WithLabelValues(err.Algorithm).Inc()
+}
+
+// LimiterRejected is meant for limiter.Options.OnReject.
+func (m *Metrics) LimiterRejected(reason string) {
+	m.limiterRejections.WithLabelValues(reason).Inc()
+}
+
+// RegisterLimiter exports the size of the client table of the limiter.
+func (m *Metrics) RegisterLimiter(l *limiter.Limiter) {
+	m.registerer.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "limiter_clients",
+			Help:      "Clients tracked by the limiter.",
+		}, func() float64 {
+			return float64(l.Stats().Clients)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "limiter_evictions_total",
+			Help:      "Clients evicted from the limiter.",
+		}, func() float64 {
+			return float64(l.Stats().Evictions)
+		}),
+	)
+}
+
+// RegisterTotals exports the number and size of stored objects, counting is
+// expensive for some storages so the result is cached for interval.
+func (m *Metrics) RegisterTotals(counter storage.Counter, interval time.Duration) {
+	m.registerer.MustRegister(&totalsCollector{
+		counter:  counter,
+		interval: interval,
+		objects: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "stored_objects"),
+			"Objects in the storage.", nil, nil),
+		bytes: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "stored_bytes"),
+			"Size of the objects in the storage.", nil, nil),
+	})
+}
+
+type totalsCollector struct {
+	counter  storage.Counter
+	interval time.Duration
+	objects  *prometheus.Desc
+	bytes    *prometheus.Desc
+
+	lock        sync.Mutex
+	updated     time.Time
+	objectCount int64
+	size        int64
+}
+
+func (c *totalsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.objects
+	ch <- c.bytes
+}
+
+func (c *totalsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if time.Since(c.updated) >= c.interval {
+		objects, size, err := c.counter.Count()
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(c.objects, err)
+			return
+		}
+		c.objectCount, c.size, c.updated = objects, size, time.Now()
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.objects, prometheus.GaugeValue, float64(c.objectCount))
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(c.size))
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// ReadFrom keeps the io.ReaderFrom of the underlying writer, e.g. sendfile.
+func (w *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.n += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type bodyReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,149 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"crypto/sha256"
+
+	"github.com/nameoffnv/httpfiles"
+	"github.com/nameoffnv/httpfiles/metrics"
+	"github.com/nameoffnv/httpfiles/storage"
+	"github.com/nameoffnv/httpfiles/storage/memory"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := metrics.New(reg)
+
+	s := m.InstrumentStorage(memory.New(sha256.New), "memory")
+	if _, ok := s.(storage.Uploader); !ok {
+		t.Fatal("instrumented storage lost the Uploader capability")
+	}
+	if _, ok := storage.Unwrap(s).(*memory.MemoryStorage); !ok {
+		t.Fatal("unwrap did not return the memory storage")
+	}
+
+	fh, err := httpfiles.New(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.OnHashMismatch = m.HashMismatch
+	m.RegisterTotals(s.(storage.Counter), time.Minute)
+	handler := m.Middleware(fh)
+
+	testObj := []byte("hello world")
+	var downloaded int
+	serve := func(method, target string, body []byte) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, target, bytes.NewReader(body)))
+		downloaded += rr.Body.Len()
+		return rr
+	}
+
+	if rr := serve(http.MethodPost, "/", testObj); rr.Code != http.StatusCreated {
+		t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusCreated, rr.Code)
+	}
+	if rr := serve(http.MethodPost, "/?md5=aaa", testObj); rr.Code != http.StatusBadRequest {
+		t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusBadRequest, rr.Code)
+	}
+	if rr := serve(http.MethodGet, "/b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", nil); rr.Code != http.StatusOK {
+		t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusOK, rr.Code)
+	}
+	serve("BREW", "/", nil)
+
+	cases := []struct {
+		name     string
+		labels   map[string]string
+		excepted float64
+	}{
+		{"httpfiles_requests_total", map[string]string{"method": "POST", "status": "201"}, 1},
+		{"httpfiles_requests_total", map[string]string{"method": "POST", "status": "400"}, 1},
+		{"httpfiles_requests_total", map[string]string{"method": "other"}, 1},
+		{"httpfiles_uploaded_bytes_total", nil, float64(2 * len(testObj))},
+		{"httpfiles_downloaded_bytes_total", nil, float64(downloaded)},
+		{"httpfiles_hash_mismatches_total", map[string]string{"algorithm": "md5"}, 1},
+		{"httpfiles_storage_operation_duration_seconds", map[string]string{"backend": "memory", "operation": "save", "result": "ok"}, 1},
+		{"httpfiles_stored_objects", nil, 1},
+		{"httpfiles_stored_bytes", nil, float64(len(testObj))},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if actual := value(t, reg, c.name, c.labels); actual != c.excepted {
+				t.Fatalf("bad value of %s%v, excepted %v, actual %v", c.name, c.labels, c.excepted, actual)
+			}
+		})
+	}
+}
+
+// value returns the value of the metric with the labels, the sample count of
+// histograms.
+func value(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+
+	metrics:
+		for _, metric := range f.GetMetric() {
+			for _, l := range metric.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+					continue metrics
+				}
+			}
+
+			switch {
+			case metric.Counter != nil:
+				return metric.GetCounter().GetValue()
+			case metric.Gauge != nil:
+				return metric.GetGauge().GetValue()
+			case metric.Histogram != nil:
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+
+	t.Fatalf("metric %s%v not found", name, labels)
+	return 0
+}
+
+// deadlineWriter supports the write deadline of http.ResponseController.
+type deadlineWriter struct {
+	*httptest.ResponseRecorder
+	deadline time.Time
+}
+
+func (w *deadlineWriter) SetWriteDeadline(deadline time.Time) error {
+	w.deadline = deadline
+	return nil
+}
+
+func TestMiddlewareResponseController(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+
+	deadline := time.Now().Add(time.Minute)
+	handler := m.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if err := http.NewResponseController(rw).SetWriteDeadline(deadline); err != nil {
+			t.Errorf("set write deadline failed, error %v", err)
+		}
+	}))
+
+	rw := &deadlineWriter{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if !rw.deadline.Equal(deadline) {
+		t.Fatalf("bad write deadline, excepted %v, actual %v", deadline, rw.deadline)
+	}
+}
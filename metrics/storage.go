@@ -0,0 +1,179 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/nameoffnv/httpfiles/storage"
+)
+
+// InstrumentStorage wraps s to observe the latency of its operations. The
+// Expirer, Uploader, Sweeper, Counter and Lister capabilities of s are kept,
+// List fails with storage.ErrNotSupported if s is not a storage.Lister.
+func (m *Metrics) InstrumentStorage(s storage.Storage, backend string) storage.Storage {
+	return wrap(&instrumentedStorage{Storage: s, metrics: m, backend: backend})
+}
+
+func wrap(base *instrumentedStorage) storage.Storage {
+	return storage.Wrap(base, base.Storage, storage.Hooks{
+		Expirer: func(e storage.Expirer) storage.Expirer {
+			return &instrumentedExpirer{base, e}
+		},
+		Uploader: func(u storage.Uploader) storage.Uploader {
+			return &instrumentedUploader{base, u}
+		},
+	})
+}
+
+type instrumentedStorage struct {
+	storage.Storage
+	metrics *Metrics
+	backend string
+}
+
+func (s *instrumentedStorage) Unwrap() storage.Storage {
+	return s.Storage
+}
+
+// WithContext binds the wrapped storage, e.g. a traced one.
+func (s *instrumentedStorage) WithContext(ctx context.Context) storage.Storage {
+	bound := *s
+	if binder, ok := s.Storage.(storage.ContextBinder); ok {
+		bound.Storage = binder.WithContext(ctx)
+	}
+	return wrap(&bound)
+}
+
+// observe records the duration of an operation started at start.
+func (s *instrumentedStorage) observe(operation string, start time.Time, err error) {
+	result := "ok"
+	if err == storage.ErrNotFound {
+		result = "not_found"
+	} else if err != nil {
+		result = "error"
+	}
+	s.metrics.storageDuration.WithLabelValues(s.backend, operation, result).Observe(time.Since(start).Seconds())
+}
+
+func (s *instrumentedStorage) NewObjectWriter() (storage.ObjectWriter, error) {
+	start := time.Now()
+	w, err := s.Storage.NewObjectWriter()
+	s.observe("new_writer", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedWriter{ObjectWriter: w, storage: s}, nil
+}
+
+func (s *instrumentedStorage) Get(id string) (storage.Object, error) {
+	start := time.Now()
+	o, err := s.Storage.Get(id)
+	s.observe("get", start, err)
+	return o, err
+}
+
+func (s *instrumentedStorage) Stat(id string) (*storage.ObjectInfo, error) {
+	start := time.Now()
+	info, err := s.Storage.Stat(id)
+	s.observe("stat", start, err)
+	return info, err
+}
+
+func (s *instrumentedStorage) Delete(id string) error {
+	start := time.Now()
+	err := s.Storage.Delete(id)
+	s.observe("delete", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) Count() (int64, int64, error) {
+	counter, ok := s.Storage.(storage.Counter)
+	if !ok {
+		return 0, 0, nil
+	}
+
+	start := time.Now()
+	objects, size, err := counter.Count()
+	s.observe("count", start, err)
+	return objects, size, err
+}
+
+func (s *instrumentedStorage) List(opts storage.ListOptions) (*storage.ListPage, error) {
+	lister, ok := s.Storage.(storage.Lister)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+
+	start := time.Now()
+	page, err := lister.List(opts)
+	s.observe("list", start, err)
+	return page, err
+}
+
+type instrumentedWriter struct {
+	storage.ObjectWriter
+	storage *instrumentedStorage
+}
+
+func (w *instrumentedWriter) Save() (string, error) {
+	start := time.Now()
+	h, err := w.ObjectWriter.Save()
+	w.storage.observe("save", start, err)
+	return h, err
+}
+
+func (w *instrumentedWriter) Remove() error {
+	start := time.Now()
+	err := w.ObjectWriter.Remove()
+	w.storage.observe("remove", start, err)
+	return err
+}
+
+type instrumentedExpirer struct {
+	storage *instrumentedStorage
+	expirer storage.Expirer
+}
+
+func (e *instrumentedExpirer) Expired(now time.Time) ([]string, error) {
+	start := time.Now()
+	ids, err := e.expirer.Expired(now)
+	e.storage.observe("expired", start, err)
+	return ids, err
+}
+
+type instrumentedUploader struct {
+	storage  *instrumentedStorage
+	uploader storage.Uploader
+}
+
+func (u *instrumentedUploader) NewUpload(info storage.UploadInfo) (storage.Upload, error) {
+	start := time.Now()
+	upload, err := u.uploader.NewUpload(info)
+	u.storage.observe("new_upload", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedUpload{Upload: upload, storage: u.storage}, nil
+}
+
+func (u *instrumentedUploader) GetUpload(id string) (storage.Upload, error) {
+	start := time.Now()
+	upload, err := u.uploader.GetUpload(id)
+	u.storage.observe("get_upload", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedUpload{Upload: upload, storage: u.storage}, nil
+}
+
+type instrumentedUpload struct {
+	storage.Upload
+	storage *instrumentedStorage
+}
+
+func (u *instrumentedUpload) Save() (string, error) {
+	start := time.Now()
+	h, err := u.Upload.Save()
+	u.storage.observe("save", start, err)
+	return h, err
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type ctxKey int
+
+const (
+	ctxPrincipalKey ctxKey = iota
+)
+
+// Principal is the authenticated caller.
+type Principal struct {
+	Name        string
+	Permissions Permission
+}
+
+func (p *Principal) Can(perm Permission) bool {
+	return p.Permissions&perm == perm
+}
+
+// Authenticator checks one kind of credentials. It returns a nil principal
+// and error when the request carries no credentials of its kind.
+type Authenticator interface {
+	Authenticate(*http.Request) (*Principal, error)
+}
+
+type Auth struct {
+	options        Options
+	lock           sync.RWMutex
+	authenticators []Authenticator
+}
+
+func New(opts Options, authenticators ...Authenticator) *Auth {
+	opts.Setup()
+
+	return &Auth{
+		options:        opts,
+		authenticators: authenticators,
+	}
+}
+
+// SetAuthenticators replaces the authenticators, e.g. after the keys were
+// rotated.
+func (a *Auth) SetAuthenticators(authenticators ...Authenticator) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.authenticators = authenticators
+}
+
+// SetOptions replaces the anonymous and method permissions.
+func (a *Auth) SetOptions(opts Options) {
+	opts.Setup()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.options = opts
+}
+
+func (a *Auth) GetPrincipal(req *http.Request) *Principal {
+	return FromContext(req.Context())
+}
+
+// FromContext returns the principal stored by AuthMiddleware, or nil.
+func FromContext(ctx context.Context) *Principal {
+	principal, ok := ctx.Value(ctxPrincipalKey).(*Principal)
+	if !ok {
+		return nil
+	}
+	return principal
+}
+
+// WithPrincipal stores the principal in the request context, it allows other
+// middlewares, e.g. signed urls, to authorize a request.
+func WithPrincipal(req *http.Request, principal *Principal) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), ctxPrincipalKey, principal))
+}
+
+func (a *Auth) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		a.lock.RLock()
+		opts := a.options
+		a.lock.RUnlock()
+
+		required, ok := opts.Methods[req.Method]
+		if !ok {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		principal := FromContext(req.Context())
+		if principal == nil {
+			var err error
+			principal, err = a.authenticate(req)
+			if err != nil {
+				log.Printf("remote: %s - authentication failed: %v", req.RemoteAddr, err)
+				unauthorized(rw)
+				return
+			}
+		}
+
+		if principal == nil {
+			// credentials no authenticator understood are not anonymous
+			if req.Header.Get("Authorization") != "" || req.Header.Get("X-API-Key") != "" {
+				unauthorized(rw)
+				return
+			}
+			if opts.Anonymous&required != required {
+				unauthorized(rw)
+				return
+			}
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		if !principal.Can(required) {
+			http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(rw, WithPrincipal(req, principal))
+	})
+}
+
+func (a *Auth) authenticate(req *http.Request) (*Principal, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for _, authenticator := range a.authenticators {
+		principal, err := authenticator.Authenticate(req)
+		if err != nil {
+			return nil, err
+		}
+		if principal != nil {
+			return principal, nil
+		}
+	}
+	return nil, nil
+}
+
+func unauthorized(rw http.ResponseWriter) {
+	rw.Header().Set("WWW-Authenticate", `Bearer realm="httpfiles"`)
+	http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(req *http.Request) string {
+	header := req.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
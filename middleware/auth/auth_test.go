@@ -0,0 +1,250 @@
+package auth_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/nameoffnv/httpfiles/middleware/auth"
+)
+
+func newHandler(a *auth.Auth) http.Handler {
+	return a.AuthMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if principal := a.GetPrincipal(req); principal != nil {
+			rw.Header().Set("X-Principal", principal.Name)
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+}
+
+func serve(handler http.Handler, method string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/abc", nil)
+	for k := range header {
+		req.Header.Set(k, header.Get(k))
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+func TestStaticKeys(t *testing.T) {
+	handler := newHandler(auth.New(auth.Options{Anonymous: auth.PermRead}, auth.StaticKeys{
+		"secret": {Name: "ci", Permissions: auth.PermRead | auth.PermWrite},
+	}))
+
+	cases := []struct {
+		name   string
+		method string
+		header http.Header
+		status int
+	}{
+		{"anonymous-read", http.MethodGet, nil, http.StatusOK},
+		{"anonymous-write", http.MethodPost, nil, http.StatusUnauthorized},
+		{"key-write", http.MethodPost, http.Header{"X-Api-Key": {"secret"}}, http.StatusOK},
+		{"key-delete", http.MethodDelete, http.Header{"X-Api-Key": {"secret"}}, http.StatusForbidden},
+		{"bad-key", http.MethodGet, http.Header{"X-Api-Key": {"wrong"}}, http.StatusUnauthorized},
+		{"unknown-method", http.MethodPut, http.Header{"X-Api-Key": {"secret"}}, http.StatusMethodNotAllowed},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rr := serve(handler, c.method, c.header)
+			if rr.Code != c.status {
+				t.Fatalf("bad response status code, excepted %d, actual %d", c.status, rr.Code)
+			}
+		})
+	}
+
+	t.Run("principal", func(t *testing.T) {
+		rr := serve(handler, http.MethodGet, http.Header{"X-Api-Key": {"secret"}})
+		if rr.Header().Get("X-Principal") != "ci" {
+			t.Fatalf("bad principal, excepted ci, actual '%s'", rr.Header().Get("X-Principal"))
+		}
+	})
+}
+
+func TestHMACTokens(t *testing.T) {
+	secret := []byte("token secret")
+	handler := newHandler(auth.New(auth.Options{}, auth.HMACTokens{Secret: secret}))
+
+	valid := auth.SignToken(secret, auth.Principal{Name: "alice", Permissions: auth.PermAll}, time.Now().Add(time.Hour))
+	expired := auth.SignToken(secret, auth.Principal{Name: "alice", Permissions: auth.PermAll}, time.Now().Add(-time.Hour))
+	forged := auth.SignToken([]byte("other"), auth.Principal{Name: "alice", Permissions: auth.PermAll}, time.Time{})
+
+	cases := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"valid", valid, http.StatusOK},
+		{"expired", expired, http.StatusUnauthorized},
+		{"forged", forged, http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rr := serve(handler, http.MethodDelete, bearer(c.token))
+			if rr.Code != c.status {
+				t.Fatalf("bad response status code, excepted %d, actual %d", c.status, rr.Code)
+			}
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		rr := serve(handler, http.MethodGet, nil)
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusUnauthorized, rr.Code)
+		}
+		if rr.Header().Get("WWW-Authenticate") == "" {
+			t.Fatal("not found 'WWW-Authenticate' header in response")
+		}
+	})
+}
+
+func TestJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	jwks := fmt.Sprintf(`{"keys":[{"kid":"k1","kty":"RSA","use":"sig","n":"%s","e":"%s"}]}`,
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+	if err := os.WriteFile(jwksPath, []byte(jwks), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := auth.LoadJWKS(jwksPath)
+	if err != nil {
+		t.Fatalf("load jwks failed, error %v", err)
+	}
+
+	secret := []byte("jwt secret")
+	handler := newHandler(auth.New(auth.Options{}, &auth.JWT{Secret: secret, Keys: keys}))
+
+	claims := jwt.MapClaims{
+		"sub":   "bob",
+		"scope": "read write",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+
+	rs256 := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	rs256.Header["kid"] = "k1"
+	rsToken, err := rs256.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hsToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknownKid := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	unknownKid.Header["kid"] = "k2"
+	unknownToken, err := unknownKid.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		token  string
+		status int
+	}{
+		{"rs256", http.MethodPost, rsToken, http.StatusOK},
+		{"hs256", http.MethodGet, hsToken, http.StatusOK},
+		{"scope-missing", http.MethodDelete, rsToken, http.StatusForbidden},
+		{"unknown-kid", http.MethodGet, unknownToken, http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rr := serve(handler, c.method, bearer(c.token))
+			if rr.Code != c.status {
+				t.Fatalf("bad response status code, excepted %d, actual %d", c.status, rr.Code)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	a := auth.New(auth.Options{}, auth.StaticKeys{"old": {Name: "ci", Permissions: auth.PermRead}})
+	handler := newHandler(a)
+
+	a.SetAuthenticators(auth.StaticKeys{"new": {Name: "ci", Permissions: auth.PermRead}})
+	a.SetOptions(auth.Options{Anonymous: auth.PermRead})
+
+	cases := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"old-key", http.Header{"X-Api-Key": {"old"}}, http.StatusUnauthorized},
+		{"new-key", http.Header{"X-Api-Key": {"new"}}, http.StatusOK},
+		{"anonymous", nil, http.StatusOK},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rr := serve(handler, http.MethodGet, c.header)
+			if rr.Code != c.status {
+				t.Fatalf("bad response status code, excepted %d, actual %d", c.status, rr.Code)
+			}
+		})
+	}
+}
+
+func TestClientCerts(t *testing.T) {
+	handler := newHandler(auth.New(auth.Options{}, auth.ClientCerts{
+		"backup": {Name: "backup", Permissions: auth.PermRead},
+	}))
+
+	verified := func(name string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		state  *tls.ConnectionState
+		status int
+	}{
+		{"no-tls", http.MethodGet, nil, http.StatusUnauthorized},
+		{"no-cert", http.MethodGet, &tls.ConnectionState{}, http.StatusUnauthorized},
+		{"read", http.MethodGet, verified("backup"), http.StatusOK},
+		{"write", http.MethodPost, verified("backup"), http.StatusForbidden},
+		{"unknown", http.MethodGet, verified("other"), http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, "/abc", nil)
+			req.TLS = c.state
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != c.status {
+				t.Fatalf("bad response status code, excepted %d, actual %d", c.status, rr.Code)
+			}
+		})
+	}
+}
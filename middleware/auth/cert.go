@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ClientCerts authenticates verified TLS client certificates by the common
+// name of their subject. The certificates are verified during the handshake,
+// see tls.Config.ClientCAs.
+type ClientCerts map[string]Principal
+
+func (c ClientCerts) Authenticate(req *http.Request) (*Principal, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+
+	name := req.TLS.VerifiedChains[0][0].Subject.CommonName
+	principal, ok := c[name]
+	if !ok {
+		return nil, errors.Errorf("unknown client certificate %s", name)
+	}
+	return &principal, nil
+}
+
+// ParseClientCert parses a "commonname:permissions" definition, e.g.
+// "backup.internal:read". The principal is named after the common name.
+func ParseClientCert(s string) (string, Principal, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return "", Principal{}, errors.Errorf("invalid client certificate definition, excepted commonname:permissions")
+	}
+
+	perm, err := ParsePermission(s[i+1:])
+	if err != nil {
+		return "", Principal{}, err
+	}
+
+	return s[:i], Principal{Name: s[:i], Permissions: perm}, nil
+}
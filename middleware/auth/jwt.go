@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+)
+
+// JWT authenticates bearer JSON web tokens signed with HS256 by Secret or with
+// RS256 by one of Keys, looked up by the "kid" header. Permissions are taken
+// from the space delimited "scope" claim, e.g. "read write".
+type JWT struct {
+	Secret   []byte
+	Keys     map[string]*rsa.PublicKey
+	Issuer   string
+	Audience string
+}
+
+type jwtClaims struct {
+	Scope string `json:"scope"`
+	jwt.RegisteredClaims
+}
+
+func (j *JWT) Authenticate(req *http.Request) (*Principal, error) {
+	token := bearerToken(req)
+	if token == "" || strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods(j.methods()),
+		jwt.WithExpirationRequired(),
+	}
+	if j.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(j.Issuer))
+	}
+	if j.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(j.Audience))
+	}
+
+	claims := jwtClaims{}
+	if _, err := jwt.ParseWithClaims(token, &claims, j.key, parserOpts...); err != nil {
+		return nil, errors.Wrap(err, "parse jwt")
+	}
+
+	principal := &Principal{Name: claims.Subject}
+	for _, scope := range strings.Fields(claims.Scope) {
+		perm, err := ParsePermission(scope)
+		if err != nil {
+			// scopes of other services may share the token
+			continue
+		}
+		principal.Permissions |= perm
+	}
+
+	return principal, nil
+}
+
+func (j *JWT) methods() []string {
+	methods := []string{}
+	if len(j.Secret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if len(j.Keys) > 0 {
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+	return methods
+}
+
+func (j *JWT) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method {
+	case jwt.SigningMethodHS256:
+		return j.Secret, nil
+	case jwt.SigningMethodRS256:
+		kid, _ := token.Header["kid"].(string)
+		key, ok := j.Keys[kid]
+		if !ok {
+			return nil, errors.Errorf("unknown key id '%s'", kid)
+		}
+		return key, nil
+	}
+	return nil, errors.Errorf("unexpected signing method %s", token.Method.Alg())
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// LoadJWKS reads the RSA public keys of a JSON web key set file.
+func LoadJWKS(path string) (map[string]*rsa.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read jwks")
+	}
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, errors.Wrap(err, "unmarshal jwks")
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode modulus of key %s", k.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode exponent of key %s", k.Kid)
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
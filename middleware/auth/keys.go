@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// StaticKeys authenticates the X-API-Key header against a fixed set of keys.
+type StaticKeys map[string]Principal
+
+func (k StaticKeys) Authenticate(req *http.Request) (*Principal, error) {
+	key := req.Header.Get("X-API-Key")
+	if key == "" {
+		return nil, nil
+	}
+
+	// compare against every key to not leak which prefix matched
+	var found *Principal
+	for k, principal := range k {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			p := principal
+			found = &p
+		}
+	}
+
+	if found == nil {
+		return nil, errors.New("unknown api key")
+	}
+	return found, nil
+}
+
+// ParseStaticKey parses a "name:key:permissions" definition, e.g.
+// "ci:secret:rw".
+func ParseStaticKey(s string) (string, Principal, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return "", Principal{}, errors.Errorf("invalid api key definition, excepted name:key:permissions")
+	}
+
+	perm, err := ParsePermission(parts[2])
+	if err != nil {
+		return "", Principal{}, err
+	}
+
+	return parts[1], Principal{Name: parts[0], Permissions: perm}, nil
+}
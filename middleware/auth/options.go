@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type Permission int
+
+const (
+	PermRead Permission = 1 << iota
+	PermWrite
+	PermDelete
+
+	PermNone Permission = 0
+	PermAll             = PermRead | PermWrite | PermDelete
+)
+
+// DefaultMethods requires read for downloads, write for uploads, including
+// tus PATCH, and delete for removal.
+var DefaultMethods = map[string]Permission{
+	http.MethodGet:     PermRead,
+	http.MethodHead:    PermRead,
+	http.MethodOptions: PermRead,
+	http.MethodPost:    PermWrite,
+	http.MethodPatch:   PermWrite,
+	http.MethodDelete:  PermDelete,
+}
+
+type Options struct {
+	// Methods maps request methods to the required permission, methods not
+	// listed are rejected
+	Methods map[string]Permission
+	// Anonymous is granted to requests without credentials
+	Anonymous Permission
+}
+
+func (o *Options) Setup() {
+	if o.Methods == nil {
+		o.Methods = DefaultMethods
+	}
+}
+
+// ParsePermission parses a comma separated list of read, write and delete or
+// their first letters, e.g. "read,write" or "rw".
+func ParsePermission(s string) (Permission, error) {
+	perm := PermNone
+	for _, p := range strings.Split(s, ",") {
+		switch strings.TrimSpace(p) {
+		case "":
+		case "read", "r":
+			perm |= PermRead
+		case "write", "w":
+			perm |= PermWrite
+		case "delete", "d":
+			perm |= PermDelete
+		case "rw":
+			perm |= PermRead | PermWrite
+		case "rwd", "all":
+			perm |= PermAll
+		default:
+			return PermNone, errors.Errorf("unknown permission %s", p)
+		}
+	}
+	return perm, nil
+}
+
+// ParseMethods parses "GET=read,POST=write" like lists, methods not listed
+// keep their DefaultMethods permission.
+func ParseMethods(s string) (map[string]Permission, error) {
+	methods := make(map[string]Permission, len(DefaultMethods))
+	for k, v := range DefaultMethods {
+		methods[k] = v
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid method permission %s", pair)
+		}
+
+		perm, err := ParsePermission(strings.Replace(parts[1], "+", ",", -1))
+		if err != nil {
+			return nil, err
+		}
+		methods[strings.ToUpper(strings.TrimSpace(parts[0]))] = perm
+	}
+
+	return methods, nil
+}
+
+func (p Permission) String() string {
+	names := []string{}
+	if p&PermRead != 0 {
+		names = append(names, "read")
+	}
+	if p&PermWrite != 0 {
+		names = append(names, "write")
+	}
+	if p&PermDelete != 0 {
+		names = append(names, "delete")
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HMACTokens authenticates bearer tokens issued by SignToken. A token is the
+// base64 encoded JSON payload and its HMAC-SHA256, joined by a dot.
+type HMACTokens struct {
+	Secret []byte
+}
+
+type tokenPayload struct {
+	Subject     string     `json:"sub"`
+	Permissions Permission `json:"perm"`
+	Expires     int64      `json:"exp,omitempty"`
+}
+
+// SignToken issues a token for the principal, a zero expires never expires.
+func SignToken(secret []byte, principal Principal, expires time.Time) string {
+	payload := tokenPayload{
+		Subject:     principal.Name,
+		Permissions: principal.Permissions,
+	}
+	if !expires.IsZero() {
+		payload.Expires = expires.Unix()
+	}
+
+	b, _ := json.Marshal(payload)
+	encoded := base64.RawURLEncoding.EncodeToString(b)
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(secret, encoded))
+}
+
+func (t HMACTokens) Authenticate(req *http.Request) (*Principal, error) {
+	token := bearerToken(req)
+	if token == "" || strings.Count(token, ".") != 1 {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(token, ".", 2)
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "decode token signature")
+	}
+
+	if !hmac.Equal(sig, tokenMAC(t.Secret, parts[0])) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "decode token payload")
+	}
+
+	payload := tokenPayload{}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return nil, errors.Wrap(err, "unmarshal token payload")
+	}
+
+	if payload.Expires != 0 && time.Now().Unix() >= payload.Expires {
+		return nil, errors.New("token expired")
+	}
+
+	return &Principal{Name: payload.Subject, Permissions: payload.Permissions}, nil
+}
+
+func tokenMAC(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
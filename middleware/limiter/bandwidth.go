@@ -0,0 +1,224 @@
+package limiter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shapeChunk is the largest write or read passed through at once, so a
+// throttled transfer is smooth instead of bursting a whole buffer.
+const shapeChunk = 32 * 1024
+
+// bandwidth shapes a byte stream with the same theoretical arrival time
+// approach as gcra, each byte advances tat by the time it takes at the rate.
+type bandwidth struct {
+	lock      sync.Mutex
+	tat       time.Time
+	perByte   float64 // nanoseconds
+	tolerance time.Duration
+}
+
+func newBandwidth(bytesPerSecond int64) *bandwidth {
+	b := &bandwidth{perByte: float64(time.Second) / float64(bytesPerSecond)}
+	b.tolerance = b.cost(shapeChunk)
+	return b
+}
+
+func (b *bandwidth) setRate(bytesPerSecond int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.perByte = float64(time.Second) / float64(bytesPerSecond)
+	b.tolerance = b.cost(shapeChunk)
+}
+
+func (b *bandwidth) cost(n int) time.Duration {
+	return time.Duration(float64(n) * b.perByte)
+}
+
+// wait blocks until n bytes may pass.
+func (b *bandwidth) wait(ctx context.Context, n int) error {
+	b.lock.Lock()
+	now := time.Now()
+	if b.tat.Before(now) {
+		b.tat = now
+	}
+	b.tat = b.tat.Add(b.cost(n))
+	delay := b.tat.Sub(now) - b.tolerance
+	b.lock.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func waitAll(ctx context.Context, shapes []*bandwidth, n int) error {
+	for _, shape := range shapes {
+		if err := shape.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// counterResponseWriter throttles the response and counts it against the
+// quota, the response is cut off once the quota is used up.
+type counterResponseWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	shapes   []*bandwidth
+	transfer Transfer
+	// body is the request body, a handler failing to read it because the
+	// quota was used up gets its error response replaced by 429
+	body        *counterReader
+	wroteHeader bool
+	rejected    bool
+}
+
+func (c *counterResponseWriter) WriteHeader(code int) {
+	if !c.wroteHeader && code >= 400 && c.body != nil && c.body.exceeded.Load() {
+		c.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(c.transfer.QuotaReset())))
+		code = http.StatusTooManyRequests
+		c.rejected = true
+	}
+	c.wroteHeader = true
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *counterResponseWriter) Write(b []byte) (int, error) {
+	c.wroteHeader = true
+	// the quota is used up, the error message of the 429 is not counted
+	if c.rejected {
+		return c.ResponseWriter.Write(b)
+	}
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > shapeChunk && len(c.shapes) > 0 {
+			chunk = b[:shapeChunk]
+		}
+
+		allowed := c.transfer.Add(int64(len(chunk)))
+		if allowed == 0 {
+			return written, ErrQuotaExceeded
+		}
+		chunk = chunk[:allowed]
+
+		if err := waitAll(c.ctx, c.shapes, len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := c.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Flush keeps streaming responses working through the wrapper.
+func (c *counterResponseWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// ReadFrom copies through Write, so the bytes are throttled and counted
+// instead of taking the io.ReaderFrom of the underlying writer.
+func (c *counterResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{c}, r)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (c *counterResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// writerOnly hides the io.ReaderFrom of a writer from io.Copy.
+type writerOnly struct {
+	io.Writer
+}
+
+// counterReader throttles the request body and counts it against the quota,
+// reading fails with ErrQuotaExceeded once the quota is used up.
+type counterReader struct {
+	io.ReadCloser
+	ctx      context.Context
+	shapes   []*bandwidth
+	transfer Transfer
+	exceeded atomic.Bool
+}
+
+func (c *counterReader) Read(p []byte) (int, error) {
+	if len(p) > shapeChunk && len(c.shapes) > 0 {
+		p = p[:shapeChunk]
+	}
+
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		if allowed := int(c.transfer.Add(int64(n))); allowed < n {
+			c.exceeded.Store(true)
+			return allowed, ErrQuotaExceeded
+		}
+		if werr := waitAll(c.ctx, c.shapes, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// windowCounter approximates a rolling window by weighting the count of the
+// previous fixed window by how much of it still overlaps the rolling one.
+type windowCounter struct {
+	window time.Duration
+	start  time.Time
+	prev   int64
+	cur    int64
+}
+
+func (w *windowCounter) advance(now time.Time) {
+	start := now.Truncate(w.window)
+	switch {
+	case start.Equal(w.start):
+		return
+	case start.Equal(w.start.Add(w.window)):
+		w.prev = w.cur
+	default:
+		w.prev = 0
+	}
+	w.cur = 0
+	w.start = start
+}
+
+func (w *windowCounter) add(now time.Time, n int64) {
+	w.advance(now)
+	w.cur += n
+}
+
+func (w *windowCounter) count(now time.Time) int64 {
+	w.advance(now)
+	return slidingCount(w.prev, w.cur, now.Sub(w.start), w.window)
+}
+
+func slidingCount(prev, cur int64, elapsed, window time.Duration) int64 {
+	overlap := float64(window-elapsed) / float64(window)
+	return int64(float64(prev)*overlap) + cur
+}
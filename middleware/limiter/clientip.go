@@ -0,0 +1,140 @@
+package limiter
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// KeyFunc identifies the client a request is limited as.
+type KeyFunc func(*http.Request) string
+
+// IPKey limits by client address, IPv6 clients are grouped by the prefix of
+// ipv6Bits, e.g. 64, since a single host usually owns a whole /64. Zero keeps
+// the full address.
+func IPKey(trustedProxies []netip.Prefix, ipv6Bits int) KeyFunc {
+	return func(req *http.Request) string {
+		addr, ok := ClientIP(req, trustedProxies)
+		if !ok {
+			return req.RemoteAddr
+		}
+
+		if addr.Is6() && ipv6Bits > 0 && ipv6Bits < 128 {
+			prefix, err := addr.Prefix(ipv6Bits)
+			if err == nil {
+				return prefix.String()
+			}
+		}
+		return addr.String()
+	}
+}
+
+// ParseTrustedProxies parses a comma separated list of CIDRs or addresses.
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if strings.Contains(v, "/") {
+			prefix, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// ClientIP returns the address of the client. The forwarding headers are only
+// honoured when the peer is a trusted proxy, then the chain is walked from the
+// nearest hop and the first untrusted address is the client. Forwarded takes
+// precedence over X-Forwarded-For, which takes precedence over X-Real-IP.
+func ClientIP(req *http.Request, trustedProxies []netip.Prefix) (netip.Addr, bool) {
+	remote, ok := parseAddr(req.RemoteAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+
+	if !trusted(remote, trustedProxies) {
+		return remote, true
+	}
+
+	var chain []string
+	if forwarded := req.Header.Values("Forwarded"); len(forwarded) > 0 {
+		chain = parseForwarded(forwarded)
+	} else if xff := req.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		for _, v := range xff {
+			chain = append(chain, strings.Split(v, ",")...)
+		}
+	} else if realIP := req.Header.Get("X-Real-IP"); realIP != "" {
+		chain = []string{realIP}
+	}
+
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseAddr(strings.TrimSpace(chain[i]))
+		if !ok {
+			// unknown or obfuscated hops can not be followed
+			break
+		}
+		client = addr
+		if !trusted(addr, trustedProxies) {
+			break
+		}
+	}
+
+	return client, true
+}
+
+func trusted(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddr parses an address with an optional port, like "[::1]:1234",
+// "::1", "10.0.0.1:80" or "10.0.0.1".
+func parseAddr(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// parseForwarded returns the "for" parameters of RFC 7239 Forwarded headers
+// in order.
+func parseForwarded(values []string) []string {
+	chain := []string{}
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(parts) == 2 && strings.EqualFold(parts[0], "for") {
+					chain = append(chain, strings.Trim(parts[1], `"`))
+				}
+			}
+		}
+	}
+	return chain
+}
@@ -0,0 +1,50 @@
+package limiter
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPKey(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, fd00::/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		header     map[string]string
+		ipv6Bits   int
+		key        string
+	}{
+		{"ipv4", "203.0.113.7:1234", nil, 0, "203.0.113.7"},
+		{"ipv6", "[2001:db8::1]:1234", nil, 0, "2001:db8::1"},
+		{"ipv6-prefix", "[2001:db8:0:0:aaaa::1]:1234", nil, 64, "2001:db8::/64"},
+		{"ipv4-mapped", "[::ffff:203.0.113.7]:1234", nil, 64, "203.0.113.7"},
+		{"untrusted-peer", "203.0.113.7:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, 0, "203.0.113.7"},
+		{"xff", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.2"}, 0, "198.51.100.1"},
+		{"xff-spoofed", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1"}, 0, "198.51.100.1"},
+		{"xff-all-trusted", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, 0, "10.0.0.3"},
+		{"real-ip", "192.168.1.1:1234", map[string]string{"X-Real-IP": "198.51.100.1"}, 0, "198.51.100.1"},
+		{"forwarded", "[fd00::1]:1234", map[string]string{
+			"Forwarded":       `for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.2`,
+			"X-Forwarded-For": "1.1.1.1",
+		}, 0, "2001:db8:cafe::17"},
+		{"forwarded-unknown", "10.0.0.1:1234", map[string]string{"Forwarded": "for=unknown, for=10.0.0.2"}, 0, "10.0.0.2"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = c.remoteAddr
+			for k, v := range c.header {
+				req.Header.Set(k, v)
+			}
+
+			if key := IPKey(trusted, c.ipv6Bits)(req); key != c.key {
+				t.Fatalf("bad key, excepted %s, actual %s", c.key, key)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package limiter
+
+import (
+	"time"
+)
+
+// gcra is the generic cell rate algorithm, a token bucket which only keeps the
+// theoretical arrival time of the next request instead of a token counter.
+type gcra struct {
+	// interval between requests at the sustained rate
+	interval time.Duration
+	burst    int
+}
+
+func newGCRA(rate float64, burst int) gcra {
+	return gcra{
+		interval: time.Duration(float64(time.Second) / rate),
+		burst:    burst,
+	}
+}
+
+// Decision is the outcome of a rate limit check.
+type Decision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is the wait until the next request is allowed when rejected
+	RetryAfter time.Duration
+	// Reset is the wait until the bucket is full again
+	Reset time.Duration
+	// Reason tells which limit rejected the request
+	Reason string
+}
+
+// Reasons of rejected requests.
+const (
+	ReasonRate        = "rate"
+	ReasonQuota       = "quota"
+	ReasonConnections = "connections"
+	ReasonUnavailable = "unavailable"
+)
+
+// allow checks a request arriving at now against the theoretical arrival time
+// tat and returns the new tat.
+func (g gcra) allow(tat, now time.Time) (time.Time, Decision) {
+	if tat.Before(now) {
+		tat = now
+	}
+
+	tolerance := g.interval * time.Duration(g.burst)
+	newTat := tat.Add(g.interval)
+	allowAt := newTat.Add(-tolerance)
+
+	d := Decision{Limit: g.burst}
+	if now.Before(allowAt) {
+		d.RetryAfter = allowAt.Sub(now)
+		d.Reason = ReasonRate
+		d.Reset = tat.Sub(now)
+		return tat, d
+	}
+
+	d.Allowed = true
+	d.Remaining = int(now.Sub(allowAt) / g.interval)
+	d.Reset = newTat.Sub(now)
+	return newTat, d
+}
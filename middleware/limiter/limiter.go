@@ -1,9 +1,12 @@
 package limiter
 
 import (
+	"container/list"
+	"errors"
 	"log"
+	"math"
 	"net/http"
-	"strings"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,26 +14,29 @@ import (
 
 type Limiter struct {
 	options Options
+	rate    gcra
 	lock    sync.RWMutex
 	remotes map[string]*remoteLimit
+	// recent orders remotes from the most to the least recently seen
+	recent    *list.List
+	evictions uint64
+	done      chan struct{}
+	closeOnce sync.Once
+	// janitor ticks every half IdleTimeout, SetOptions resets it
+	janitor *time.Ticker
+	// global throttles the transfers of all clients, nil if unlimited
+	global *bandwidth
 }
 
 type remoteLimit struct {
+	addr          string
+	elem          *list.Element
+	lock          sync.Mutex
 	last          time.Time
+	tat           time.Time
 	connectionSem chan struct{}
-	rpsTicker     *time.Ticker
-	rpsCalls      int64
-	transferred   int64
-}
-
-type counterResponseWriter struct {
-	http.ResponseWriter
-	bytesTransferred int64
-}
-
-func (c *counterResponseWriter) Write(b []byte) (int, error) {
-	c.bytesTransferred += int64(len(b))
-	return c.ResponseWriter.Write(b)
+	quota         windowCounter
+	bandwidth     *bandwidth
 }
 
 func New(opts Options) *Limiter {
@@ -38,99 +44,357 @@ func New(opts Options) *Limiter {
 
 	limiter := &Limiter{
 		options: opts,
+		rate:    newGCRA(opts.Rate, opts.Burst),
 		remotes: make(map[string]*remoteLimit),
+		recent:  list.New(),
+		done:    make(chan struct{}),
+		janitor: time.NewTicker(opts.IdleTimeout / 2),
 	}
+	if opts.GlobalBytesPerSecond > 0 {
+		limiter.global = newBandwidth(opts.GlobalBytesPerSecond)
+	}
+
+	go limiter.evictIdleLoop()
 
 	return limiter
 }
 
-func (l *Limiter) LimitMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		crw := &counterResponseWriter{ResponseWriter: rw}
-		remoteAddr := strings.Split(req.RemoteAddr, ":")[0]
-
-		if l.acquire(remoteAddr) {
-			next.ServeHTTP(rw, req)
-			l.release(remoteAddr)
-			l.transferred(remoteAddr, crw.bytesTransferred)
-		} else {
-			log.Printf("remote: %s - too many requests", remoteAddr)
-			http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
-		}
+// Close stops the janitor.
+func (l *Limiter) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
 	})
+	return nil
 }
 
-func (l *Limiter) acquire(addr string) bool {
+// Stats describes the state of the client table.
+type Stats struct {
+	Clients   int
+	Evictions uint64
+}
+
+func (l *Limiter) Stats() Stats {
 	l.lock.RLock()
+	defer l.lock.RUnlock()
 
-	limit, ok := l.remotes[addr]
-	if !ok {
-		l.lock.RUnlock()
+	return Stats{
+		Clients:   len(l.remotes),
+		Evictions: atomic.LoadUint64(&l.evictions),
+	}
+}
 
-		l.lock.Lock()
-		l.remotes[addr] = &remoteLimit{
-			last:          time.Now(),
-			connectionSem: make(chan struct{}, l.options.MaxConnectionPerIP),
-			rpsTicker:     time.NewTicker(1 * time.Second),
-		}
-		l.lock.Unlock()
+// ErrQuotaExceeded aborts a transfer which used up the byte quota of the
+// client.
+var ErrQuotaExceeded = errors.New("byte quota exceeded")
 
-		return acquire(l.remotes[addr], l.options)
+// Backend keeps the limits of the clients. Limiter keeps them in process,
+// RedisLimiter shares them between replicas.
+type Backend interface {
+	// Acquire checks a request of the client identified by key. When the
+	// request is allowed, the bytes it sends are counted with the returned
+	// Transfer, which must be ended with Done once it is finished.
+	Acquire(key string) (Decision, Transfer, error)
+}
+
+// Transfer is a request admitted by a Backend.
+type Transfer interface {
+	// Add counts n more bytes against the quota of the client and returns
+	// how many of them are within it, fewer than n once it is used up
+	Add(n int64) int64
+	// QuotaReset is the time until the quota window of the client ends
+	QuotaReset() time.Duration
+	// Done frees the connection slot of the request
+	Done()
+}
+
+func (l *Limiter) LimitMiddleware(next http.Handler) http.Handler {
+	return Middleware(l, l.options.KeyFunc, next)
+}
+
+// SetOptions replaces the limits, e.g. on a config reload. The state of the
+// known clients carries over and follows the new rate and bandwidth, the
+// KeyFunc of the middleware and MaxConnectionPerIP of known clients are kept.
+func (l *Limiter) SetOptions(opts Options) {
+	opts.Setup()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.options = opts
+	l.rate = newGCRA(opts.Rate, opts.Burst)
+	l.janitor.Reset(opts.IdleTimeout / 2)
+
+	switch {
+	case opts.GlobalBytesPerSecond <= 0:
+		l.global = nil
+	case l.global == nil:
+		l.global = newBandwidth(opts.GlobalBytesPerSecond)
+	default:
+		l.global.setRate(opts.GlobalBytesPerSecond)
 	}
 
-	l.lock.RUnlock()
-	return acquire(limit, l.options)
+	// a client which used up the old burst has used up the new one, but
+	// doesn't wait longer than the new limits require
+	maxTat := time.Now().Add(l.rate.interval * time.Duration(l.rate.burst))
+	for _, limit := range l.remotes {
+		limit.lock.Lock()
+		if limit.tat.After(maxTat) {
+			limit.tat = maxTat
+		}
+		limit.quota.window = opts.QuotaWindow
+		if opts.BytesPerSecond > 0 {
+			if limit.bandwidth == nil {
+				limit.bandwidth = newBandwidth(opts.BytesPerSecond)
+			} else {
+				limit.bandwidth.setRate(opts.BytesPerSecond)
+			}
+		}
+		limit.lock.Unlock()
+	}
 }
 
-func (l *Limiter) release(addr string) {
+// config returns the current limits.
+func (l *Limiter) config() (gcra, Options) {
 	l.lock.RLock()
 	defer l.lock.RUnlock()
 
-	limit, ok := l.remotes[addr]
-	if !ok {
-		return
+	return l.rate, l.options
+}
+
+func (l *Limiter) Acquire(key string) (Decision, Transfer, error) {
+	// the client entry is kept for the whole request, so an eviction
+	// meanwhile does not release a slot of a newer entry
+	limit := l.remote(key)
+	rate, opts := l.config()
+	d := acquire(limit, rate, opts, time.Now())
+	if !d.Allowed {
+		opts.rejected(d.Reason)
+		return d, nil, nil
+	}
+
+	return d, &localTransfer{limit: limit, maxBytes: opts.MaxBytesPerIP}, nil
+}
+
+// localTransfer counts the bytes of a request as they pass, so concurrent
+// requests of a client share its quota.
+type localTransfer struct {
+	limit    *remoteLimit
+	maxBytes int64
+}
+
+func (t *localTransfer) Add(n int64) int64 {
+	t.limit.lock.Lock()
+	defer t.limit.lock.Unlock()
+
+	now := time.Now()
+	if t.maxBytes > 0 {
+		if left := t.maxBytes - t.limit.quota.count(now); n > left {
+			n = max(left, 0)
+		}
 	}
+	t.limit.quota.add(now, n)
+	return n
+}
+
+func (t *localTransfer) QuotaReset() time.Duration {
+	t.limit.lock.Lock()
+	defer t.limit.lock.Unlock()
 
-	release(limit)
+	now := time.Now()
+	t.limit.quota.advance(now)
+	return t.limit.quota.start.Add(t.limit.quota.window).Sub(now)
 }
 
-func (l *Limiter) transferred(addr string, n int64) {
+func (t *localTransfer) Done() {
+	release(t.limit)
+}
+
+// shaper is implemented by backends which throttle transfers.
+type shaper interface {
+	shapes(key string) []*bandwidth
+}
+
+func (l *Limiter) shapes(key string) []*bandwidth {
+	limit := l.remote(key)
+
 	l.lock.RLock()
 	defer l.lock.RUnlock()
 
-	limit, ok := l.remotes[addr]
-	if !ok {
-		return
+	shapes := []*bandwidth{}
+	if l.options.BytesPerSecond > 0 {
+		limit.lock.Lock()
+		shapes = append(shapes, limit.bandwidth)
+		limit.lock.Unlock()
+	}
+	if l.global != nil {
+		shapes = append(shapes, l.global)
 	}
+	return shapes
+}
+
+// Middleware limits the requests to next by the client identified by key.
+func Middleware(b Backend, key KeyFunc, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		remoteAddr := key(req)
+
+		d, transfer, err := b.Acquire(remoteAddr)
+		if err != nil {
+			log.Printf("remote: %s - limiter failed: %v", remoteAddr, err)
+			rw.Header().Set("Retry-After", "1")
+			http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		setRateLimitHeaders(rw, d)
+
+		if d.Allowed {
+			defer transfer.Done()
+
+			cr := &counterReader{ReadCloser: req.Body, ctx: req.Context(), transfer: transfer}
+			crw := &counterResponseWriter{ResponseWriter: rw, ctx: req.Context(), transfer: transfer, body: cr}
+			if s, ok := b.(shaper); ok {
+				crw.shapes = s.shapes(remoteAddr)
+				cr.shapes = crw.shapes
+			}
+			if req.Body != nil {
+				req.Body = cr
+			}
+
+			next.ServeHTTP(crw, req)
+		} else {
+			log.Printf("remote: %s - too many requests", remoteAddr)
+			rw.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
+			http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		}
+	})
+}
+
+// setRateLimitHeaders sets the RateLimit header fields of
+// draft-ietf-httpapi-ratelimit-headers.
+func setRateLimitHeaders(rw http.ResponseWriter, d Decision) {
+	rw.Header().Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	rw.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	rw.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+}
 
-	atomic.AddInt64(&limit.transferred, n)
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
 }
 
-func acquire(limit *remoteLimit, limitOptions Options) bool {
-	limit.last = time.Now()
+func (l *Limiter) remote(addr string) *remoteLimit {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 
-	select {
-	case <-limit.rpsTicker.C:
-		atomic.StoreInt64(&limit.rpsCalls, 0)
-	default:
+	if limit, ok := l.remotes[addr]; ok {
+		limit.lock.Lock()
+		limit.last = time.Now()
+		limit.lock.Unlock()
+
+		l.recent.MoveToFront(limit.elem)
+		return limit
+	}
+
+	if len(l.remotes) >= l.options.MaxClients {
+		l.evictOldest()
 	}
 
-	calls := atomic.AddInt64(&limit.rpsCalls, 1)
-	if calls > int64(limitOptions.MaxRequestPerSecond) {
-		return false
+	limit := &remoteLimit{
+		addr:          addr,
+		last:          time.Now(),
+		connectionSem: make(chan struct{}, l.options.MaxConnectionPerIP),
+		quota:         windowCounter{window: l.options.QuotaWindow},
+	}
+	if l.options.BytesPerSecond > 0 {
+		limit.bandwidth = newBandwidth(l.options.BytesPerSecond)
+	}
+	limit.elem = l.recent.PushFront(limit)
+	l.remotes[addr] = limit
+	return limit
+}
+
+// evictOldest drops the least recently seen client without running requests.
+func (l *Limiter) evictOldest() {
+	for e := l.recent.Back(); e != nil; e = e.Prev() {
+		limit := e.Value.(*remoteLimit)
+		if len(limit.connectionSem) == 0 {
+			l.evict(limit)
+			return
+		}
+	}
+}
+
+func (l *Limiter) evict(limit *remoteLimit) {
+	l.recent.Remove(limit.elem)
+	delete(l.remotes, limit.addr)
+	atomic.AddUint64(&l.evictions, 1)
+}
+
+// evictIdleLoop periodically evicts idle clients.
+func (l *Limiter) evictIdleLoop() {
+	defer l.janitor.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-l.janitor.C:
+			l.evictIdle(now)
+		}
+	}
+}
+
+func (l *Limiter) evictIdle(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for e := l.recent.Back(); e != nil; {
+		limit := e.Value.(*remoteLimit)
+		prev := e.Prev()
+
+		limit.lock.Lock()
+		idle := now.Sub(limit.last) > l.options.IdleTimeout
+		limit.lock.Unlock()
+
+		// the list is ordered by recency, so the rest is not idle either
+		if !idle {
+			return
+		}
+		if len(limit.connectionSem) == 0 {
+			l.evict(limit)
+		}
+		e = prev
+	}
+}
+
+func acquire(limit *remoteLimit, rate gcra, limitOptions Options, now time.Time) Decision {
+	limit.lock.Lock()
+	defer limit.lock.Unlock()
+
+	// the new tat is only stored once the request is admitted, so the retries
+	// of a client rejected for its quota or connections take no tokens
+	tat, d := rate.allow(limit.tat, now)
+	if !d.Allowed {
+		return d
 	}
 
-	if atomic.LoadInt64(&limit.transferred) > limitOptions.MaxBytesPerIP {
-		return false
+	if limitOptions.MaxBytesPerIP > 0 && limit.quota.count(now) >= limitOptions.MaxBytesPerIP {
+		d.Allowed = false
+		d.RetryAfter = limit.quota.start.Add(limit.quota.window).Sub(now)
+		d.Reason = ReasonQuota
+		return d
 	}
 
 	select {
 	case limit.connectionSem <- struct{}{}:
 	default:
-		return false
+		// a connection slot frees up when a running request finishes
+		d.Allowed = false
+		d.RetryAfter = time.Second
+		d.Reason = ReasonConnections
+		return d
 	}
 
-	return true
+	limit.tat = tat
+	return d
 }
 
 func release(limit *remoteLimit) {
@@ -0,0 +1,327 @@
+package limiter
+
+import (
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nameoffnv/httpfiles"
+	"github.com/nameoffnv/httpfiles/storage/memory"
+)
+
+func TestGCRA(t *testing.T) {
+	rate := newGCRA(2, 3)
+	now := time.Now()
+	tat := time.Time{}
+
+	var d Decision
+	for i := 0; i < 3; i++ {
+		tat, d = rate.allow(tat, now)
+		if !d.Allowed {
+			t.Fatalf("request %d rejected within burst", i)
+		}
+		if d.Remaining != 2-i {
+			t.Fatalf("bad remaining, excepted %d, actual %d", 2-i, d.Remaining)
+		}
+	}
+
+	tat, d = rate.allow(tat, now)
+	if d.Allowed {
+		t.Fatal("request allowed over burst")
+	}
+	if d.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("bad retry after, excepted %v, actual %v", 500*time.Millisecond, d.RetryAfter)
+	}
+
+	// one token is back after the interval, but no burst at a window boundary
+	now = now.Add(500 * time.Millisecond)
+	tat, d = rate.allow(tat, now)
+	if !d.Allowed {
+		t.Fatal("request rejected after interval")
+	}
+	if _, d = rate.allow(tat, now); d.Allowed {
+		t.Fatal("second request allowed after single interval")
+	}
+}
+
+func TestLimitMiddleware(t *testing.T) {
+	limiter := New(Options{MaxRequestPerSecond: 1, Burst: 2})
+	defer limiter.Close()
+	handler := limiter.LimitMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := serve(); rr.Code != http.StatusOK {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusOK, rr.Code)
+		}
+	}
+
+	rr := serve()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "1" {
+		t.Fatalf("bad Retry-After, excepted 1, actual '%s'", rr.Header().Get("Retry-After"))
+	}
+	if rr.Header().Get("RateLimit-Limit") != "2" || rr.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("bad RateLimit headers, limit '%s', remaining '%s'",
+			rr.Header().Get("RateLimit-Limit"), rr.Header().Get("RateLimit-Remaining"))
+	}
+}
+
+func TestRejectedKeepsTokens(t *testing.T) {
+	l := New(Options{Rate: 0.01, Burst: 3, MaxConnectionPerIP: 1})
+	defer l.Close()
+
+	d, transfer, err := l.Acquire("10.0.0.1")
+	if err != nil || !d.Allowed {
+		t.Fatalf("first request rejected, error %v", err)
+	}
+
+	// the retries rejected for the connection limit take no tokens
+	for i := 0; i < 5; i++ {
+		if d, _, _ := l.Acquire("10.0.0.1"); d.Allowed || d.Reason != ReasonConnections {
+			t.Fatalf("bad decision of retry %d, excepted reason %s, actual %+v", i, ReasonConnections, d)
+		}
+	}
+	transfer.Done()
+
+	d, transfer, err = l.Acquire("10.0.0.1")
+	if err != nil || !d.Allowed {
+		t.Fatalf("request rejected after the connection was released, error %v, decision %+v", err, d)
+	}
+	if d.Remaining != 1 {
+		t.Fatalf("bad remaining, excepted 1, actual %d", d.Remaining)
+	}
+	transfer.Done()
+}
+
+func TestEviction(t *testing.T) {
+	limiter := New(Options{MaxClients: 2, IdleTimeout: time.Minute})
+	defer limiter.Close()
+
+	for _, addr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.3"} {
+		limiter.remote(addr)
+	}
+
+	t.Run("lru", func(t *testing.T) {
+		stats := limiter.Stats()
+		if stats.Clients != 2 || stats.Evictions != 1 {
+			t.Fatalf("bad stats, excepted 2 clients and 1 eviction, actual %+v", stats)
+		}
+		if _, ok := limiter.remotes["10.0.0.2"]; ok {
+			t.Fatal("least recently seen client not evicted")
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		busy := limiter.remote("10.0.0.1")
+		busy.connectionSem <- struct{}{}
+
+		limiter.evictIdle(time.Now().Add(2 * time.Minute))
+
+		stats := limiter.Stats()
+		if stats.Clients != 1 || stats.Evictions != 2 {
+			t.Fatalf("bad stats, excepted 1 client and 2 evictions, actual %+v", stats)
+		}
+		if _, ok := limiter.remotes["10.0.0.1"]; !ok {
+			t.Fatal("client with running request evicted")
+		}
+	})
+
+	t.Run("reload-interval", func(t *testing.T) {
+		<-limiter.remote("10.0.0.1").connectionSem
+
+		// the janitor follows the new idle timeout instead of ticking every
+		// half minute
+		limiter.SetOptions(Options{MaxClients: 2, IdleTimeout: 10 * time.Millisecond})
+
+		deadline := time.Now().Add(time.Second)
+		for limiter.Stats().Clients > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("idle client not evicted after reload, actual %+v", limiter.Stats())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+}
+
+func TestQuota(t *testing.T) {
+	limiter := New(Options{Rate: 100, Burst: 100, MaxBytesPerIP: 10, QuotaWindow: time.Hour})
+	defer limiter.Close()
+
+	var writeErr, readErr error
+	handler := limiter.LimitMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, readErr = io.ReadAll(req.Body)
+		_, writeErr = rw.Write([]byte("more than ten bytes"))
+	}))
+
+	serve := func(remoteAddr, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr + ":1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("download-cut-off", func(t *testing.T) {
+		rr := serve("10.0.0.1", "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusOK, rr.Code)
+		}
+		if body := rr.Body.String(); body != "more than " {
+			t.Fatalf("bad body, excepted first ten bytes, actual %q", body)
+		}
+		if writeErr != ErrQuotaExceeded {
+			t.Fatalf("bad write error, excepted %v, actual %v", ErrQuotaExceeded, writeErr)
+		}
+
+		if rr := serve("10.0.0.1", ""); rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusTooManyRequests, rr.Code)
+		}
+	})
+
+	t.Run("upload-cut-off", func(t *testing.T) {
+		serve("10.0.0.2", "more than ten bytes")
+		if readErr != ErrQuotaExceeded {
+			t.Fatalf("bad read error, excepted %v, actual %v", ErrQuotaExceeded, readErr)
+		}
+		if writeErr != ErrQuotaExceeded {
+			t.Fatalf("bad write error, excepted %v, actual %v", ErrQuotaExceeded, writeErr)
+		}
+	})
+
+	t.Run("upload-files-handler", func(t *testing.T) {
+		files, err := httpfiles.New(memory.New(sha256.New))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer files.Close()
+		handler := limiter.LimitMiddleware(files)
+
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("more than ten bytes"))
+		req.RemoteAddr = "10.0.0.3:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusTooManyRequests, rr.Code)
+		}
+		if retryAfter, _ := strconv.Atoi(rr.Header().Get("Retry-After")); retryAfter <= 0 || retryAfter > 3600 {
+			t.Fatalf("bad Retry-After '%s'", rr.Header().Get("Retry-After"))
+		}
+		if !strings.Contains(rr.Body.String(), ErrQuotaExceeded.Error()) {
+			t.Fatalf("bad body, excepted %q, actual %q", ErrQuotaExceeded.Error(), rr.Body.String())
+		}
+	})
+}
+
+func TestWindowCounter(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := windowCounter{window: time.Hour}
+
+	w.add(start, 100)
+	if n := w.count(start.Add(30 * time.Minute)); n != 100 {
+		t.Fatalf("bad count, excepted 100, actual %d", n)
+	}
+
+	// half of the previous window still overlaps the rolling one
+	w.add(start.Add(90*time.Minute), 10)
+	if n := w.count(start.Add(90 * time.Minute)); n != 60 {
+		t.Fatalf("bad count, excepted 60, actual %d", n)
+	}
+
+	if n := w.count(start.Add(5 * time.Hour)); n != 0 {
+		t.Fatalf("bad count, excepted 0, actual %d", n)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	limiter := New(Options{Rate: 100, Burst: 100, BytesPerSecond: 128 * 1024})
+	defer limiter.Close()
+
+	body := make([]byte, 96*1024)
+	handler := limiter.LimitMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(body)
+	}))
+
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	elapsed := time.Since(start)
+
+	if rr.Body.Len() != len(body) {
+		t.Fatalf("bad body length, excepted %d, actual %d", len(body), rr.Body.Len())
+	}
+	// the first chunk passes as burst, the other two take 0.5s
+	if elapsed < 400*time.Millisecond {
+		t.Fatalf("transfer not throttled, took %v", elapsed)
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	limiter := New(Options{MaxRequestPerSecond: 1, Burst: 1})
+	defer limiter.Close()
+
+	if d, transfer, _ := limiter.Acquire("client"); !d.Allowed {
+		t.Fatal("first request rejected")
+	} else {
+		transfer.Done()
+	}
+	if d, _, _ := limiter.Acquire("client"); d.Allowed {
+		t.Fatal("request allowed over burst")
+	}
+
+	limiter.SetOptions(Options{Rate: 1000, Burst: 10, BytesPerSecond: 1024})
+	// the used up burst carries over, at the new rate
+	time.Sleep(2 * time.Millisecond)
+
+	d, transfer, _ := limiter.Acquire("client")
+	if !d.Allowed {
+		t.Fatal("request rejected after raising the limits")
+	}
+	transfer.Done()
+	if d.Limit != 10 {
+		t.Fatalf("bad limit, excepted 10, actual %d", d.Limit)
+	}
+	if shapes := limiter.shapes("client"); len(shapes) != 1 || shapes[0] == nil {
+		t.Fatalf("excepted bandwidth of a known client after reload, actual %v", shapes)
+	}
+}
+
+func TestResponseController(t *testing.T) {
+	limiter := New(Options{Rate: 100, Burst: 100, BytesPerSecond: 1024 * 1024})
+	defer limiter.Close()
+
+	var unwrapped http.ResponseWriter
+	handler := limiter.LimitMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if u, ok := rw.(interface{ Unwrap() http.ResponseWriter }); ok {
+			unwrapped = u.Unwrap()
+		}
+		// ReadFrom goes through the throttled Write
+		io.Copy(rw, strings.NewReader("hello world"))
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if unwrapped != rr {
+		t.Fatalf("bad unwrapped writer, excepted the recorder, actual %T", unwrapped)
+	}
+	if rr.Body.String() != "hello world" {
+		t.Fatalf("bad body, excepted 'hello world', actual '%s'", rr.Body.String())
+	}
+}
@@ -1,15 +1,86 @@
 package limiter
 
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
 const (
 	defaultMaxConnectionPerIP  = 1
 	defaultMaxRequestPerSecond = 1
-	defaultMaxBytesPerIP       = 10 * 1024 * 1024
+	defaultBurst               = 1
+	defaultQuotaWindow         = 24 * time.Hour
+	defaultIdleTimeout         = 10 * time.Minute
+	defaultMaxClients          = 100000
+	defaultKeyPrefix           = "limiter:"
+	defaultFailureCooldown     = 5 * time.Second
 )
 
 type Options struct {
-	MaxConnectionPerIP  int
+	MaxConnectionPerIP int
+	// MaxRequestPerSecond is the sustained request rate, Rate overrides it
+	// with a fractional value, e.g. 0.5 for one request every two seconds
 	MaxRequestPerSecond int
-	MaxBytesPerIP       int64
+	Rate                float64
+	// Burst is how many requests may be made at once after a quiet period
+	Burst int
+	// MaxBytesPerIP is the quota of bytes a client may upload and download
+	// per rolling QuotaWindow, transfers are cut off once it is used up,
+	// zero means no quota
+	MaxBytesPerIP int64
+	QuotaWindow   time.Duration
+	// BytesPerSecond throttles the transfers of every client,
+	// GlobalBytesPerSecond those of all clients together, zero means no limit
+	BytesPerSecond       int64
+	GlobalBytesPerSecond int64
+	// IdleTimeout evicts clients without requests for that long, their limits
+	// start over on the next request
+	IdleTimeout time.Duration
+	// MaxClients caps the number of tracked clients, the least recently seen
+	// one is evicted when a new client arrives
+	MaxClients int
+
+	// TrustedProxies are the peers whose forwarding headers are honoured
+	TrustedProxies []netip.Prefix
+	// IPv6Prefix groups IPv6 clients by prefix length, e.g. 64
+	IPv6Prefix int
+	// KeyFunc overrides how clients are identified, by default IPKey with
+	// TrustedProxies and IPv6Prefix
+	KeyFunc KeyFunc
+
+	// OnReject is called with the Decision.Reason of every rejected request
+	OnReject func(reason string)
+
+	// KeyPrefix and Failure are only used by RedisLimiter, after a failure
+	// redis is skipped for the FailureCooldown
+	KeyPrefix       string
+	Failure         FailurePolicy
+	FailureCooldown time.Duration
+}
+
+// FailurePolicy decides what RedisLimiter does while redis is unreachable.
+type FailurePolicy int
+
+const (
+	// FailLocal limits every replica on its own
+	FailLocal FailurePolicy = iota
+	// FailOpen allows all requests
+	FailOpen
+	// FailClosed rejects all requests
+	FailClosed
+)
+
+func ParseFailurePolicy(s string) (FailurePolicy, error) {
+	switch s {
+	case "local", "":
+		return FailLocal, nil
+	case "open":
+		return FailOpen, nil
+	case "closed":
+		return FailClosed, nil
+	}
+	return FailLocal, fmt.Errorf("unknown failure policy %s", s)
 }
 
 func (o *Options) Setup() {
@@ -19,7 +90,34 @@ func (o *Options) Setup() {
 	if o.MaxRequestPerSecond == 0 {
 		o.MaxRequestPerSecond = defaultMaxRequestPerSecond
 	}
-	if o.MaxBytesPerIP == 0 {
-		o.MaxBytesPerIP = defaultMaxBytesPerIP
+	if o.Rate == 0 {
+		o.Rate = float64(o.MaxRequestPerSecond)
+	}
+	if o.Burst == 0 {
+		o.Burst = defaultBurst
+	}
+	if o.QuotaWindow == 0 {
+		o.QuotaWindow = defaultQuotaWindow
+	}
+	if o.IdleTimeout == 0 {
+		o.IdleTimeout = defaultIdleTimeout
+	}
+	if o.KeyFunc == nil {
+		o.KeyFunc = IPKey(o.TrustedProxies, o.IPv6Prefix)
+	}
+	if o.KeyPrefix == "" {
+		o.KeyPrefix = defaultKeyPrefix
+	}
+	if o.FailureCooldown == 0 {
+		o.FailureCooldown = defaultFailureCooldown
+	}
+	if o.MaxClients == 0 {
+		o.MaxClients = defaultMaxClients
+	}
+}
+
+func (o Options) rejected(reason string) {
+	if o.OnReject != nil {
+		o.OnReject(reason)
 	}
 }
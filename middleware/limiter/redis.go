@@ -0,0 +1,415 @@
+package limiter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisLimiter shares the limits between replicas, the token bucket,
+// connection leases and byte quota of a client are updated atomically by lua
+// scripts using the redis clock.
+type RedisLimiter struct {
+	lock    sync.RWMutex
+	options Options
+	client  *redis.Client
+	rate    gcra
+	// local limits the requests while redis is unreachable
+	local *Limiter
+	// unavailableUntil is the unix nano time until which redis is not called
+	// after it failed, so requests do not wait for its timeouts
+	unavailableUntil atomic.Int64
+}
+
+func NewRedis(client *redis.Client, opts Options) *RedisLimiter {
+	opts.Setup()
+
+	return &RedisLimiter{
+		options: opts,
+		client:  client,
+		rate:    newGCRA(opts.Rate, opts.Burst),
+		local:   New(opts),
+	}
+}
+
+// Close stops the local fallback limiter, the redis client is left open.
+func (l *RedisLimiter) Close() error {
+	return l.local.Close()
+}
+
+// SetOptions replaces the limits like Limiter.SetOptions, KeyPrefix and the
+// Failure policy are kept.
+func (l *RedisLimiter) SetOptions(opts Options) {
+	opts.Setup()
+
+	l.lock.Lock()
+	opts.KeyPrefix = l.options.KeyPrefix
+	opts.Failure = l.options.Failure
+	opts.FailureCooldown = l.options.FailureCooldown
+	l.options = opts
+	l.rate = newGCRA(opts.Rate, opts.Burst)
+	l.lock.Unlock()
+
+	l.local.SetOptions(opts)
+}
+
+// config returns the current limits.
+func (l *RedisLimiter) config() (gcra, Options) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return l.rate, l.options
+}
+
+func (l *RedisLimiter) LimitMiddleware(next http.Handler) http.Handler {
+	return Middleware(l, l.options.KeyFunc, next)
+}
+
+// connectionLease is how long a request holds its connection slot without a
+// refresh. Running requests refresh their lease every third of it, so the
+// slots of a crashed replica are freed after connectionLease at the latest.
+const connectionLease = 30 * time.Second
+
+// acquireScript is the GCRA of gcra.allow followed by the byte quota and
+// connection checks of acquire. Times are in microseconds. The quota is
+// counted per fixed window of the redis clock and weighted like
+// windowCounter, KEYS[3] is the prefix of the byte count keys of the windows.
+// The connections are a sorted set of request ids scored by the expiry of
+// their lease.
+var acquireScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local maxConn = tonumber(ARGV[3])
+local maxBytes = tonumber(ARGV[4])
+local lease = tonumber(ARGV[5])
+local window = tonumber(ARGV[6])
+
+local index = math.floor(now / window)
+local elapsed = now - index * window
+
+local tat = tonumber(redis.call("GET", KEYS[1])) or now
+if tat < now then
+	tat = now
+end
+local newTat = tat + interval
+local allowAt = newTat - interval * burst
+if now < allowAt then
+	return {0, 0, allowAt - now, tat - now, "rate", 0, index, elapsed}
+end
+local remaining = math.floor((now - allowAt) / interval)
+local reset = newTat - now
+
+local left = -1
+if maxBytes > 0 then
+	local cur = tonumber(redis.call("GET", KEYS[3] .. index)) or 0
+	local prev = tonumber(redis.call("GET", KEYS[3] .. (index - 1))) or 0
+	left = maxBytes - math.floor(prev * (window - elapsed) / window) - cur
+	if left <= 0 then
+		return {0, remaining, window - elapsed, reset, "quota", 0, index, elapsed}
+	end
+end
+
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", now)
+if redis.call("ZCARD", KEYS[2]) >= maxConn then
+	return {0, remaining, 1000000, reset, "connections", 0, index, elapsed}
+end
+-- the token is only taken once the request is admitted
+redis.call("SET", KEYS[1], newTat, "PX", math.ceil((newTat - now) / 1000) + 1)
+redis.call("ZADD", KEYS[2], now + lease, ARGV[7])
+redis.call("PEXPIRE", KEYS[2], math.ceil(lease / 1000))
+
+return {1, remaining, 0, reset, "", left, index, elapsed}
+`)
+
+var releaseScript = redis.NewScript(`
+redis.call("ZREM", KEYS[1], ARGV[3])
+redis.call("INCRBY", KEYS[2], ARGV[1])
+redis.call("PEXPIRE", KEYS[2], ARGV[2])
+return 1
+`)
+
+// refreshScript extends the connection lease of a running request.
+var refreshScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local lease = tonumber(ARGV[2])
+redis.call("ZADD", KEYS[1], now + lease, ARGV[1])
+redis.call("PEXPIRE", KEYS[1], math.ceil(lease / 1000))
+return 1
+`)
+
+// countScript adds the bytes of a running request and returns the weighted
+// count of the quota window.
+var countScript = redis.NewScript(`
+local cur = redis.call("INCRBY", KEYS[1], ARGV[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+local prev = tonumber(redis.call("GET", KEYS[2])) or 0
+return math.floor(prev * tonumber(ARGV[3])) + cur
+`)
+
+// quotaFlush is the number of bytes a running request counts locally before
+// it adds them in redis and refreshes its remaining quota.
+const quotaFlush = 1 << 20
+
+// redisKeys returns the keys of the token bucket and connection leases and
+// the prefix of the byte count keys of the quota windows.
+func redisKeys(opts Options, key string) []string {
+	prefix := opts.KeyPrefix + key
+	return []string{
+		prefix + ":tat",
+		prefix + ":conn",
+		prefix + ":bytes:",
+	}
+}
+
+// quotaKeys returns the byte count keys of the quota window with the index of
+// the acquire script and of the previous one.
+func quotaKeys(prefix string, index int64) []string {
+	return []string{
+		prefix + strconv.FormatInt(index, 10),
+		prefix + strconv.FormatInt(index-1, 10),
+	}
+}
+
+func (l *RedisLimiter) shapes(key string) []*bandwidth {
+	return l.local.shapes(key)
+}
+
+// quotaOverlap returns the weight of the previous quota window, elapsed is the
+// time since the current one started.
+func quotaOverlap(opts Options, elapsed time.Duration) float64 {
+	if elapsed >= opts.QuotaWindow {
+		return 0
+	}
+	return float64(opts.QuotaWindow-elapsed) / float64(opts.QuotaWindow)
+}
+
+// available reports whether redis may be called, it is skipped for the
+// FailureCooldown after a failure.
+func (l *RedisLimiter) available() bool {
+	return time.Now().UnixNano() >= l.unavailableUntil.Load()
+}
+
+// failed skips redis for the FailureCooldown.
+func (l *RedisLimiter) failed(key string, err error) {
+	_, opts := l.config()
+	if l.available() {
+		log.Printf("remote: %s - redis limiter failed, fall back for %s: %v", key, opts.FailureCooldown, err)
+	}
+	l.unavailableUntil.Store(time.Now().Add(opts.FailureCooldown).UnixNano())
+}
+
+func (l *RedisLimiter) Acquire(key string) (Decision, Transfer, error) {
+	if !l.available() {
+		return l.fallback(key, errUnavailable)
+	}
+
+	rate, opts := l.config()
+	keys := redisKeys(opts, key)
+	id, err := requestID()
+	if err != nil {
+		return l.fallback(key, err)
+	}
+
+	start := time.Now()
+	res, err := acquireScript.Run(l.client, keys,
+		rate.interval.Microseconds(),
+		rate.burst,
+		opts.MaxConnectionPerIP,
+		opts.MaxBytesPerIP,
+		connectionLease.Microseconds(),
+		opts.QuotaWindow.Microseconds(),
+		id,
+	).Result()
+	if err != nil {
+		l.failed(key, err)
+		return l.fallback(key, err)
+	}
+
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 8 {
+		return l.fallback(key, fmt.Errorf("unexpected acquire script result %v", res))
+	}
+	ints := make([]int64, 8)
+	for i := range ints {
+		ints[i], _ = values[i].(int64)
+	}
+	reason, _ := values[4].(string)
+
+	d := Decision{
+		Allowed:    ints[0] == 1,
+		Limit:      rate.burst,
+		Remaining:  int(ints[1]),
+		RetryAfter: time.Duration(ints[2]) * time.Microsecond,
+		Reset:      time.Duration(ints[3]) * time.Microsecond,
+		Reason:     reason,
+	}
+	if !d.Allowed {
+		opts.rejected(d.Reason)
+		return d, nil, nil
+	}
+
+	t := &redisTransfer{
+		limiter:    l,
+		key:        key,
+		id:         id,
+		connKey:    keys[1],
+		quotaKeys:  quotaKeys(keys[2], ints[6]),
+		opts:       opts,
+		start:      start,
+		windowTime: time.Duration(ints[7]) * time.Microsecond,
+		left:       ints[5],
+		done:       make(chan struct{}),
+	}
+	go t.refresh()
+	return d, t, nil
+}
+
+// requestID returns a random id of a connection lease.
+func requestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// redisTransfer counts the bytes of a request locally and adds them in redis
+// every quotaFlush bytes, so concurrent requests on all replicas share the
+// quota. The bytes are counted in the window the request started in.
+type redisTransfer struct {
+	limiter   *RedisLimiter
+	key       string
+	id        string
+	connKey   string
+	quotaKeys []string
+	opts      Options
+	// start is the local time of the acquire, windowTime the time of the
+	// redis clock since its quota window started
+	start      time.Time
+	windowTime time.Duration
+	done       chan struct{}
+
+	lock sync.Mutex
+	// left is the remaining quota, -1 without a quota
+	left    int64
+	pending int64
+}
+
+func (t *redisTransfer) Add(n int64) int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.left >= 0 {
+		n = min(n, t.left)
+		t.left -= n
+	}
+	t.pending += n
+	if t.pending >= quotaFlush {
+		t.flush()
+	}
+	return n
+}
+
+// flush adds the pending bytes in redis and refreshes the remaining quota.
+func (t *redisTransfer) flush() {
+	if !t.limiter.available() {
+		return
+	}
+
+	count, err := countScript.Run(t.limiter.client, t.quotaKeys,
+		t.pending,
+		(2 * t.opts.QuotaWindow).Milliseconds(),
+		quotaOverlap(t.opts, t.windowTime+time.Since(t.start)),
+	).Int64()
+	if err != nil {
+		log.Printf("remote: %s - redis limiter count failed: %v", t.key, err)
+		return
+	}
+
+	t.pending = 0
+	if t.left >= 0 {
+		t.left = max(t.opts.MaxBytesPerIP-count, 0)
+	}
+}
+
+// refresh extends the connection lease until the request is done.
+func (t *redisTransfer) refresh() {
+	ticker := time.NewTicker(connectionLease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			if !t.limiter.available() {
+				continue
+			}
+			err := refreshScript.Run(t.limiter.client, []string{t.connKey}, t.id, connectionLease.Microseconds()).Err()
+			if err != nil {
+				log.Printf("remote: %s - redis limiter lease refresh failed: %v", t.key, err)
+			}
+		}
+	}
+}
+
+func (t *redisTransfer) QuotaReset() time.Duration {
+	return max(t.opts.QuotaWindow-t.windowTime-time.Since(t.start), 0)
+}
+
+func (t *redisTransfer) Done() {
+	close(t.done)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// the lease of the request expires on its own while redis is unavailable
+	if !t.limiter.available() {
+		return
+	}
+
+	err := releaseScript.Run(t.limiter.client, []string{t.connKey, t.quotaKeys[0]}, t.pending, (2 * t.opts.QuotaWindow).Milliseconds(), t.id).Err()
+	if err != nil {
+		log.Printf("remote: %s - redis limiter release failed: %v", t.key, err)
+	}
+	t.pending = 0
+}
+
+// unlimitedTransfer admits every byte.
+type unlimitedTransfer struct{}
+
+func (unlimitedTransfer) Add(n int64) int64 { return n }
+
+func (unlimitedTransfer) QuotaReset() time.Duration { return 0 }
+
+func (unlimitedTransfer) Done() {}
+
+// errUnavailable is the error of requests which skip redis after a failure.
+var errUnavailable = errors.New("redis limiter unavailable")
+
+// fallback decides by the Failure policy, failed logs once redis becomes
+// unavailable.
+func (l *RedisLimiter) fallback(key string, err error) (Decision, Transfer, error) {
+	rate, opts := l.config()
+	switch opts.Failure {
+	case FailOpen:
+		return Decision{Allowed: true, Limit: rate.burst}, unlimitedTransfer{}, nil
+	case FailClosed:
+		opts.rejected(ReasonUnavailable)
+		return Decision{}, nil, err
+	}
+
+	return l.local.Acquire(key)
+}
@@ -0,0 +1,205 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+func newTestRedisLimiter(t *testing.T, opts Options) (*miniredis.Miniredis, *RedisLimiter) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	l := NewRedis(client, opts)
+	t.Cleanup(func() { l.Close() })
+	return mr, l
+}
+
+func TestRedisLimiter(t *testing.T) {
+	mr, l := newTestRedisLimiter(t, Options{Rate: 1, Burst: 2, MaxConnectionPerIP: 1})
+
+	t.Run("burst", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			d, transfer, err := l.Acquire("10.0.0.1")
+			if err != nil {
+				t.Fatalf("acquire failed, error %v", err)
+			}
+			if !d.Allowed {
+				t.Fatalf("request %d rejected within burst", i)
+			}
+			if d.Remaining != 1-i {
+				t.Fatalf("bad remaining, excepted %d, actual %d", 1-i, d.Remaining)
+			}
+			transfer.Add(10)
+			transfer.Done()
+		}
+
+		d, _, err := l.Acquire("10.0.0.1")
+		if err != nil {
+			t.Fatalf("acquire failed, error %v", err)
+		}
+		if d.Allowed {
+			t.Fatal("request allowed over burst")
+		}
+		if d.RetryAfter <= 0 || d.RetryAfter > time.Second {
+			t.Fatalf("bad retry after %v", d.RetryAfter)
+		}
+	})
+
+	t.Run("connections", func(t *testing.T) {
+		d, transfer, err := l.Acquire("10.0.0.2")
+		if err != nil || !d.Allowed {
+			t.Fatalf("first request rejected, error %v", err)
+		}
+
+		if d, _, _ := l.Acquire("10.0.0.2"); d.Allowed {
+			t.Fatal("request allowed over connection limit")
+		}
+		transfer.Done()
+	})
+
+	t.Run("lease-expired", func(t *testing.T) {
+		// a request of a crashed replica which never releases its slot
+		d, crashed, err := l.Acquire("10.0.0.3")
+		if err != nil || !d.Allowed {
+			t.Fatalf("first request rejected, error %v", err)
+		}
+		defer crashed.Done()
+
+		mr.SetTime(time.Now().Add(connectionLease + time.Second))
+		defer mr.SetTime(time.Time{})
+
+		d, transfer, err := l.Acquire("10.0.0.3")
+		if err != nil || !d.Allowed {
+			t.Fatalf("request rejected after the lease expired, error %v", err)
+		}
+		transfer.Done()
+	})
+}
+
+func TestRedisLimiterFailure(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  FailurePolicy
+		allowed bool
+		err     bool
+	}{
+		{"local", FailLocal, true, false},
+		{"open", FailOpen, true, false},
+		{"closed", FailClosed, false, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mr, l := newTestRedisLimiter(t, Options{Failure: c.policy})
+			mr.Close()
+
+			d, transfer, err := l.Acquire("10.0.0.1")
+			if (err != nil) != c.err {
+				t.Fatalf("bad error, excepted error %v, actual %v", c.err, err)
+			}
+			if d.Allowed != c.allowed {
+				t.Fatalf("bad decision, excepted allowed %v, actual %v", c.allowed, d.Allowed)
+			}
+			if transfer != nil {
+				transfer.Done()
+			}
+		})
+	}
+}
+
+func TestRedisLimiterCooldown(t *testing.T) {
+	mr, l := newTestRedisLimiter(t, Options{Failure: FailClosed, FailureCooldown: time.Hour})
+	mr.Close()
+
+	if _, _, err := l.Acquire("10.0.0.1"); err == nil {
+		t.Fatal("excepted an error while redis is down")
+	}
+
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	// redis is not called again before the cooldown ended
+	if _, _, err := l.Acquire("10.0.0.1"); err != errUnavailable {
+		t.Fatalf("bad error within the cooldown, excepted %v, actual %v", errUnavailable, err)
+	}
+
+	l.unavailableUntil.Store(0)
+	d, transfer, err := l.Acquire("10.0.0.1")
+	if err != nil || !d.Allowed {
+		t.Fatalf("request rejected after the cooldown, error %v", err)
+	}
+	transfer.Done()
+}
+
+func TestRedisLimiterQuota(t *testing.T) {
+	_, l := newTestRedisLimiter(t, Options{Rate: 100, Burst: 100, MaxConnectionPerIP: 2, MaxBytesPerIP: 10})
+
+	d, transfer, err := l.Acquire("10.0.0.1")
+	if err != nil || !d.Allowed {
+		t.Fatalf("first request rejected, error %v", err)
+	}
+	if n := transfer.Add(20); n != 10 {
+		t.Fatalf("bad transfer, excepted 10 bytes within the quota, actual %d", n)
+	}
+	transfer.Done()
+
+	d, _, err = l.Acquire("10.0.0.1")
+	if err != nil {
+		t.Fatalf("acquire failed, error %v", err)
+	}
+	if d.Allowed {
+		t.Fatal("request allowed over quota")
+	}
+}
+
+func TestRedisLimiterQuotaClock(t *testing.T) {
+	mr, l := newTestRedisLimiter(t, Options{Rate: 100, Burst: 100, MaxBytesPerIP: 10, QuotaWindow: time.Hour})
+
+	d, transfer, err := l.Acquire("10.0.0.1")
+	if err != nil || !d.Allowed {
+		t.Fatalf("first request rejected, error %v", err)
+	}
+	transfer.Add(10)
+	transfer.Done()
+
+	// the quota windows follow the redis clock, not the local one
+	mr.SetTime(time.Now().Add(2 * time.Hour))
+	defer mr.SetTime(time.Time{})
+
+	d, transfer, err = l.Acquire("10.0.0.1")
+	if err != nil || !d.Allowed {
+		t.Fatalf("request rejected in a new quota window of the redis clock, error %v, decision %+v", err, d)
+	}
+	transfer.Done()
+}
+
+func TestRedisLimiterRejectedKeepsTokens(t *testing.T) {
+	_, l := newTestRedisLimiter(t, Options{Rate: 0.01, Burst: 3, MaxConnectionPerIP: 1})
+
+	d, transfer, err := l.Acquire("10.0.0.1")
+	if err != nil || !d.Allowed {
+		t.Fatalf("first request rejected, error %v", err)
+	}
+
+	// the retries rejected for the connection limit take no tokens
+	for i := 0; i < 5; i++ {
+		if d, _, _ := l.Acquire("10.0.0.1"); d.Allowed || d.Reason != ReasonConnections {
+			t.Fatalf("bad decision of retry %d, excepted reason %s, actual %+v", i, ReasonConnections, d)
+		}
+	}
+	transfer.Done()
+
+	d, transfer, err = l.Acquire("10.0.0.1")
+	if err != nil || !d.Allowed {
+		t.Fatalf("request rejected after the connection was released, error %v, decision %+v", err, d)
+	}
+	if d.Remaining != 1 {
+		t.Fatalf("bad remaining, excepted 1, actual %d", d.Remaining)
+	}
+	transfer.Done()
+}
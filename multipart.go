@@ -0,0 +1,182 @@
+package httpfiles
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/nameoffnv/httpfiles/storage"
+)
+
+type uploadedFile struct {
+	Hash        string `json:"hash"`
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+const (
+	defaultMaxMultipartParts = 32
+	// multipartPartOverhead is allowed per part for the boundary and headers
+	// when the body limit is derived from MaxFileSize
+	multipartPartOverhead = 16 * 1024
+)
+
+// pendingPart is a received file part which is saved once the whole body was
+// read.
+type pendingPart struct {
+	writer storage.ObjectWriter
+	file   uploadedFile
+}
+
+// handleMultipart streams every file part of a multipart/form-data body into
+// its own object. Form fields without a filename are ignored, the size limit
+// applies to each file separately. The files are only saved once the whole
+// body was received, so a failed part leaves none of them behind.
+func (s *FilesHandler) handleMultipart(rw http.ResponseWriter, req *http.Request, maxFileSize int64, expireDate *time.Time) {
+	// the query hashes can not tell which of the files they are meant for
+	if len(expectedHashes(req.URL.Query())) > 0 {
+		http.Error(rw, "hashes are not supported for multipart uploads", http.StatusBadRequest)
+		return
+	}
+
+	if maxSize := s.multipartMaxSize(maxFileSize); maxSize > 0 {
+		if req.ContentLength > maxSize {
+			http.Error(rw, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = http.MaxBytesReader(rw, req.Body, maxSize)
+	}
+
+	mr, err := req.MultipartReader()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pending := []*pendingPart{}
+	// Remove does nothing for the saved writers
+	defer func() {
+		for _, p := range pending {
+			p.writer.Remove()
+		}
+	}()
+
+	for parts := 1; ; parts++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(rw, err.Error(), bodyErrorStatus(err, http.StatusBadRequest))
+			return
+		}
+
+		if parts > s.maxMultipartParts {
+			part.Close()
+			http.Error(rw, "too many parts", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		p, status, err := s.receivePart(req, part, maxFileSize, expireDate)
+		part.Close()
+		if err != nil {
+			http.Error(rw, err.Error(), status)
+			return
+		}
+
+		pending = append(pending, p)
+	}
+
+	files := []uploadedFile{}
+	for _, p := range pending {
+		h, err := p.writer.Save()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := s.postSave(req, h); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		p.file.Hash = h
+		files = append(files, p.file)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(rw).Encode(files); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// multipartMaxSize returns the limit of a whole multipart body, zero means no
+// limit.
+func (s *FilesHandler) multipartMaxSize(maxFileSize int64) int64 {
+	if s.maxMultipartSize > 0 {
+		return s.maxMultipartSize
+	}
+	if maxFileSize > 0 {
+		return int64(s.maxMultipartParts) * (maxFileSize + multipartPartOverhead)
+	}
+	return 0
+}
+
+// bodyErrorStatus returns 413 if err comes from the body size limit and
+// status otherwise.
+func bodyErrorStatus(err error, status int) int {
+	if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return status
+}
+
+// receivePart writes a file part into a new object, it is not saved yet.
+func (s *FilesHandler) receivePart(req *http.Request, part *multipart.Part, maxFileSize int64, expireDate *time.Time) (*pendingPart, int, error) {
+	objectWriter, err := s.newObjectWriter(req)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	var reader io.Reader = part
+	if maxFileSize > 0 {
+		reader = io.LimitReader(part, maxFileSize+1)
+	}
+
+	n, err := io.Copy(objectWriter, reader)
+	if err != nil {
+		objectWriter.Remove()
+		return nil, bodyErrorStatus(err, http.StatusInternalServerError), err
+	}
+
+	if maxFileSize > 0 && n > maxFileSize {
+		objectWriter.Remove()
+		return nil, http.StatusRequestEntityTooLarge, errors.New(http.StatusText(http.StatusRequestEntityTooLarge))
+	}
+
+	meta := storage.Meta{
+		Filename:    part.FileName(),
+		ContentType: part.Header.Get("Content-Type"),
+		ExpireDate:  expireDate,
+	}
+	objectWriter.SetMeta(meta)
+
+	return &pendingPart{
+		writer: objectWriter,
+		file: uploadedFile{
+			Filename:    meta.Filename,
+			Size:        n,
+			ContentType: meta.ContentType,
+		},
+	}, 0, nil
+}
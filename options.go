@@ -0,0 +1,75 @@
+package httpfiles
+
+import (
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option configures a FilesHandler.
+type Option func(*FilesHandler)
+
+// MaxFileSize limits the size of uploaded files in bytes, zero means no limit.
+func MaxFileSize(n int64) Option {
+	return func(s *FilesHandler) {
+		s.maxFileSize.Store(n)
+	}
+}
+
+// MaxMultipartParts limits the number of parts of a multipart upload, form
+// fields included. Zero means the default of 32.
+func MaxMultipartParts(n int) Option {
+	return func(s *FilesHandler) {
+		s.maxMultipartParts = n
+	}
+}
+
+// MaxMultipartSize limits the whole body of a multipart upload in bytes. By
+// default it is derived from MaxFileSize and MaxMultipartParts, without
+// MaxFileSize there is no limit.
+func MaxMultipartSize(n int64) Option {
+	return func(s *FilesHandler) {
+		s.maxMultipartSize = n
+	}
+}
+
+// ReapInterval sets how often expired objects are deleted, it only has effect
+// for storages implementing storage.Expirer. Zero disables the reaper.
+func ReapInterval(d time.Duration) Option {
+	return func(s *FilesHandler) {
+		s.reapInterval = d
+	}
+}
+
+// SignedURLs enables pre-signed urls verified by the signer. The used upload
+// urls are remembered in memory, so each replica accepts an upload url once.
+func SignedURLs(signer *Signer) Option {
+	return func(s *FilesHandler) {
+		s.signer = signer
+	}
+}
+
+// AccessLog sets the logger of the access log, any slog.Handler may be used,
+// e.g. slog.NewJSONHandler or slog.NewTextHandler for logfmt.
+func AccessLog(logger *slog.Logger) Option {
+	return func(s *FilesHandler) {
+		s.logger = logger
+	}
+}
+
+// LogSampling logs only the given fraction of successful requests, failed
+// requests are always logged.
+func LogSampling(rate float64) Option {
+	return func(s *FilesHandler) {
+		s.logSampling = rate
+	}
+}
+
+// Tracing sets the provider of the request and storage spans, by default the
+// global provider of otel is used.
+func Tracing(tp trace.TracerProvider) Option {
+	return func(s *FilesHandler) {
+		s.tracer = tp.Tracer(tracerName)
+	}
+}
@@ -3,10 +3,15 @@ package httpfiles
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
+	"mime"
 	"net/http"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"fmt"
@@ -16,12 +21,18 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"github.com/nameoffnv/httpfiles/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ctxKey int
 
 const (
 	ctxStorageKey ctxKey = iota
+	ctxMaxFileSizeKey
+	ctxAccessKey
+	ctxSignedMaxSizeKey
 )
 
 var Hashes = map[string]func() hash.Hash{
@@ -33,24 +44,70 @@ var Hashes = map[string]func() hash.Hash{
 type FilesHandler struct {
 	*http.ServeMux
 
-	storage     storage.Storage
-	maxFileSize int64
+	storage           storage.Storage
+	maxFileSize       atomic.Int64
+	maxMultipartParts int
+	maxMultipartSize  int64
+	reapInterval      time.Duration
+	uploadLocks       sync.Map
+	writers           sync.Map
+	done              chan struct{}
+	closeOnce         sync.Once
+
+	signer         *Signer
+	usedSignatures sync.Map
+
+	logger      *slog.Logger
+	logSampling float64
+	tracer      trace.Tracer
 
 	PreSave  func(storage.Storage, *http.Request) error
 	PostSave func(storage.Storage, *http.Request, string) error
+	// OnHashMismatch is called when an upload is rejected because it does not
+	// match a client provided hash
+	OnHashMismatch func(*http.Request, *HashMismatchError)
 }
 
-func New(s storage.Storage) (*FilesHandler, error) {
+func New(s storage.Storage, opts ...Option) (*FilesHandler, error) {
 	fh := &FilesHandler{
-		ServeMux: http.NewServeMux(),
-		storage:  s,
+		ServeMux:    http.NewServeMux(),
+		storage:     s,
+		done:        make(chan struct{}),
+		logger:      slog.Default(),
+		logSampling: 1,
+		tracer:      defaultTracer(),
+	}
+
+	for _, opt := range opts {
+		opt(fh)
+	}
+	if fh.maxMultipartParts <= 0 {
+		fh.maxMultipartParts = defaultMaxMultipartParts
+	}
+
+	if expirer, ok := s.(storage.Expirer); ok && fh.reapInterval > 0 {
+		go fh.reap(expirer, fh.reapInterval)
 	}
 
 	fh.Handle("/", fh.WithContext(http.HandlerFunc(fh.handle)))
+	fh.Handle(UploadsPath, fh.WithContext(http.HandlerFunc(fh.handleTus)))
 
 	return fh, nil
 }
 
+// Close stops the background work of the handler and removes the data of
+// uploads which are still running, call it once the server was shut down.
+// Resumable uploads are kept.
+func (s *FilesHandler) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	if n := s.removeWriters(); n > 0 {
+		s.logger.Warn("removed unfinished uploads", "count", n)
+	}
+	return nil
+}
+
 func (s *FilesHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	s.ServeMux.ServeHTTP(rw, req)
 }
@@ -63,20 +120,73 @@ func (s *FilesHandler) GetStorage(req *http.Request) storage.Storage {
 	return cStorage
 }
 
+// SetFileSizeLimit replaces the upload size limit of MaxFileSize, requests
+// which already started keep the previous one.
+func (s *FilesHandler) SetFileSizeLimit(n int64) {
+	s.maxFileSize.Store(n)
+}
+
+// SetMaxFileSize overrides the upload size limit for a single request, it is
+// meant to be called from a PreSave hook, e.g. to allow larger files for
+// authenticated callers. Zero disables the limit.
+func SetMaxFileSize(req *http.Request, n int64) {
+	if maxFileSize, ok := req.Context().Value(ctxMaxFileSizeKey).(*int64); ok {
+		*maxFileSize = n
+	}
+}
+
+// requestMaxFileSize returns the upload size limit of the request, the
+// max_size of a signed url caps it whatever a PreSave hook set.
+func (s *FilesHandler) requestMaxFileSize(req *http.Request) int64 {
+	maxFileSize := s.maxFileSize.Load()
+	if n, ok := req.Context().Value(ctxMaxFileSizeKey).(*int64); ok {
+		maxFileSize = *n
+	}
+	if signed, ok := req.Context().Value(ctxSignedMaxSizeKey).(int64); ok && (maxFileSize == 0 || signed < maxFileSize) {
+		return signed
+	}
+	return maxFileSize
+}
+
 func (s *FilesHandler) WithContext(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		start := time.Now()
-		ctx := context.WithValue(req.Context(), ctxStorageKey, s.storage)
-		next.ServeHTTP(rw, req.WithContext(ctx))
-		stop := time.Now().Sub(start)
-		log.Printf("%s - %s - %d nsec", req.Method, req.URL.RequestURI(), stop.Nanoseconds())
+		ctx, span := s.startRequestSpan(req)
+		defer span.End()
+
+		ctx = s.bindStorage(ctx)
+		maxFileSize := s.maxFileSize.Load()
+		ctx = context.WithValue(ctx, ctxMaxFileSizeKey, &maxFileSize)
+		ctx, info := withAccessInfo(ctx, req)
+		rw.Header().Set(RequestIDHeader, info.requestID)
+		span.SetAttributes(attribute.String("httpfiles.request_id", info.requestID))
+
+		rr := &responseRecorder{ResponseWriter: rw}
+		req = req.WithContext(ctx)
+		next.ServeHTTP(rr, req)
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rr.Status()))
+		if info.hash != "" {
+			span.SetAttributes(attribute.String("httpfiles.hash", info.hash))
+		}
+		if rr.Status() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rr.Status()))
+		}
+		s.logAccess(req, rr, info, time.Since(start))
 	})
 }
 
 func (s *FilesHandler) handle(rw http.ResponseWriter, req *http.Request) {
+	if IsSigned(req) {
+		s.handleSigned(rw, req)
+		return
+	}
+
 	switch req.Method {
 	case http.MethodGet:
 		s.handleGET(rw, req)
+	case http.MethodHead:
+		s.handleHEAD(rw, req)
 	case http.MethodPost:
 		s.handlePOST(rw, req)
 	case http.MethodDelete:
@@ -87,13 +197,42 @@ func (s *FilesHandler) handle(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (s *FilesHandler) handleGET(rw http.ResponseWriter, req *http.Request) {
-	urlParts := strings.Split(req.URL.RequestURI(), "/")
-	if len(urlParts) != 2 {
+	req, span := s.startSpan(req, "httpfiles.handleGET")
+	defer span.End()
+
+	if _, ok := req.URL.Query()["list"]; ok && req.URL.Path == "/" {
+		s.handleList(rw, req)
+		return
+	}
+
+	id, ok := objectID(req)
+	if !ok {
 		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	reader, err := s.storage.Get(urlParts[1])
+	if _, ok := req.URL.Query()["meta"]; ok {
+		s.handleMeta(rw, req, id)
+		return
+	}
+
+	st := s.requestStorage(req)
+
+	// checked before Get, which counts the download
+	info, err := st.Stat(id)
+	if err == storage.ErrNotFound {
+		http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if info.Expired(time.Now()) {
+		http.Error(rw, http.StatusText(http.StatusGone), http.StatusGone)
+		return
+	}
+
+	reader, err := st.Get(id)
 	if err == storage.ErrNotFound {
 		http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
@@ -102,59 +241,162 @@ func (s *FilesHandler) handleGET(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 	defer reader.Close()
+	info = reader.Info()
+
+	setObjectHeaders(rw, info)
+	http.ServeContent(rw, req, id, info.UploadDate, reader)
+}
+
+func (s *FilesHandler) handleHEAD(rw http.ResponseWriter, req *http.Request) {
+	req, span := s.startSpan(req, "httpfiles.handleHEAD")
+	defer span.End()
+
+	id, ok := objectID(req)
+	if !ok {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	info, err := s.requestStorage(req).Stat(id)
+	if err == storage.ErrNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if info.Expired(time.Now()) {
+		rw.WriteHeader(http.StatusGone)
+		return
+	}
+
+	setObjectHeaders(rw, info)
+	// the content is not read, so it can not be sniffed
+	if rw.Header().Get("Content-Type") == "" {
+		rw.Header().Set("Content-Type", "application/octet-stream")
+	}
+	// ServeContent answers the conditional and range headers like for GET,
+	// it only seeks the content of a HEAD request to find its size
+	http.ServeContent(rw, req, id, info.UploadDate, io.NewSectionReader(unreadable{}, 0, info.Size))
+}
+
+// unreadable is the content of HEAD requests.
+type unreadable struct{}
+
+func (unreadable) ReadAt([]byte, int64) (int, error) {
+	return 0, errors.New("content of a HEAD request is not read")
+}
+
+// setObjectHeaders replays the stored metadata of the object.
+func setObjectHeaders(rw http.ResponseWriter, info *storage.ObjectInfo) {
+	// objects are content addressed, so the hash is a strong validator
+	rw.Header().Set("ETag", fmt.Sprintf("%q", info.ID))
+
+	if info.ContentType != "" {
+		rw.Header().Set("Content-Type", info.ContentType)
+	}
+
+	if info.Filename != "" {
+		rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Filename}))
+	}
+}
+
+func (s *FilesHandler) handleMeta(rw http.ResponseWriter, req *http.Request, id string) {
+	info, err := s.requestStorage(req).Stat(id)
+	if err == storage.ErrNotFound {
+		http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	if _, err := io.Copy(rw, reader); err != nil {
+	if info.Expired(time.Now()) {
+		http.Error(rw, http.StatusText(http.StatusGone), http.StatusGone)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(info); err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 	}
 }
 
 func (s *FilesHandler) handlePOST(rw http.ResponseWriter, req *http.Request) {
-	if s.PreSave != nil {
-		if err := s.PreSave(s.storage, req); err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
+	req, span := s.startSpan(req, "httpfiles.handlePOST")
+	defer span.End()
+
+	if err := s.preSave(req); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	maxFileSize := s.requestMaxFileSize(req)
+
+	expireDate, err := s.expireDate(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		s.handleMultipart(rw, req, maxFileSize, expireDate)
+		return
+	}
+
+	if maxFileSize > 0 {
+		if req.ContentLength > maxFileSize {
+			http.Error(rw, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
 			return
 		}
+		req.Body = http.MaxBytesReader(rw, req.Body, maxFileSize)
 	}
 
-	objectWriter, err := s.storage.NewObjectWriter()
+	objectWriter, err := s.newObjectWriter(req)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	meta := requestMeta(req)
+	meta.ExpireDate = expireDate
+	objectWriter.SetMeta(meta)
 
 	writers := []io.Writer{
 		objectWriter,
 	}
 
 	// check url params for hashes
-	checkHashes := make(map[string]hash.Hash)
-	for k := range req.URL.Query() {
-		if hNew, ok := Hashes[k]; ok {
-			h := hNew()
-			checkHashes[k] = h
-			writers = append(writers, h)
-		}
+	expected := expectedHashes(req.URL.Query())
+	checkHashes := newHashes(expected)
+	for _, h := range checkHashes {
+		writers = append(writers, h)
 	}
 
 	mw := io.MultiWriter(writers...)
 
-	if _, err := io.Copy(mw, req.Body); err != nil {
+	// reading the body, hashing and writing to the storage happen together
+	_, copySpan := s.tracer.Start(req.Context(), "httpfiles.receive")
+	n, err := io.Copy(mw, req.Body)
+	copySpan.SetAttributes(attribute.Int64("httpfiles.size", n))
+	spanError(copySpan, err)
+	copySpan.End()
+
+	if err != nil {
+		objectWriter.Remove()
+		if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+			http.Error(rw, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	for k, v := range checkHashes {
-		hashProvided := req.URL.Query().Get(k)
-		hashCalculated := fmt.Sprintf("%x", v.Sum(nil))
-		if hashProvided != hashCalculated {
-			objectWriter.Remove()
-			http.Error(
-				rw,
-				fmt.Sprintf("hash mismatch %s, %s != %s", k, hashProvided, hashCalculated),
-				http.StatusBadRequest,
-			)
-			return
-		}
+	if err := verifyHashes(expected, checkHashes); err != nil {
+		objectWriter.Remove()
+		s.hashMismatch(req, err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	h, err := objectWriter.Save()
@@ -163,11 +405,11 @@ func (s *FilesHandler) handlePOST(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if s.PostSave != nil {
-		if err := s.PostSave(s.storage, req, h); err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	setLogHash(req, h)
+
+	if err := s.postSave(req, h); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	rw.WriteHeader(http.StatusCreated)
@@ -178,13 +420,16 @@ func (s *FilesHandler) handlePOST(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (s *FilesHandler) handleDELETE(rw http.ResponseWriter, req *http.Request) {
-	urlParts := strings.Split(req.URL.RequestURI(), "/")
-	if len(urlParts) != 2 {
+	req, span := s.startSpan(req, "httpfiles.handleDELETE")
+	defer span.End()
+
+	id, ok := objectID(req)
+	if !ok {
 		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	if err := s.storage.Delete(urlParts[1]); err == storage.ErrNotFound {
+	if err := s.requestStorage(req).Delete(id); err == storage.ErrNotFound {
 		http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	} else if err != nil {
@@ -194,3 +439,73 @@ func (s *FilesHandler) handleDELETE(rw http.ResponseWriter, req *http.Request) {
 
 	rw.WriteHeader(http.StatusNoContent)
 }
+
+// requestMeta takes the object metadata of a raw upload from the request
+// headers.
+func requestMeta(req *http.Request) storage.Meta {
+	meta := storage.Meta{
+		ContentType: req.Header.Get("Content-Type"),
+	}
+
+	if _, params, err := mime.ParseMediaType(req.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		meta.Filename = filepath.Base(params["filename"])
+	}
+
+	return meta
+}
+
+// expectedHashes picks the client provided hashes of known algorithms.
+func expectedHashes(values map[string][]string) map[string]string {
+	expected := make(map[string]string)
+	for k, v := range values {
+		if _, ok := Hashes[k]; ok && len(v) > 0 {
+			expected[k] = v[0]
+		}
+	}
+	return expected
+}
+
+func newHashes(expected map[string]string) map[string]hash.Hash {
+	hashes := make(map[string]hash.Hash, len(expected))
+	for k := range expected {
+		hashes[k] = Hashes[k]()
+	}
+	return hashes
+}
+
+// HashMismatchError rejects an upload not matching the client provided hash.
+type HashMismatchError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("hash mismatch %s, %s != %s", e.Algorithm, e.Expected, e.Actual)
+}
+
+func verifyHashes(expected map[string]string, hashes map[string]hash.Hash) *HashMismatchError {
+	for k, v := range hashes {
+		hashProvided := expected[k]
+		hashCalculated := fmt.Sprintf("%x", v.Sum(nil))
+		if hashProvided != hashCalculated {
+			return &HashMismatchError{Algorithm: k, Expected: hashProvided, Actual: hashCalculated}
+		}
+	}
+	return nil
+}
+
+func (s *FilesHandler) hashMismatch(req *http.Request, err *HashMismatchError) {
+	if s.OnHashMismatch != nil {
+		s.OnHashMismatch(req, err)
+	}
+}
+
+// objectID extracts the object hash from a "/<hash>" request path.
+func objectID(req *http.Request) (string, bool) {
+	urlParts := strings.Split(req.URL.Path, "/")
+	if len(urlParts) != 2 || urlParts[1] == "" {
+		return "", false
+	}
+	return urlParts[1], true
+}
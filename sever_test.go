@@ -4,14 +4,22 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"crypto/sha256"
 
 	"github.com/nameoffnv/httpfiles"
+	"github.com/nameoffnv/httpfiles/storage"
+	"github.com/nameoffnv/httpfiles/storage/fs"
 	"github.com/nameoffnv/httpfiles/storage/memory"
 )
 
@@ -119,6 +127,178 @@ func TestFilesHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("get-range", func(t *testing.T) {
+		var hashKey string
+
+		storageObjects := s.(*memory.MemoryStorage).Objects()
+		for k := range storageObjects {
+			hashKey = k
+			break
+		}
+
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprint("/", hashKey), nil)
+		req.Header.Set("Range", "bytes=6-")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusPartialContent {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusPartialContent, rr.Code)
+		}
+
+		if rr.Body.String() != "world" {
+			t.Fatalf("bad range body, excepted 'world', actual '%s'", rr.Body.String())
+		}
+
+		if rr.Header().Get("Content-Range") != "bytes 6-10/11" {
+			t.Fatalf("bad content range, excepted 'bytes 6-10/11', actual '%s'", rr.Header().Get("Content-Range"))
+		}
+	})
+
+	t.Run("get-multi-range", func(t *testing.T) {
+		var hashKey string
+
+		storageObjects := s.(*memory.MemoryStorage).Objects()
+		for k := range storageObjects {
+			hashKey = k
+			break
+		}
+
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprint("/", hashKey), nil)
+		req.Header.Set("Range", "bytes=0-4,6-10")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusPartialContent {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusPartialContent, rr.Code)
+		}
+
+		if !strings.HasPrefix(rr.Header().Get("Content-Type"), "multipart/byteranges") {
+			t.Fatalf("bad content type, excepted multipart/byteranges, actual '%s'", rr.Header().Get("Content-Type"))
+		}
+	})
+
+	t.Run("get-if-none-match", func(t *testing.T) {
+		var hashKey string
+
+		storageObjects := s.(*memory.MemoryStorage).Objects()
+		for k := range storageObjects {
+			hashKey = k
+			break
+		}
+
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprint("/", hashKey), nil)
+		req.Header.Set("If-None-Match", fmt.Sprintf("%q", hashKey))
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotModified {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusNotModified, rr.Code)
+		}
+	})
+
+	t.Run("head", func(t *testing.T) {
+		var hashKey string
+
+		storageObjects := s.(*memory.MemoryStorage).Objects()
+		for k := range storageObjects {
+			hashKey = k
+			break
+		}
+
+		req := httptest.NewRequest(http.MethodHead, fmt.Sprint("/", hashKey), nil)
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusOK, rr.Code)
+		}
+
+		if rr.Header().Get("Content-Length") != fmt.Sprint(len(testObj)) {
+			t.Fatalf("bad content length, excepted %d, actual '%s'", len(testObj), rr.Header().Get("Content-Length"))
+		}
+
+		if rr.Header().Get("ETag") != fmt.Sprintf("%q", hashKey) {
+			t.Fatalf("bad etag, excepted '%q', actual '%s'", hashKey, rr.Header().Get("ETag"))
+		}
+
+		if rr.Body.Len() != 0 {
+			t.Fatalf("excepted empty body, actual '%s'", rr.Body.String())
+		}
+	})
+
+	t.Run("head-conditional", func(t *testing.T) {
+		var hashKey string
+
+		storageObjects := s.(*memory.MemoryStorage).Objects()
+		for k := range storageObjects {
+			hashKey = k
+			break
+		}
+
+		headers := map[string]string{
+			"If-None-Match":     fmt.Sprintf("%q", hashKey),
+			"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat),
+		}
+		for name, value := range headers {
+			req := httptest.NewRequest(http.MethodHead, fmt.Sprint("/", hashKey), nil)
+			req.Header.Set(name, value)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusNotModified {
+				t.Fatalf("bad response status code for %s, excepted %d, actual %d", name, http.StatusNotModified, rr.Code)
+			}
+		}
+	})
+
+	t.Run("head-key-not-exist", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodHead, "/notfoundkey", nil)
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("get-meta", func(t *testing.T) {
+		var hashKey string
+
+		storageObjects := s.(*memory.MemoryStorage).Objects()
+		for k := range storageObjects {
+			hashKey = k
+			break
+		}
+
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprint("/", hashKey, "?meta"), nil)
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusOK, rr.Code)
+		}
+
+		info := storage.ObjectInfo{}
+		if err := json.NewDecoder(rr.Body).Decode(&info); err != nil {
+			t.Fatalf("json decode response failed, error %v", err)
+		}
+
+		if info.ID != hashKey || info.Size != int64(len(testObj)) {
+			t.Fatalf("bad meta, excepted id %s size %d, actual id %s size %d", hashKey, len(testObj), info.ID, info.Size)
+		}
+
+		if info.DownloadCount == 0 {
+			t.Fatal("excepted download count to be tracked")
+		}
+	})
+
 	t.Run("get-key-not-exist", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/notfoundkey", nil)
 		rr := httptest.NewRecorder()
@@ -179,3 +359,421 @@ func TestFilesHandler(t *testing.T) {
 		}
 	})
 }
+
+func TestFilesHandlerMaxFileSize(t *testing.T) {
+	s := memory.New(sha256.New)
+
+	handler, err := httpfiles.New(s, httpfiles.MaxFileSize(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testObj := []byte("hello world")
+
+	t.Run("content-length", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(testObj))
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusRequestEntityTooLarge, rr.Code)
+		}
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(testObj))
+		req.ContentLength = -1
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusRequestEntityTooLarge, rr.Code)
+		}
+
+		if len(s.(*memory.MemoryStorage).Objects()) != 0 {
+			t.Fatal("object saved to memory storage after size limit exceeded")
+		}
+	})
+
+	t.Run("presave-override", func(t *testing.T) {
+		handler.PreSave = func(_ storage.Storage, req *http.Request) error {
+			httpfiles.SetMaxFileSize(req, 0)
+			return nil
+		}
+		defer func() { handler.PreSave = nil }()
+
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(testObj))
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusCreated, rr.Code)
+		}
+	})
+}
+
+func TestFilesHandlerMultipart(t *testing.T) {
+	s := memory.New(sha256.New)
+
+	handler, err := httpfiles.New(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	mw.WriteField("comment", "ignored")
+
+	partHeader := textproto.MIMEHeader{}
+	partHeader.Set("Content-Disposition", `form-data; name="file"; filename="hello.txt"`)
+	partHeader.Set("Content-Type", "text/plain")
+	part, err := mw.CreatePart(partHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("hello world"))
+
+	part, err = mw.CreateFormFile("file", "data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte{0, 1, 2})
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("bad response status code, excepted %d, acutal %d", http.StatusCreated, rr.Code)
+	}
+
+	files := []struct {
+		Hash        string `json:"hash"`
+		Filename    string `json:"filename"`
+		Size        int64  `json:"size"`
+		ContentType string `json:"content_type"`
+	}{}
+	if err := json.NewDecoder(rr.Body).Decode(&files); err != nil {
+		t.Fatalf("json decode response failed, error %v", err)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("excepted 2 uploaded files, actual %d", len(files))
+	}
+
+	if files[0].Filename != "hello.txt" || files[0].Size != 11 || files[0].ContentType != "text/plain" {
+		t.Fatalf("bad uploaded file %+v", files[0])
+	}
+
+	req = httptest.NewRequest(http.MethodGet, fmt.Sprint("/", files[0].Hash), nil)
+	rr = httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Body.String() != "hello world" {
+		t.Fatalf("test object not equal object from storage, 'hello world' != '%s'", rr.Body.String())
+	}
+
+	if rr.Header().Get("Content-Type") != "text/plain" {
+		t.Fatalf("bad content type, excepted 'text/plain', actual '%s'", rr.Header().Get("Content-Type"))
+	}
+
+	if rr.Header().Get("Content-Disposition") != `attachment; filename=hello.txt` {
+		t.Fatalf("bad content disposition '%s'", rr.Header().Get("Content-Disposition"))
+	}
+}
+
+func TestFilesHandlerMultipartLimits(t *testing.T) {
+	// upload posts a multipart body with a file part of every size
+	upload := func(handler http.Handler, target string, sizes ...int) *httptest.ResponseRecorder {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		for i, size := range sizes {
+			part, err := mw.CreateFormFile("file", fmt.Sprintf("file%d.bin", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			part.Write(bytes.Repeat([]byte{byte(i)}, size))
+		}
+		mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, target, body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	cases := []struct {
+		name     string
+		opts     []httpfiles.Option
+		target   string
+		sizes    []int
+		excepted int
+	}{
+		{"too-many-parts", []httpfiles.Option{httpfiles.MaxMultipartParts(2)}, "/", []int{1, 2, 3}, http.StatusRequestEntityTooLarge},
+		{"body-too-large", []httpfiles.Option{httpfiles.MaxMultipartSize(1024)}, "/", []int{600, 600}, http.StatusRequestEntityTooLarge},
+		{"later-part-too-large", []httpfiles.Option{httpfiles.MaxFileSize(5)}, "/", []int{3, 10}, http.StatusRequestEntityTooLarge},
+		{"hashes-rejected", nil, "/?sha256=b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", []int{3}, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := memory.New(sha256.New)
+			handler, err := httpfiles.New(s, c.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rr := upload(handler, c.target, c.sizes...); rr.Code != c.excepted {
+				t.Fatalf("bad response status code, excepted %d, acutal %d", c.excepted, rr.Code)
+			}
+
+			// none of the files is kept when the upload fails
+			if objects, _, _ := s.(storage.Counter).Count(); objects != 0 {
+				t.Fatalf("excepted no stored objects, actual %d", objects)
+			}
+		})
+	}
+}
+
+func TestFilesHandlerExpire(t *testing.T) {
+	s := memory.New(sha256.New)
+
+	handler, err := httpfiles.New(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("upload-ttl", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/?ttl=1h", strings.NewReader("hello world"))
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("bad response status code, excepted %d, acutal %d", http.StatusCreated, rr.Code)
+		}
+
+		respMap := make(map[string]string)
+		json.NewDecoder(rr.Body).Decode(&respMap)
+
+		info, err := s.Stat(respMap["hash"])
+		if err != nil {
+			t.Fatalf("stat failed, error %v", err)
+		}
+
+		if info.ExpireDate == nil || info.ExpireDate.Before(time.Now().Add(59*time.Minute)) {
+			t.Fatalf("bad expire date %v", info.ExpireDate)
+		}
+	})
+
+	t.Run("reupload-keeps-permanent", func(t *testing.T) {
+		upload := func(url string) string {
+			req := httptest.NewRequest(http.MethodPost, url, strings.NewReader("permanent"))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("bad response status code, excepted %d, acutal %d", http.StatusCreated, rr.Code)
+			}
+			respMap := make(map[string]string)
+			json.NewDecoder(rr.Body).Decode(&respMap)
+			return respMap["hash"]
+		}
+
+		h := upload("/")
+		upload("/?ttl=1m")
+
+		info, err := s.Stat(h)
+		if err != nil {
+			t.Fatalf("stat failed, error %v", err)
+		}
+		if info.ExpireDate != nil {
+			t.Fatalf("excepted permanent file, actual expire date %v", info.ExpireDate)
+		}
+	})
+
+	t.Run("upload-expire-in-past", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/?expire_at=2001-01-01T00:00:00Z", strings.NewReader("hello world"))
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("bad response status code, excepted %d, acutal %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("gone-and-reaped", func(t *testing.T) {
+		w, err := s.NewObjectWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("expired"))
+		expireDate := time.Now().Add(-time.Second)
+		w.SetMeta(storage.Meta{ExpireDate: &expireDate})
+
+		h, err := w.Save()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprint("/", h), nil)
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusGone {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusGone, rr.Code)
+		}
+		if info, _ := s.Stat(h); info.DownloadCount != 0 {
+			t.Fatalf("excepted no download counted for an expired object, actual %d", info.DownloadCount)
+		}
+
+		reaper, err := httpfiles.New(s, httpfiles.ReapInterval(10*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reaper.Close()
+
+		deadline := time.Now().Add(time.Second)
+		for {
+			if _, err := s.Stat(h); err == storage.ErrNotFound {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("expired object was not reaped")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestFilesHandlerExpireNotSupported(t *testing.T) {
+	// fs keeps no metadata, so expired objects can not be found
+	handler, err := httpfiles.New(fs.New(t.TempDir(), sha256.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/?ttl=1h", httpfiles.UploadsPath + "?ttl=1h"} {
+		t.Run(target, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, target, strings.NewReader("hello world"))
+			req.Header.Set("Tus-Resumable", "1.0.0")
+			req.Header.Set("Upload-Length", "11")
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusBadRequest, rr.Code)
+			}
+		})
+	}
+}
+
+func TestFilesHandlerList(t *testing.T) {
+	s := memory.New(sha256.New)
+
+	handler, err := httpfiles.New(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range []string{"a", "bb", "ccc"} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(data))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	list := func(t *testing.T, query string) (int, storage.ListPage) {
+		req := httptest.NewRequest(http.MethodGet, "/?list&"+query, nil)
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		page := storage.ListPage{}
+		if rr.Code == http.StatusOK {
+			if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+				t.Fatalf("json decode response failed, error %v", err)
+			}
+		}
+		return rr.Code, page
+	}
+
+	t.Run("pages", func(t *testing.T) {
+		code, page := list(t, "sort=size&order=desc&limit=2")
+		if code != http.StatusOK {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusOK, code)
+		}
+		if len(page.Objects) != 2 || page.Objects[0].Size != 3 || page.Next == "" {
+			t.Fatalf("bad first page %v next '%s'", page.Objects, page.Next)
+		}
+
+		code, page = list(t, "sort=size&order=desc&limit=2&cursor="+page.Next)
+		if code != http.StatusOK {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusOK, code)
+		}
+		if len(page.Objects) != 1 || page.Objects[0].Size != 1 || page.Next != "" {
+			t.Fatalf("bad last page %v next '%s'", page.Objects, page.Next)
+		}
+	})
+
+	t.Run("date-range", func(t *testing.T) {
+		from := time.Now().Add(time.Hour).Format(time.RFC3339)
+		code, page := list(t, "from="+from)
+		if code != http.StatusOK || len(page.Objects) != 0 {
+			t.Fatalf("excepted empty list, actual status %d objects %v", code, page.Objects)
+		}
+	})
+
+	for _, query := range []string{"sort=name", "order=up", "limit=0", "from=yesterday", "cursor=bad"} {
+		t.Run("bad-"+query, func(t *testing.T) {
+			if code, _ := list(t, query); code != http.StatusBadRequest {
+				t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusBadRequest, code)
+			}
+		})
+	}
+}
+
+func TestFilesHandlerClose(t *testing.T) {
+	dir := t.TempDir()
+	handler, err := httpfiles.New(fs.New(dir, sha256.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the upload blocks until the body is closed
+	body, bodyWriter := io.Pipe()
+	done := make(chan int)
+	go func() {
+		req := httptest.NewRequest(http.MethodPost, "/", body)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		done <- rr.Code
+	}()
+	bodyWriter.Write([]byte("partial"))
+
+	tempFiles := func() int {
+		files, _ := os.ReadDir(filepath.Join(dir, "temp"))
+		return len(files)
+	}
+	if n := tempFiles(); n != 1 {
+		t.Fatalf("excepted 1 temp file of the running upload, actual %d", n)
+	}
+
+	handler.Close()
+	if n := tempFiles(); n != 0 {
+		t.Fatalf("excepted the temp file removed on close, actual %d", n)
+	}
+
+	bodyWriter.Close()
+	if code := <-done; code == http.StatusCreated {
+		t.Fatalf("excepted the closed upload to fail, actual %d", code)
+	}
+}
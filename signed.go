@@ -0,0 +1,252 @@
+package httpfiles
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	signExpiresParam = "expires"
+	signKeyParam     = "kid"
+	signParam        = "sig"
+	signMaxSizeParam = "max_size"
+)
+
+var (
+	ErrSignatureInvalid = errors.New("invalid url signature")
+	ErrSignatureExpired = errors.New("url signature expired")
+)
+
+// SigningKey is a secret to sign urls with, the ID is put into the signed url
+// so the key can be found on verification.
+type SigningKey struct {
+	ID     string
+	Secret []byte
+}
+
+// Signer issues and verifies HMAC-SHA256 signed urls. New urls are signed with
+// the first key, the others are only used for verification, so a key can be
+// rotated by prepending a new one and removing the old one once its urls have
+// expired.
+type Signer struct {
+	lock sync.RWMutex
+	keys []SigningKey
+}
+
+func NewSigner(keys ...SigningKey) *Signer {
+	return &Signer{keys: keys}
+}
+
+// SetKeys replaces the signing keys.
+func (s *Signer) SetKeys(keys ...SigningKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.keys = keys
+}
+
+// UploadPolicy restricts what a signed upload url accepts.
+type UploadPolicy struct {
+	// MaxSize limits the size of the uploaded file, zero keeps the handler limit
+	MaxSize int64
+	// Hashes are the expected hashes of the file by algorithm, e.g. "sha256"
+	Hashes map[string]string
+}
+
+// SignDownload returns the signed "/<id>?..." url of an object.
+func (s *Signer) SignDownload(id string, expires time.Time) (string, error) {
+	return s.Sign(http.MethodGet, "/"+id, nil, expires)
+}
+
+// SignUpload returns a signed url which allows a single POST upload per
+// handler, see SignedURLs.
+func (s *Signer) SignUpload(policy UploadPolicy, expires time.Time) (string, error) {
+	params := url.Values{}
+	if policy.MaxSize > 0 {
+		params.Set(signMaxSizeParam, strconv.FormatInt(policy.MaxSize, 10))
+	}
+	for k, v := range policy.Hashes {
+		if _, ok := Hashes[k]; !ok {
+			return "", fmt.Errorf("unknown hash %s", k)
+		}
+		params.Set(k, v)
+	}
+	return s.Sign(http.MethodPost, "/", params, expires)
+}
+
+// Sign signs the method, path and all params, so none of them can be changed
+// without invalidating the url.
+func (s *Signer) Sign(method, path string, params url.Values, expires time.Time) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if len(s.keys) == 0 {
+		return "", errors.New("no signing keys")
+	}
+	key := s.keys[0]
+
+	signed := url.Values{}
+	for k, v := range params {
+		signed[k] = v
+	}
+	signed.Set(signExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	signed.Set(signKeyParam, key.ID)
+	signed.Set(signParam, signature(key.Secret, method, path, signed))
+
+	return path + "?" + signed.Encode(), nil
+}
+
+// Verify checks the signature and expiration of a signed url request.
+func (s *Signer) Verify(req *http.Request) error {
+	query := req.URL.Query()
+
+	expires, err := strconv.ParseInt(query.Get(signExpiresParam), 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+
+	sig, err := hex.DecodeString(query.Get(signParam))
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+
+	key, ok := s.key(query.Get(signKeyParam))
+	if !ok {
+		return ErrSignatureInvalid
+	}
+
+	// a download url is valid for HEAD as well
+	method := req.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+
+	expected, _ := hex.DecodeString(signature(key.Secret, method, req.URL.Path, query))
+	if !hmac.Equal(sig, expected) {
+		return ErrSignatureInvalid
+	}
+
+	if time.Now().Unix() >= expires {
+		return ErrSignatureExpired
+	}
+
+	return nil
+}
+
+func (s *Signer) key(id string) (SigningKey, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, key := range s.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+func signature(secret []byte, method, path string, params url.Values) string {
+	unsigned := url.Values{}
+	for k, v := range params {
+		if k != signParam {
+			unsigned[k] = v
+		}
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + unsigned.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsSigned reports whether the request uses a signed url.
+func IsSigned(req *http.Request) bool {
+	_, ok := req.URL.Query()[signParam]
+	return ok
+}
+
+// handleSigned verifies a signed url request and applies the upload policy.
+func (s *FilesHandler) handleSigned(rw http.ResponseWriter, req *http.Request) {
+	if s.signer == nil {
+		http.Error(rw, "signed urls are not enabled", http.StatusForbidden)
+		return
+	}
+
+	if err := s.signer.Verify(req); err != nil {
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		s.handleGET(rw, req)
+	case http.MethodHead:
+		s.handleHEAD(rw, req)
+	case http.MethodPost:
+		s.handleSignedPOST(rw, req)
+	default:
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *FilesHandler) handleSignedPOST(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	sig := query.Get(signParam)
+
+	if maxSize := query.Get(signMaxSizeParam); maxSize != "" {
+		n, err := strconv.ParseInt(maxSize, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(rw, "invalid max_size", http.StatusBadRequest)
+			return
+		}
+		// kept apart from SetMaxFileSize, which a PreSave hook may call
+		req = req.WithContext(context.WithValue(req.Context(), ctxSignedMaxSizeKey, n))
+	}
+
+	// multipart uploads are not checked against url hashes
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" && len(expectedHashes(query)) > 0 {
+		http.Error(rw, "upload url with hashes requires a raw body", http.StatusBadRequest)
+		return
+	}
+
+	expires, _ := strconv.ParseInt(query.Get(signExpiresParam), 10, 64)
+	if !s.useSignature(sig, time.Unix(expires, 0)) {
+		http.Error(rw, "upload url already used", http.StatusConflict)
+		return
+	}
+
+	rr := &responseRecorder{ResponseWriter: rw}
+	s.handlePOST(rr, req)
+
+	// a failed upload may be retried with the same url
+	if rr.Status() != http.StatusCreated {
+		s.usedSignatures.Delete(sig)
+	}
+}
+
+// useSignature marks the signature of an upload url as used, it returns false
+// when it was used already. Used signatures are forgotten after they expire.
+// They are kept in memory, so behind several replicas an upload url may be
+// used once per replica.
+func (s *FilesHandler) useSignature(sig string, expires time.Time) bool {
+	now := time.Now()
+	s.usedSignatures.Range(func(k, v interface{}) bool {
+		if now.After(v.(time.Time)) {
+			s.usedSignatures.Delete(k)
+		}
+		return true
+	})
+
+	_, used := s.usedSignatures.LoadOrStore(sig, expires)
+	return !used
+}
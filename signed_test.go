@@ -0,0 +1,161 @@
+package httpfiles_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"crypto/sha256"
+
+	"github.com/nameoffnv/httpfiles"
+	"github.com/nameoffnv/httpfiles/storage"
+	"github.com/nameoffnv/httpfiles/storage/memory"
+)
+
+func TestSignedURLs(t *testing.T) {
+	s := memory.New(sha256.New)
+
+	oldKey := httpfiles.SigningKey{ID: "old", Secret: []byte("old secret")}
+	newKey := httpfiles.SigningKey{ID: "new", Secret: []byte("new secret")}
+	signer := httpfiles.NewSigner(oldKey)
+
+	handler, err := httpfiles.New(s, httpfiles.SignedURLs(signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testObj := []byte("hello world")
+	testHash := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+	serve := func(method, target string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("upload", func(t *testing.T) {
+		target, err := signer.SignUpload(httpfiles.UploadPolicy{
+			MaxSize: int64(len(testObj)),
+			Hashes:  map[string]string{"sha256": testHash},
+		}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rr := serve(http.MethodPost, target, []byte("hello there")); rr.Code != http.StatusBadRequest {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusBadRequest, rr.Code)
+		}
+
+		// the failed upload does not use up the url
+		if rr := serve(http.MethodPost, target, testObj); rr.Code != http.StatusCreated {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusCreated, rr.Code)
+		}
+
+		if rr := serve(http.MethodPost, target, testObj); rr.Code != http.StatusConflict {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusConflict, rr.Code)
+		}
+	})
+
+	t.Run("upload-too-large", func(t *testing.T) {
+		target, err := signer.SignUpload(httpfiles.UploadPolicy{MaxSize: 5}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rr := serve(http.MethodPost, target, testObj); rr.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusRequestEntityTooLarge, rr.Code)
+		}
+	})
+
+	t.Run("upload-too-large-presave", func(t *testing.T) {
+		// a hook raising the handler limit does not lift the signed one
+		handler.PreSave = func(_ storage.Storage, req *http.Request) error {
+			httpfiles.SetMaxFileSize(req, 0)
+			return nil
+		}
+		defer func() { handler.PreSave = nil }()
+
+		target, err := signer.SignUpload(httpfiles.UploadPolicy{MaxSize: 5}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rr := serve(http.MethodPost, target, testObj); rr.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusRequestEntityTooLarge, rr.Code)
+		}
+	})
+
+	t.Run("upload-tampered", func(t *testing.T) {
+		target, err := signer.SignUpload(httpfiles.UploadPolicy{MaxSize: 5}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		target = strings.Replace(target, "max_size=5", "max_size=500", 1)
+		if rr := serve(http.MethodPost, target, testObj); rr.Code != http.StatusForbidden {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("download", func(t *testing.T) {
+		target, err := signer.SignDownload(testHash, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := serve(http.MethodGet, target, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusOK, rr.Code)
+		}
+		if rr.Body.String() != string(testObj) {
+			t.Fatalf("bad response body, excepted '%s', actual '%s'", string(testObj), rr.Body.String())
+		}
+
+		if rr := serve(http.MethodHead, target, nil); rr.Code != http.StatusOK {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusOK, rr.Code)
+		}
+
+		if rr := serve(http.MethodDelete, target, nil); rr.Code != http.StatusForbidden {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("download-expired", func(t *testing.T) {
+		target, err := signer.SignDownload(testHash, time.Now().Add(-time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rr := serve(http.MethodGet, target, nil); rr.Code != http.StatusForbidden {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("key-rotation", func(t *testing.T) {
+		oldTarget, err := signer.SignDownload(testHash, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signer.SetKeys(newKey, oldKey)
+		newTarget, err := signer.SignDownload(testHash, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, target := range []string{oldTarget, newTarget} {
+			if rr := serve(http.MethodGet, target, nil); rr.Code != http.StatusOK {
+				t.Fatalf("bad response status code for %s, excepted %d, actual %d", target, http.StatusOK, rr.Code)
+			}
+		}
+
+		signer.SetKeys(newKey)
+		if rr := serve(http.MethodGet, oldTarget, nil); rr.Code != http.StatusForbidden {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusForbidden, rr.Code)
+		}
+	})
+}
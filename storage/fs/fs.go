@@ -1,9 +1,10 @@
 package fs
 
 import (
-	"io"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	"hash"
 
@@ -27,9 +28,14 @@ func (s *FileStorage) NewObjectWriter() (storage.ObjectWriter, error) {
 	return NewObjectWriter(s.path, s.hashFunc())
 }
 
-func (s *FileStorage) Get(id string) (io.ReadCloser, error) {
-	fname := path.Join(s.path, id[:2], id)
-	if _, err := os.Stat(fname); err != nil {
+func (s *FileStorage) Get(id string) (storage.Object, error) {
+	fname, ok := s.objectPath(id)
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+
+	fi, err := os.Stat(fname)
+	if err != nil {
 		return nil, storage.ErrNotFound
 	}
 
@@ -38,13 +44,161 @@ func (s *FileStorage) Get(id string) (io.ReadCloser, error) {
 		return nil, errors.Wrap(err, "open file")
 	}
 
-	return f, nil
+	return &object{File: f, info: fileInfo(id, fi)}, nil
+}
+
+func (s *FileStorage) Stat(id string) (*storage.ObjectInfo, error) {
+	fname, ok := s.objectPath(id)
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return nil, storage.ErrNotFound
+	}
+
+	return fileInfo(id, fi), nil
 }
 
 func (s *FileStorage) Delete(id string) error {
-	fname := path.Join(s.path, id[:2], id)
+	fname, ok := s.objectPath(id)
+	if !ok {
+		return storage.ErrNotFound
+	}
+
 	if _, err := os.Stat(fname); err != nil {
 		return storage.ErrNotFound
 	}
 	return os.Remove(fname)
 }
+
+// Walk calls fn for every stored object, temporary and unfinished upload
+// files are skipped.
+func (s *FileStorage) Walk(fn func(*storage.ObjectInfo) error) error {
+	dirs, err := os.ReadDir(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "read store dir")
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+
+		files, err := os.ReadDir(path.Join(s.path, dir.Name()))
+		if err != nil {
+			return errors.Wrap(err, "read shard dir")
+		}
+
+		for _, f := range files {
+			if f.IsDir() || !strings.HasPrefix(f.Name(), dir.Name()) {
+				continue
+			}
+
+			fi, err := f.Info()
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return errors.Wrap(err, "stat file")
+			}
+
+			if err := fn(fileInfo(f.Name(), fi)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Count walks all stored files.
+func (s *FileStorage) Count() (int64, int64, error) {
+	var objects, size int64
+	err := s.Walk(func(info *storage.ObjectInfo) error {
+		objects++
+		size += info.Size
+		return nil
+	})
+	return objects, size, err
+}
+
+// SweepTemp deletes temporary files of unfinished writes and resumable
+// uploads which were not written to for olderThan.
+func (s *FileStorage) SweepTemp(olderThan time.Duration) (int, error) {
+	deadline := time.Now().Add(-olderThan)
+
+	removed, err := s.sweepUploads(deadline)
+	if err != nil {
+		return removed, err
+	}
+
+	files, err := os.ReadDir(path.Join(s.path, "temp"))
+	if os.IsNotExist(err) {
+		return removed, nil
+	} else if err != nil {
+		return removed, errors.Wrap(err, "read temp dir")
+	}
+
+	for _, f := range files {
+		fi, err := f.Info()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return removed, errors.Wrap(err, "stat temp file")
+		}
+		if f.IsDir() || !fi.ModTime().Before(deadline) {
+			continue
+		}
+
+		if err := os.Remove(path.Join(s.path, "temp", f.Name())); err != nil && !os.IsNotExist(err) {
+			return removed, errors.Wrap(err, "remove temp file")
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// List walks all stored files, the file modification time is the upload date.
+func (s *FileStorage) List(opts storage.ListOptions) (*storage.ListPage, error) {
+	infos := []*storage.ObjectInfo{}
+	err := s.Walk(func(info *storage.ObjectInfo) error {
+		if opts.Match(info) {
+			infos = append(infos, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return storage.Paginate(infos, opts)
+}
+
+// objectPath returns the location of the object, files are sharded by the
+// first two characters of the hash.
+func (s *FileStorage) objectPath(id string) (string, bool) {
+	if len(id) < 2 || strings.ContainsAny(id, "/\\.") {
+		return "", false
+	}
+	return path.Join(s.path, id[:2], id), true
+}
+
+func fileInfo(id string, fi os.FileInfo) *storage.ObjectInfo {
+	return &storage.ObjectInfo{
+		ID:         id,
+		Size:       fi.Size(),
+		UploadDate: fi.ModTime(),
+	}
+}
+
+type object struct {
+	*os.File
+	info *storage.ObjectInfo
+}
+
+func (o *object) Info() *storage.ObjectInfo {
+	return o.info
+}
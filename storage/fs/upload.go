@@ -0,0 +1,236 @@
+package fs
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/nameoffnv/httpfiles/storage"
+	"github.com/pkg/errors"
+)
+
+const uploadsDir = "uploads"
+
+type fileUpload struct {
+	basePath string
+	info     storage.UploadInfo
+	size     int64
+
+	file     *os.File
+	hashFunc func() hash.Hash
+	verifier storage.Verifier
+}
+
+func (s *FileStorage) NewUpload(info storage.UploadInfo) (storage.Upload, error) {
+	if err := os.MkdirAll(path.Join(s.path, uploadsDir), os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "ensure uploads dir")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errors.Wrap(err, "generate upload id")
+	}
+	info.ID = fmt.Sprintf("%x", id)
+
+	f, err := os.OpenFile(s.uploadPath(info.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "create upload file")
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "marshal upload info")
+	}
+
+	if err := os.WriteFile(s.uploadPath(info.ID)+".info", b, 0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errors.Wrap(err, "write upload info")
+	}
+
+	return &fileUpload{
+		basePath: s.path,
+		info:     info,
+		file:     f,
+		hashFunc: s.hashFunc,
+	}, nil
+}
+
+func (s *FileStorage) GetUpload(id string) (storage.Upload, error) {
+	if !isHex(id) {
+		return nil, storage.ErrNotFound
+	}
+
+	b, err := os.ReadFile(s.uploadPath(id) + ".info")
+	if os.IsNotExist(err) {
+		return nil, storage.ErrNotFound
+	} else if err != nil {
+		return nil, errors.Wrap(err, "read upload info")
+	}
+
+	info := storage.UploadInfo{}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return nil, errors.Wrap(err, "unmarshal upload info")
+	}
+
+	f, err := os.OpenFile(s.uploadPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if os.IsNotExist(err) {
+		return nil, storage.ErrNotFound
+	} else if err != nil {
+		return nil, errors.Wrap(err, "open upload file")
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "stat upload file")
+	}
+
+	return &fileUpload{
+		basePath: s.path,
+		info:     info,
+		size:     fi.Size(),
+		file:     f,
+		hashFunc: s.hashFunc,
+	}, nil
+}
+
+func (s *FileStorage) uploadPath(id string) string {
+	return path.Join(s.path, uploadsDir, id)
+}
+
+// sweepUploads removes the uploads whose data and info files were both last
+// modified before deadline. A PATCH appends to the data file, so its
+// modification time is the last activity of the upload.
+func (s *FileStorage) sweepUploads(deadline time.Time) (int, error) {
+	files, err := os.ReadDir(path.Join(s.path, uploadsDir))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "read uploads dir")
+	}
+
+	// an upload may have lost either of its files, e.g. after a crash
+	ids := make(map[string]struct{})
+	for _, f := range files {
+		if id := strings.TrimSuffix(f.Name(), ".info"); !f.IsDir() && isHex(id) {
+			ids[id] = struct{}{}
+		}
+	}
+
+	removed := 0
+	for id := range ids {
+		stale := true
+		for _, name := range []string{s.uploadPath(id), s.uploadPath(id) + ".info"} {
+			fi, err := os.Stat(name)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return removed, errors.Wrap(err, "stat upload file")
+			}
+			stale = stale && fi.ModTime().Before(deadline)
+		}
+		if !stale {
+			continue
+		}
+
+		if err := os.Remove(s.uploadPath(id) + ".info"); err != nil && !os.IsNotExist(err) {
+			return removed, errors.Wrap(err, "remove upload info")
+		}
+		if err := os.Remove(s.uploadPath(id)); err != nil && !os.IsNotExist(err) {
+			return removed, errors.Wrap(err, "remove upload file")
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+func (u *fileUpload) Write(p []byte) (int, error) {
+	n, err := u.file.Write(p)
+	u.size += int64(n)
+	return n, err
+}
+
+// SetMeta is a no-op, the file storage keeps no metadata.
+func (u *fileUpload) SetMeta(storage.Meta) {}
+
+func (u *fileUpload) Size() int64 {
+	return u.size
+}
+
+func (u *fileUpload) Info() storage.UploadInfo {
+	return u.info
+}
+
+func (u *fileUpload) SetVerifier(verifier storage.Verifier) {
+	u.verifier = verifier
+}
+
+// Save hashes the upload from disk, because the upload may have been started
+// by another process. The verifier reads the file in the same pass.
+func (u *fileUpload) Save() (string, error) {
+	if err := u.file.Close(); err != nil {
+		return "", errors.Wrap(err, "close file")
+	}
+
+	f, err := os.Open(u.file.Name())
+	if err != nil {
+		return "", errors.Wrap(err, "open file")
+	}
+	defer f.Close()
+
+	h := u.hashFunc()
+	var w io.Writer = h
+	if u.verifier != nil {
+		w = io.MultiWriter(h, u.verifier)
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return "", errors.Wrap(err, "hash file")
+	}
+	if u.verifier != nil {
+		if err := u.verifier.Verify(); err != nil {
+			return "", err
+		}
+	}
+	hashSum := fmt.Sprintf("%x", h.Sum(nil))
+
+	if err := storeFile(u.basePath, u.file.Name(), hashSum); err != nil {
+		return "", err
+	}
+
+	if err := os.Remove(u.file.Name() + ".info"); err != nil {
+		return "", errors.Wrap(err, "remove upload info")
+	}
+
+	return hashSum, nil
+}
+
+func (u *fileUpload) Remove() error {
+	u.file.Close()
+	os.Remove(u.file.Name() + ".info")
+	return os.Remove(u.file.Name())
+}
+
+func (u *fileUpload) Close() error {
+	return u.file.Close()
+}
+
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nameoffnv/httpfiles/storage"
+)
+
+type testVerifier struct {
+	data []byte
+	err  error
+}
+
+func (v *testVerifier) Write(p []byte) (int, error) {
+	v.data = append(v.data, p...)
+	return len(p), nil
+}
+
+func (v *testVerifier) Verify() error {
+	return v.err
+}
+
+func TestFileUpload(t *testing.T) {
+	dir := t.TempDir()
+	testObj := []byte("hello world")
+	testHash := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+	newUpload := func(s storage.Storage) storage.Upload {
+		upload, err := s.(storage.Uploader).NewUpload(storage.UploadInfo{
+			Length:   int64(len(testObj)),
+			Metadata: map[string]string{"filename": "hello.txt"},
+		})
+		if err != nil {
+			t.Fatalf("new upload failed, error %v", err)
+		}
+		return upload
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		s := New(dir, sha256.New)
+		upload := newUpload(s)
+		id := upload.Info().ID
+		upload.Write(testObj[:5])
+		upload.Close()
+
+		// a new storage imitates a process restart
+		s = New(dir, sha256.New)
+		upload, err := s.(storage.Uploader).GetUpload(id)
+		if err != nil {
+			t.Fatalf("get upload failed, error %v", err)
+		}
+		if upload.Size() != 5 || upload.Info().Metadata["filename"] != "hello.txt" {
+			t.Fatalf("bad resumed upload, size %d, info %+v", upload.Size(), upload.Info())
+		}
+
+		upload.Write(testObj[5:])
+		h, err := upload.Save()
+		if err != nil {
+			t.Fatalf("save failed, error %v", err)
+		}
+		if h != testHash {
+			t.Fatalf("bad hash, excepted %s, actual %s", testHash, h)
+		}
+
+		obj, err := s.Get(h)
+		if err != nil {
+			t.Fatalf("get failed, error %v", err)
+		}
+		defer obj.Close()
+		if data, _ := io.ReadAll(obj); string(data) != string(testObj) {
+			t.Fatalf("bad stored object, excepted '%s', actual '%s'", testObj, data)
+		}
+
+		if _, err := s.(storage.Uploader).GetUpload(id); err != storage.ErrNotFound {
+			t.Fatalf("excepted the saved upload to be gone, actual error %v", err)
+		}
+	})
+
+	t.Run("get-unknown", func(t *testing.T) {
+		s := New(dir, sha256.New)
+		for _, id := range []string{"abc", "../temp", ""} {
+			if _, err := s.(storage.Uploader).GetUpload(id); err != storage.ErrNotFound {
+				t.Fatalf("bad error for '%s', excepted %v, actual %v", id, storage.ErrNotFound, err)
+			}
+		}
+	})
+
+	t.Run("save-verified", func(t *testing.T) {
+		s := New(t.TempDir(), sha256.New)
+		upload := newUpload(s)
+		upload.Write(testObj)
+
+		verifier := &testVerifier{}
+		upload.SetVerifier(verifier)
+		if _, err := upload.Save(); err != nil {
+			t.Fatalf("save failed, error %v", err)
+		}
+		if string(verifier.data) != string(testObj) {
+			t.Fatalf("bad verified data, excepted '%s', actual '%s'", testObj, verifier.data)
+		}
+	})
+
+	t.Run("save-verify-failed", func(t *testing.T) {
+		s := New(t.TempDir(), sha256.New)
+		upload := newUpload(s)
+		upload.Write(testObj)
+
+		verifyErr := errors.New("mismatch")
+		upload.SetVerifier(&testVerifier{err: verifyErr})
+		if _, err := upload.Save(); err != verifyErr {
+			t.Fatalf("bad save error, excepted %v, actual %v", verifyErr, err)
+		}
+		if _, err := s.Stat(testHash); err != storage.ErrNotFound {
+			t.Fatalf("excepted the object not to be stored, actual error %v", err)
+		}
+	})
+
+	t.Run("sweep", func(t *testing.T) {
+		dir := t.TempDir()
+		s := New(dir, sha256.New).(*FileStorage)
+
+		active := newUpload(s)
+		active.Close()
+		stale := newUpload(s)
+		stale.Close()
+		// an info file which lost its data file
+		orphan := newUpload(s)
+		orphan.Close()
+		os.Remove(s.uploadPath(orphan.Info().ID))
+
+		old := time.Now().Add(-2 * time.Hour)
+		for _, name := range []string{s.uploadPath(stale.Info().ID), s.uploadPath(stale.Info().ID) + ".info", s.uploadPath(orphan.Info().ID) + ".info"} {
+			if err := os.Chtimes(name, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// an old info file of an upload written to recently is kept
+		if err := os.Chtimes(s.uploadPath(active.Info().ID)+".info", old, old); err != nil {
+			t.Fatal(err)
+		}
+
+		removed, err := s.SweepTemp(time.Hour)
+		if err != nil {
+			t.Fatalf("sweep failed, error %v", err)
+		}
+		if removed != 2 {
+			t.Fatalf("bad removed count, excepted 2, actual %d", removed)
+		}
+
+		for _, id := range []string{stale.Info().ID, orphan.Info().ID} {
+			for _, name := range []string{s.uploadPath(id), s.uploadPath(id) + ".info"} {
+				if _, err := os.Stat(name); !os.IsNotExist(err) {
+					t.Fatalf("excepted %s to be removed, actual error %v", name, err)
+				}
+			}
+		}
+		if _, err := s.GetUpload(active.Info().ID); err != nil {
+			t.Fatalf("excepted the active upload to be kept, actual error %v", err)
+		}
+	})
+}
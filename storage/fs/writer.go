@@ -51,17 +51,16 @@ func (w *storageFileWriter) Save() (string, error) {
 	}
 	hashSum := fmt.Sprintf("%x", w.hash.Sum(nil))
 
-	if err := os.MkdirAll(path.Join(w.basePath, hashSum[:2]), os.ModePerm); err != nil {
-		return "", errors.Wrap(err, "ensure destination folder")
-	}
-
-	if err := os.Rename(w.file.Name(), path.Join(w.basePath, hashSum[:2], hashSum)); err != nil {
-		return "", errors.Wrap(err, "rename file")
+	if err := storeFile(w.basePath, w.file.Name(), hashSum); err != nil {
+		return "", err
 	}
 
 	return hashSum, nil
 }
 
+// SetMeta is a no-op, the file storage keeps no metadata.
+func (w *storageFileWriter) SetMeta(storage.Meta) {}
+
 func (w *storageFileWriter) Size() int64 {
 	return w.size
 }
@@ -70,3 +69,16 @@ func (w *storageFileWriter) Remove() error {
 	w.file.Close()
 	return os.Remove(w.file.Name())
 }
+
+// storeFile moves a completely written file to its content addressed location.
+func storeFile(basePath, name, hashSum string) error {
+	if err := os.MkdirAll(path.Join(basePath, hashSum[:2]), os.ModePerm); err != nil {
+		return errors.Wrap(err, "ensure destination folder")
+	}
+
+	if err := os.Rename(name, path.Join(basePath, hashSum[:2], hashSum)); err != nil {
+		return errors.Wrap(err, "rename file")
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotSupported  = errors.New("not supported by the storage")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// ListSort is the order of a listing.
+type ListSort string
+
+const (
+	// SortDefault is the storage order, by hash for fs, memory and
+	// sqlite_fs and the HSCAN order for redis_fs.
+	SortDefault ListSort = ""
+	SortSize    ListSort = "size"
+	SortDate    ListSort = "date"
+)
+
+// ParseListSort parses "size", "date" or an empty string.
+func ParseListSort(s string) (ListSort, error) {
+	switch by := ListSort(s); by {
+	case SortDefault, SortSize, SortDate:
+		return by, nil
+	}
+	return "", fmt.Errorf("unknown sort %s", s)
+}
+
+// ListOptions selects a page of objects. Zero From and To leave the upload
+// date range open, To is exclusive. Limit <= 0 returns all objects.
+type ListOptions struct {
+	Prefix string
+	From   time.Time
+	To     time.Time
+	Sort   ListSort
+	Desc   bool
+	Limit  int
+	Cursor string
+}
+
+// Match reports whether the object passes the prefix and date filters.
+func (o ListOptions) Match(info *ObjectInfo) bool {
+	if !strings.HasPrefix(info.ID, o.Prefix) {
+		return false
+	}
+	if !o.From.IsZero() && info.UploadDate.Before(o.From) {
+		return false
+	}
+	if !o.To.IsZero() && !info.UploadDate.Before(o.To) {
+		return false
+	}
+	return true
+}
+
+// ListPage is a page of a listing, Next is the cursor of the following page
+// and empty on the last one.
+type ListPage struct {
+	Objects []*ObjectInfo `json:"objects"`
+	Next    string        `json:"next,omitempty"`
+}
+
+// Lister is implemented by storages which can enumerate their objects.
+type Lister interface {
+	List(ListOptions) (*ListPage, error)
+}
+
+// Paginate sorts the matching objects and cuts the page following the cursor.
+// It is used by storages without an index to page through.
+func Paginate(objects []*ObjectInfo, opts ListOptions) (*ListPage, error) {
+	matched := make([]*ObjectInfo, 0, len(objects))
+	for _, info := range objects {
+		if opts.Match(info) {
+			matched = append(matched, info)
+		}
+	}
+
+	less := func(a, b *ObjectInfo) bool {
+		switch opts.Sort {
+		case SortSize:
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case SortDate:
+			if !a.UploadDate.Equal(b.UploadDate) {
+				return a.UploadDate.Before(b.UploadDate)
+			}
+		}
+		return a.ID < b.ID
+	}
+	after := func(a, b *ObjectInfo) bool {
+		if opts.Desc {
+			return less(b, a)
+		}
+		return less(a, b)
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return after(matched[i], matched[j])
+	})
+
+	if opts.Cursor != "" {
+		last, err := DecodeCursor(opts.Cursor, opts.Sort)
+		if err != nil {
+			return nil, err
+		}
+		i := sort.Search(len(matched), func(i int) bool {
+			return after(last, matched[i])
+		})
+		matched = matched[i:]
+	}
+
+	page := &ListPage{Objects: matched}
+	if opts.Limit > 0 && len(matched) > opts.Limit {
+		page.Objects = matched[:opts.Limit]
+		page.Next = EncodeCursor(page.Objects[opts.Limit-1], opts.Sort)
+	}
+
+	return page, nil
+}
+
+// EncodeCursor keeps the sort key and the hash of the last object of a page,
+// the sort is part of the cursor to reject it for a different order.
+func EncodeCursor(info *ObjectInfo, by ListSort) string {
+	var key string
+	switch by {
+	case SortSize:
+		key = strconv.FormatInt(info.Size, 10)
+	case SortDate:
+		key = strconv.FormatInt(info.UploadDate.UnixNano(), 10)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(string(by) + ":" + key + ":" + info.ID))
+}
+
+// DecodeCursor returns the sort key and the hash kept by EncodeCursor, it
+// fails with ErrInvalidCursor if the cursor was made for another sort.
+func DecodeCursor(cursor string, by ListSort) (*ObjectInfo, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	parts := strings.SplitN(string(b), ":", 3)
+	if len(parts) != 3 || ListSort(parts[0]) != by {
+		return nil, ErrInvalidCursor
+	}
+
+	info := &ObjectInfo{ID: parts[2]}
+	switch by {
+	case SortSize:
+		info.Size, err = strconv.ParseInt(parts[1], 10, 64)
+	case SortDate:
+		var ns int64
+		ns, err = strconv.ParseInt(parts[1], 10, 64)
+		info.UploadDate = time.Unix(0, ns)
+	}
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return info, nil
+}
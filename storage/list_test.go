@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPaginate(t *testing.T) {
+	now := time.Now()
+	objects := []*ObjectInfo{
+		{ID: "cc", Size: 1, UploadDate: now},
+		{ID: "aa", Size: 3, UploadDate: now.Add(-time.Hour)},
+		{ID: "ab", Size: 2, UploadDate: now.Add(-2 * time.Hour)},
+		{ID: "bb", Size: 2, UploadDate: now.Add(-3 * time.Hour)},
+	}
+
+	ids := func(page *ListPage) string {
+		s := ""
+		for _, info := range page.Objects {
+			s += info.ID + " "
+		}
+		return s
+	}
+
+	t.Run("pages", func(t *testing.T) {
+		opts := ListOptions{Sort: SortSize, Limit: 2}
+		seen := ""
+		for i := 0; i < 3; i++ {
+			page, err := Paginate(objects, opts)
+			if err != nil {
+				t.Fatalf("paginate failed, error %v", err)
+			}
+			seen += ids(page)
+			if page.Next == "" {
+				break
+			}
+			opts.Cursor = page.Next
+		}
+		if seen != "cc ab bb aa " {
+			t.Fatalf("bad order, excepted 'cc ab bb aa ' actual '%s'", seen)
+		}
+	})
+
+	t.Run("desc", func(t *testing.T) {
+		page, err := Paginate(objects, ListOptions{Sort: SortDate, Desc: true, Limit: 3})
+		if err != nil {
+			t.Fatalf("paginate failed, error %v", err)
+		}
+		if ids(page) != "cc aa ab " || page.Next == "" {
+			t.Fatalf("bad page, excepted 'cc aa ab ' actual '%s' next '%s'", ids(page), page.Next)
+		}
+
+		page, err = Paginate(objects, ListOptions{Sort: SortDate, Desc: true, Limit: 3, Cursor: page.Next})
+		if err != nil {
+			t.Fatalf("paginate failed, error %v", err)
+		}
+		if ids(page) != "bb " || page.Next != "" {
+			t.Fatalf("bad page, excepted 'bb ' actual '%s' next '%s'", ids(page), page.Next)
+		}
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		page, err := Paginate(objects, ListOptions{Prefix: "a", From: now.Add(-90 * time.Minute), To: now})
+		if err != nil {
+			t.Fatalf("paginate failed, error %v", err)
+		}
+		if ids(page) != "aa " {
+			t.Fatalf("bad filter, excepted 'aa ' actual '%s'", ids(page))
+		}
+	})
+
+	t.Run("cursor-of-other-sort", func(t *testing.T) {
+		page, _ := Paginate(objects, ListOptions{Sort: SortSize, Limit: 1})
+		if _, err := Paginate(objects, ListOptions{Sort: SortDate, Cursor: page.Next}); err != ErrInvalidCursor {
+			t.Fatalf("excepted invalid cursor, actual %v", err)
+		}
+	})
+}
@@ -2,9 +2,8 @@ package memory
 
 import (
 	"bytes"
-	"io"
-	"io/ioutil"
 	"sync"
+	"time"
 
 	"hash"
 
@@ -13,6 +12,8 @@ import (
 
 type MemoryStorage struct {
 	objects  map[string][]byte
+	infos    map[string]*storage.ObjectInfo
+	uploads  map[string]*upload
 	hashFunc func() hash.Hash
 	lock     sync.RWMutex
 }
@@ -20,35 +21,116 @@ type MemoryStorage struct {
 func New(h func() hash.Hash) storage.Storage {
 	return &MemoryStorage{
 		objects:  make(map[string][]byte),
+		infos:    make(map[string]*storage.ObjectInfo),
+		uploads:  make(map[string]*upload),
 		hashFunc: h,
 	}
 }
 
-func (s MemoryStorage) Objects() map[string][]byte {
+func (s *MemoryStorage) Objects() map[string][]byte {
 	return s.objects
 }
 
 func (s *MemoryStorage) NewObjectWriter() (storage.ObjectWriter, error) {
 	return &objectWriter{
 		h: s.hashFunc(),
-		postSave: func(h string, b []byte) {
+		postSave: func(h string, b []byte, meta storage.Meta) {
 			s.lock.Lock()
 			defer s.lock.Unlock()
 
+			// the same content uploaded again only extends the expiry
+			if info, ok := s.infos[h]; ok {
+				info.ExpireDate = laterExpireDate(info.ExpireDate, meta.ExpireDate)
+				return
+			}
+
 			s.objects[h] = b
+			s.infos[h] = &storage.ObjectInfo{
+				Meta:       meta,
+				ID:         h,
+				Size:       int64(len(b)),
+				UploadDate: time.Now(),
+			}
 		},
 	}, nil
 }
 
-func (s *MemoryStorage) Get(id string) (io.ReadCloser, error) {
+// laterExpireDate merges two expire dates, no expiry wins over any date.
+func laterExpireDate(a, b *time.Time) *time.Time {
+	if a == nil || b == nil {
+		return nil
+	}
+	if b.After(*a) {
+		return b
+	}
+	return a
+}
+
+func (s *MemoryStorage) Get(id string) (storage.Object, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b, ok := s.objects[id]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+
+	info := s.infos[id]
+	info.DownloadCount++
+
+	infoCopy := *info
+	return &object{Reader: bytes.NewReader(b), info: &infoCopy}, nil
+}
+
+func (s *MemoryStorage) Stat(id string) (*storage.ObjectInfo, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	b, ok := s.objects[id]
+	info, ok := s.infos[id]
 	if !ok {
 		return nil, storage.ErrNotFound
 	}
-	return ioutil.NopCloser(bytes.NewReader(b)), nil
+
+	infoCopy := *info
+	return &infoCopy, nil
+}
+
+func (s *MemoryStorage) Expired(now time.Time) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	expired := []string{}
+	for id, info := range s.infos {
+		if info.Expired(now) {
+			expired = append(expired, id)
+		}
+	}
+
+	return expired, nil
+}
+
+func (s *MemoryStorage) Count() (int64, int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var size int64
+	for _, info := range s.infos {
+		size += info.Size
+	}
+
+	return int64(len(s.infos)), size, nil
+}
+
+func (s *MemoryStorage) List(opts storage.ListOptions) (*storage.ListPage, error) {
+	s.lock.RLock()
+	infos := make([]*storage.ObjectInfo, 0, len(s.infos))
+	for _, info := range s.infos {
+		infoCopy := *info
+		infos = append(infos, &infoCopy)
+	}
+	s.lock.RUnlock()
+
+	return storage.Paginate(infos, opts)
 }
 
 func (s *MemoryStorage) Delete(id string) error {
@@ -60,6 +142,20 @@ func (s *MemoryStorage) Delete(id string) error {
 	}
 
 	delete(s.objects, id)
+	delete(s.infos, id)
+
+	return nil
+}
+
+type object struct {
+	*bytes.Reader
+	info *storage.ObjectInfo
+}
+
+func (o *object) Info() *storage.ObjectInfo {
+	return o.info
+}
 
+func (o *object) Close() error {
 	return nil
 }
@@ -0,0 +1,91 @@
+package memory
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/nameoffnv/httpfiles/storage"
+)
+
+type upload struct {
+	objectWriter
+	info     storage.UploadInfo
+	storage  *MemoryStorage
+	verifier storage.Verifier
+}
+
+func (s *MemoryStorage) NewUpload(info storage.UploadInfo) (storage.Upload, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	info.ID = fmt.Sprintf("%x", id)
+
+	w, err := s.NewObjectWriter()
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upload{
+		objectWriter: *w.(*objectWriter),
+		info:         info,
+		storage:      s,
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.uploads[info.ID] = u
+
+	return u, nil
+}
+
+func (s *MemoryStorage) GetUpload(id string) (storage.Upload, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	u, ok := s.uploads[id]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return u, nil
+}
+
+func (u *upload) Info() storage.UploadInfo {
+	return u.info
+}
+
+func (u *upload) SetVerifier(verifier storage.Verifier) {
+	u.verifier = verifier
+}
+
+func (u *upload) Save() (string, error) {
+	if u.verifier != nil {
+		u.verifier.Write(u.data)
+		if err := u.verifier.Verify(); err != nil {
+			return "", err
+		}
+	}
+	h, err := u.objectWriter.Save()
+	if err != nil {
+		return "", err
+	}
+	u.forget()
+	return h, nil
+}
+
+func (u *upload) Remove() error {
+	u.forget()
+	return nil
+}
+
+func (u *upload) Close() error {
+	return nil
+}
+
+func (u *upload) forget() {
+	u.storage.lock.Lock()
+	defer u.storage.lock.Unlock()
+
+	delete(u.storage.uploads, u.info.ID)
+}
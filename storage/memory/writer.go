@@ -5,12 +5,15 @@ import (
 	"fmt"
 	"hash"
 	"io"
+
+	"github.com/nameoffnv/httpfiles/storage"
 )
 
 type objectWriter struct {
 	data     []byte
+	meta     storage.Meta
 	h        hash.Hash
-	postSave func(string, []byte)
+	postSave func(string, []byte, storage.Meta)
 }
 
 func (w *objectWriter) Write(b []byte) (int, error) {
@@ -22,12 +25,16 @@ func (w *objectWriter) Size() int64 {
 	return int64(len(w.data))
 }
 
+func (w *objectWriter) SetMeta(meta storage.Meta) {
+	w.meta = meta
+}
+
 func (w *objectWriter) Save() (string, error) {
 	if _, err := io.Copy(w.h, bytes.NewReader(w.data)); err != nil {
 		return "", err
 	}
 	hs := fmt.Sprintf("%x", w.h.Sum(nil))
-	w.postSave(hs, w.data)
+	w.postSave(hs, w.data, w.meta)
 	return hs, nil
 }
 
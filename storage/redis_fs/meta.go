@@ -2,13 +2,17 @@ package redis_fs
 
 import (
 	"fmt"
-	"github.com/pkg/errors"
 	"strconv"
 	"time"
+
+	"github.com/nameoffnv/httpfiles/storage"
+	"github.com/pkg/errors"
 )
 
 type FileMetaInfo struct {
+	ID            string // not stored, the hash is part of the meta key
 	Filename      string
+	ContentType   string
 	Size          int64
 	UploadDate    time.Time
 	RemoveDate    *time.Time
@@ -18,6 +22,7 @@ type FileMetaInfo struct {
 func (m FileMetaInfo) redisArgs() []interface{} {
 	data := []interface{}{
 		"filename", m.Filename,
+		"content_type", m.ContentType,
 		"size", fmt.Sprint(m.Size),
 		"download_count", fmt.Sprint(m.DownloadCount),
 		"upload_date", fmt.Sprint(m.UploadDate.Unix()),
@@ -61,6 +66,8 @@ func parseRedisMap(m map[string]string) (*FileMetaInfo, error) {
 			meta.DownloadCount = count
 		case "filename":
 			meta.Filename = v
+		case "content_type":
+			meta.ContentType = v
 		default:
 			return nil, errors.Errorf("unknown filed %s", k)
 		}
@@ -68,3 +75,18 @@ func parseRedisMap(m map[string]string) (*FileMetaInfo, error) {
 
 	return meta, nil
 }
+
+func (m FileMetaInfo) objectInfo(id string) *storage.ObjectInfo {
+	return &storage.ObjectInfo{
+		Meta: storage.Meta{
+			Filename:    m.Filename,
+			ContentType: m.ContentType,
+			// set on registered files only for a scheduled removal
+			ExpireDate: m.RemoveDate,
+		},
+		ID:            id,
+		Size:          m.Size,
+		UploadDate:    m.UploadDate,
+		DownloadCount: m.DownloadCount,
+	}
+}
@@ -9,6 +9,7 @@ import (
 func TestFileMetaInfo(t *testing.T) {
 	meta := FileMetaInfo{
 		Filename:      "test",
+		ContentType:   "text/plain",
 		Size:          110,
 		UploadDate:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
 		DownloadCount: 0,
@@ -23,7 +24,7 @@ func TestFileMetaInfo(t *testing.T) {
 			args[i] = v.(string)
 		}
 
-		if strings.Join(args, " ") != "filename test size 110 download_count 0 upload_date 1577836800 remove_date 1609459200" {
+		if strings.Join(args, " ") != "filename test content_type text/plain size 110 download_count 0 upload_date 1577836800 remove_date 1609459200" {
 			t.Fatalf("marshal failed, actual '%s'", meta.redisArgs())
 		}
 	})
@@ -31,6 +32,7 @@ func TestFileMetaInfo(t *testing.T) {
 	t.Run("unmarshal", func(t *testing.T) {
 		rMap := map[string]string{
 			"filename":       "test",
+			"content_type":   "text/plain",
 			"size":           "110",
 			"download_count": "0",
 			"upload_date":    "1577836800",
@@ -46,6 +48,10 @@ func TestFileMetaInfo(t *testing.T) {
 			t.Fatalf("filename mismatch excepted %s actual %s", meta.Filename, newMeta.Filename)
 		}
 
+		if newMeta.ContentType != meta.ContentType {
+			t.Fatalf("content type mismatch excepted %s actual %s", meta.ContentType, newMeta.ContentType)
+		}
+
 		if newMeta.Size != meta.Size {
 			t.Fatalf("size mismatch excepted %d actual %d", meta.Size, newMeta.Size)
 		}
@@ -0,0 +1,86 @@
+package redis_fs
+
+import (
+	"time"
+
+	"github.com/nameoffnv/httpfiles/storage"
+	"github.com/pkg/errors"
+)
+
+// ReconcileReport lists the ids repaired by Reconcile.
+type ReconcileReport struct {
+	// Registered files were on disk without meta and got registered again
+	Registered []string
+	// Removed files were on disk but deleted in redis, the interrupted
+	// deletion was finished
+	Removed []string
+	// Unregistered files were registered in redis but missing on disk
+	Unregistered []string
+}
+
+// Reconcile repairs the differences between the file storage and the files
+// hash left behind by a crash between the redis and the filesystem update.
+func (s *RedisFileStorage) Reconcile() (*ReconcileReport, error) {
+	report := &ReconcileReport{}
+
+	err := s.fs.Walk(func(info *storage.ObjectInfo) error {
+		if err := s.exists(info.ID); err == nil {
+			return nil
+		} else if err != storage.ErrNotFound {
+			return err
+		}
+
+		meta, err := s.meta(info.ID)
+		if err != nil {
+			return err
+		}
+
+		// the file was deleted after it was written, finish the deletion
+		if meta.RemoveDate != nil && !meta.RemoveDate.Before(info.UploadDate.Truncate(time.Second)) {
+			if err := s.fs.Delete(info.ID); err != nil && err != storage.ErrNotFound {
+				return errors.Wrap(err, "delete file")
+			}
+			report.Removed = append(report.Removed, info.ID)
+			return nil
+		}
+
+		objectMeta := storage.Meta{Filename: meta.Filename, ContentType: meta.ContentType}
+		if err := s.saveMeta(info.ID, info.Size, objectMeta); err != nil {
+			return err
+		}
+		report.Registered = append(report.Registered, info.ID)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor uint64
+	for {
+		keys, next, err := s.client.HScan(keyLoadedFiles, cursor, "", 1000).Result()
+		if err != nil {
+			return nil, errors.Wrap(err, "redis HScan")
+		}
+
+		// keys holds field and value pairs
+		for i := 0; i < len(keys); i += 2 {
+			id := keys[i]
+			if _, err := s.fs.Stat(id); err != storage.ErrNotFound {
+				continue
+			}
+
+			if _, err := runDeleteScript(s.client, id); err != nil {
+				return nil, errors.Wrap(err, "redis delete meta")
+			}
+			report.Unregistered = append(report.Unregistered, id)
+		}
+
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	return report, nil
+}
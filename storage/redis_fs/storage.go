@@ -3,7 +3,8 @@ package redis_fs
 import (
 	"crypto/sha256"
 	"fmt"
-	"io"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -15,6 +16,10 @@ import (
 const (
 	keyLoadedFiles = "files"
 	keyFileInfo    = "meta"
+	keyExpires     = "expires"
+
+	// scanCount is the HSCAN batch size of listings without a limit.
+	scanCount = 1000
 )
 
 type RedisFileStorage struct {
@@ -38,6 +43,16 @@ func New(redisHost, redisPassword string, redisDB int, path string) (storage.Sto
 	return &RedisFileStorage{fileStorage.(*fs.FileStorage), client}, nil
 }
 
+// Close closes the redis client.
+func (s *RedisFileStorage) Close() error {
+	return s.client.Close()
+}
+
+// SweepTemp deletes stale temporary files of the file storage.
+func (s *RedisFileStorage) SweepTemp(olderThan time.Duration) (int, error) {
+	return s.fs.SweepTemp(olderThan)
+}
+
 func (s *RedisFileStorage) NewObjectWriter() (storage.ObjectWriter, error) {
 	writer, err := s.fs.NewObjectWriter()
 	if err != nil {
@@ -49,11 +64,31 @@ func (s *RedisFileStorage) NewObjectWriter() (storage.ObjectWriter, error) {
 	}, nil
 }
 
-func (s *RedisFileStorage) Get(id string) (io.ReadCloser, error) {
-	if _, err := s.client.HExists(keyLoadedFiles, id).Result(); err == redis.Nil {
-		return nil, storage.ErrNotFound
-	} else if err != nil {
-		return nil, errors.Wrap(err, "redis HExists")
+func (s *RedisFileStorage) NewUpload(info storage.UploadInfo) (storage.Upload, error) {
+	upload, err := s.fs.NewUpload(info)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadWriter{
+		Upload:   upload,
+		postSave: s.saveMeta,
+	}, nil
+}
+
+func (s *RedisFileStorage) GetUpload(id string) (storage.Upload, error) {
+	upload, err := s.fs.GetUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadWriter{
+		Upload:   upload,
+		postSave: s.saveMeta,
+	}, nil
+}
+
+func (s *RedisFileStorage) Get(id string) (storage.Object, error) {
+	if err := s.exists(id); err != nil {
+		return nil, err
 	}
 
 	reader, err := s.fs.Get(id)
@@ -62,80 +97,356 @@ func (s *RedisFileStorage) Get(id string) (io.ReadCloser, error) {
 	}
 
 	if _, err := s.client.HIncrBy(metaKey(id), "download_count", 1).Result(); err != nil {
+		reader.Close()
 		return nil, errors.Wrap(err, "redis HIncrBy")
 	}
 
-	return reader, nil
+	meta, err := s.meta(id)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	return &object{Object: reader, info: meta.objectInfo(id)}, nil
+}
+
+func (s *RedisFileStorage) Stat(id string) (*storage.ObjectInfo, error) {
+	if err := s.exists(id); err != nil {
+		return nil, err
+	}
+
+	meta, err := s.meta(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta.objectInfo(id), nil
 }
 
-func (s *RedisFileStorage) saveMeta(h string, n int64) error {
-	if _, err := s.client.HSet(keyLoadedFiles, h, true).Result(); err != nil {
-		return errors.Wrap(err, "redis HSet")
+func (s *RedisFileStorage) exists(id string) error {
+	exists, err := s.client.HExists(keyLoadedFiles, id).Result()
+	if err != nil {
+		return errors.Wrap(err, "redis HExists")
+	}
+	if !exists {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+func (s *RedisFileStorage) meta(id string) (*FileMetaInfo, error) {
+	metaMap, err := s.client.HGetAll(metaKey(id)).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "redis HGetAll meta")
+	}
+
+	meta, err := parseRedisMap(metaMap)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse redis map")
 	}
 
+	return meta, nil
+}
+
+// saveScript registers the file with its meta, or merges the expiry into the
+// meta of an already registered file with the same content: a file without
+// expiry stays permanent and an expiry is only ever extended. It returns 1 if
+// the file was registered.
+var saveScript = redis.NewScript(`
+local expire = ARGV[2]
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+	local current = redis.call("HGET", KEYS[2], "remove_date")
+	if not current then
+		return 0
+	end
+	if expire == "" then
+		redis.call("HDEL", KEYS[2], "remove_date")
+		redis.call("ZREM", KEYS[3], ARGV[1])
+	elseif tonumber(expire) > tonumber(current) then
+		redis.call("HSET", KEYS[2], "remove_date", expire)
+		redis.call("ZADD", KEYS[3], expire, ARGV[1])
+	end
+	return 0
+end
+
+redis.call("HSET", KEYS[1], ARGV[1], 1)
+-- replace the meta of a previously deleted file with the same hash
+redis.call("DEL", KEYS[2])
+redis.call("HMSET", KEYS[2], unpack(ARGV, 3))
+if expire ~= "" then
+	redis.call("ZADD", KEYS[3], expire, ARGV[1])
+else
+	redis.call("ZREM", KEYS[3], ARGV[1])
+end
+return 1
+`)
+
+// saveMeta registers the file and writes its meta atomically, the file is
+// already renamed to its final location. Uploading the content of a
+// registered file again only merges the expiry, see saveScript.
+func (s *RedisFileStorage) saveMeta(h string, n int64, objectMeta storage.Meta) error {
 	metaInfo := FileMetaInfo{
-		Filename:      h,
+		Filename:      objectMeta.Filename,
+		ContentType:   objectMeta.ContentType,
 		Size:          n,
 		UploadDate:    time.Now(),
+		RemoveDate:    objectMeta.ExpireDate,
 		DownloadCount: 0,
 	}
 
-	args := []interface{}{"hmset", metaKey(h)}
-	args = append(args, metaInfo.redisArgs()...)
-	cmd := redis.NewStatusCmd(args...)
-
-	s.client.Process(cmd)
+	expire := ""
+	if metaInfo.RemoveDate != nil {
+		expire = fmt.Sprint(metaInfo.RemoveDate.Unix())
+	}
 
-	if _, err := cmd.Result(); err != nil {
-		return errors.Wrap(err, "redis HMSet")
+	keys := []string{keyLoadedFiles, metaKey(h), keyExpires}
+	args := append([]interface{}{h, expire}, metaInfo.redisArgs()...)
+	if err := saveScript.Run(s.client, keys, args...).Err(); err != nil {
+		return errors.Wrap(err, "redis save meta")
 	}
 
 	return nil
 }
 
+// deleteScript unregisters the file and marks its meta removed atomically,
+// it returns 0 if the file is not registered.
+var deleteScript = redis.NewScript(`
+if redis.call("HDEL", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[2], "remove_date", ARGV[2])
+redis.call("ZREM", KEYS[3], ARGV[1])
+return 1
+`)
+
+func runDeleteScript(client *redis.Client, id string) (int, error) {
+	keys := []string{keyLoadedFiles, metaKey(id), keyExpires}
+	return deleteScript.Run(client, keys, id, time.Now().Unix()).Int()
+}
+
+// Delete unregisters the file before removing it from disk, so a crash in
+// between leaves an orphaned file for Reconcile rather than meta pointing to
+// nothing.
 func (s *RedisFileStorage) Delete(id string) error {
-	if _, err := s.client.HExists(keyLoadedFiles, id).Result(); err == redis.Nil {
+	deleted, err := runDeleteScript(s.client, id)
+	if err != nil {
+		return errors.Wrap(err, "redis delete meta")
+	}
+	if deleted == 0 {
 		return storage.ErrNotFound
-	} else if err != nil {
-		return errors.Wrap(err, "redis HExists")
 	}
 
-	if err := s.fs.Delete(id); err != nil {
+	if err := s.fs.Delete(id); err != nil && err != storage.ErrNotFound {
 		return errors.Wrap(err, "delete file")
 	}
 
-	if _, err := s.client.HDel("files", id).Result(); err != nil {
-		return errors.Wrap(err, "redis HDel")
+	return nil
+}
+
+// Expired uses the expires sorted set scored by the remove date.
+func (s *RedisFileStorage) Expired(now time.Time) ([]string, error) {
+	ids, err := s.client.ZRangeByScore(keyExpires, redis.ZRangeBy{
+		Min: "-inf",
+		Max: fmt.Sprint(now.Unix()),
+	}).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "redis ZRangeByScore")
 	}
+	return ids, nil
+}
 
-	if _, err := s.client.HSet(metaKey(id), "remove_date", time.Now().Unix()).Result(); err != nil {
-		return errors.Wrap(err, "redis HSet")
+func (s *RedisFileStorage) Count() (int64, int64, error) {
+	ids, err := s.client.HKeys(keyLoadedFiles).Result()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "redis HKeys")
 	}
 
-	return nil
+	cmds, err := s.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			pipe.HGet(metaKey(id), "size")
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return 0, 0, errors.Wrap(err, "redis HGet size")
+	}
+
+	var size int64
+	for _, cmd := range cmds {
+		n, _ := cmd.(*redis.StringCmd).Int64()
+		size += n
+	}
+
+	return int64(len(ids)), size, nil
 }
 
-func (s *RedisFileStorage) StatAll() ([]FileMetaInfo, error) {
-	files, err := s.client.HGetAll(keyLoadedFiles).Result()
+// List pages through the files hash with HSCAN. Unsorted listings continue
+// from a "<hscan cursor>:<offset>" cursor, the offset skips the objects of the
+// batch at the HSCAN cursor which were on the previous page, so the cursor is
+// meant to be used with the same Limit. Sorted listings scan the whole hash
+// and are paginated in memory.
+func (s *RedisFileStorage) List(opts storage.ListOptions) (*storage.ListPage, error) {
+	if opts.Sort != storage.SortDefault {
+		infos := []*storage.ObjectInfo{}
+		var cursor uint64
+		for {
+			batch, next, err := s.scan(cursor, opts)
+			if err != nil {
+				return nil, err
+			}
+			infos = append(infos, batch...)
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+		return storage.Paginate(infos, opts)
+	}
+
+	cursor, offset, err := parseScanCursor(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &storage.ListPage{Objects: []*storage.ObjectInfo{}}
+	for {
+		batch, next, err := s.scan(cursor, opts)
+		if err != nil {
+			return nil, err
+		}
+		batch = batch[min(offset, len(batch)):]
+
+		if left := opts.Limit - len(page.Objects); opts.Limit > 0 && len(batch) > left {
+			page.Objects = append(page.Objects, batch[:left]...)
+			page.Next = fmt.Sprintf("%d:%d", cursor, offset+left)
+			return page, nil
+		}
+		page.Objects = append(page.Objects, batch...)
+
+		cursor, offset = next, 0
+		if cursor == 0 {
+			return page, nil
+		}
+		if opts.Limit > 0 && len(page.Objects) == opts.Limit {
+			page.Next = fmt.Sprintf("%d:0", cursor)
+			return page, nil
+		}
+	}
+}
+
+// parseScanCursor parses the "<hscan cursor>:<offset>" cursor of List, an
+// empty one starts the listing.
+func parseScanCursor(cursor string) (uint64, int, error) {
+	if cursor == "" {
+		return 0, 0, nil
+	}
+
+	scan, skip, ok := strings.Cut(cursor, ":")
+	if !ok {
+		return 0, 0, storage.ErrInvalidCursor
+	}
+	next, err := strconv.ParseUint(scan, 10, 64)
+	if err != nil {
+		return 0, 0, storage.ErrInvalidCursor
+	}
+	offset, err := strconv.Atoi(skip)
+	if err != nil || offset < 0 || (next == 0 && offset == 0) {
+		return 0, 0, storage.ErrInvalidCursor
+	}
+
+	return next, offset, nil
+}
+
+// scan reads a batch of registered files matching the prefix and loads their
+// meta in a single pipeline.
+func (s *RedisFileStorage) scan(cursor uint64, opts storage.ListOptions) ([]*storage.ObjectInfo, uint64, error) {
+	count := int64(opts.Limit)
+	if count <= 0 {
+		count = scanCount
+	}
+
+	fields, next, err := s.client.HScan(keyLoadedFiles, cursor, scanPattern(opts.Prefix), count).Result()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "redis HScan")
+	}
+
+	// HSCAN replies with field and value pairs
+	ids := make([]string, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		ids = append(ids, fields[i])
+	}
+	if len(ids) == 0 {
+		return nil, next, nil
+	}
+
+	cmds, err := s.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			pipe.HGetAll(metaKey(id))
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "redis HGetAll")
+		return nil, 0, errors.Wrap(err, "redis HGetAll meta")
 	}
 
-	infoList := make([]FileMetaInfo, len(files))
-	i := 0
-	for k := range files {
-		metaMap, err := s.client.HGetAll(metaKey(k)).Result()
+	infos := make([]*storage.ObjectInfo, 0, len(ids))
+	for i, cmd := range cmds {
+		meta, err := parseRedisMap(cmd.(*redis.StringStringMapCmd).Val())
 		if err != nil {
-			return nil, errors.Wrap(err, "redis HGetAll meta")
+			return nil, 0, errors.Wrap(err, "parse redis map")
 		}
 
-		meta, err := parseRedisMap(metaMap)
+		info := meta.objectInfo(ids[i])
+		if opts.Match(info) {
+			infos = append(infos, info)
+		}
+	}
+
+	return infos, next, nil
+}
+
+// scanPattern matches the ids starting with prefix, glob characters of the
+// prefix are escaped.
+func scanPattern(prefix string) string {
+	var b strings.Builder
+	for _, c := range prefix {
+		if strings.ContainsRune(`*?[]^\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('*')
+	return b.String()
+}
+
+// StatAll loads the meta of all registered files in a single pipeline.
+func (s *RedisFileStorage) StatAll() ([]FileMetaInfo, error) {
+	ids, err := s.client.HKeys(keyLoadedFiles).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "redis HKeys")
+	}
+	if len(ids) == 0 {
+		return []FileMetaInfo{}, nil
+	}
+
+	cmds, err := s.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			pipe.HGetAll(metaKey(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "redis HGetAll meta")
+	}
+
+	infoList := make([]FileMetaInfo, len(ids))
+	for i, cmd := range cmds {
+		meta, err := parseRedisMap(cmd.(*redis.StringStringMapCmd).Val())
 		if err != nil {
 			return nil, errors.Wrap(err, "parse redis map")
 		}
 
+		meta.ID = ids[i]
 		infoList[i] = *meta
-		i++
 	}
 
 	return infoList, nil
@@ -0,0 +1,286 @@
+package redis_fs
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/nameoffnv/httpfiles/storage"
+)
+
+func newTestStorage(t *testing.T) (*RedisFileStorage, *miniredis.Miniredis, string) {
+	mr := miniredis.RunT(t)
+	dir := t.TempDir()
+
+	s, err := New(mr.Addr(), "", 0, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s.(*RedisFileStorage), mr, dir
+}
+
+func saveObject(t *testing.T, s storage.Storage, data string) string {
+	w, err := s.NewObjectWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(data))
+	h, err := w.Save()
+	if err != nil {
+		t.Fatalf("save failed, error %v", err)
+	}
+	return h
+}
+
+func TestRedisFileStorage(t *testing.T) {
+	s, mr, dir := newTestStorage(t)
+
+	h := saveObject(t, s, "hello world")
+
+	t.Run("stat", func(t *testing.T) {
+		info, err := s.Stat(h)
+		if err != nil {
+			t.Fatalf("stat failed, error %v", err)
+		}
+		if info.Size != 11 {
+			t.Fatalf("size mismatch excepted 11 actual %d", info.Size)
+		}
+	})
+
+	t.Run("get-unregistered", func(t *testing.T) {
+		mr.HDel(keyLoadedFiles, h)
+		defer mr.HSet(keyLoadedFiles, h, "1")
+
+		if _, err := s.Get(h); err != storage.ErrNotFound {
+			t.Fatalf("excepted not found for unregistered file, actual %v", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		w, err := s.NewObjectWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("expiring"))
+		expireDate := time.Now().Add(time.Hour)
+		w.SetMeta(storage.Meta{ExpireDate: &expireDate})
+		expiring, err := w.Save()
+		if err != nil {
+			t.Fatalf("save failed, error %v", err)
+		}
+
+		ids, err := s.Expired(time.Now())
+		if err != nil || len(ids) != 0 {
+			t.Fatalf("excepted no expired files, actual %v, error %v", ids, err)
+		}
+
+		ids, err = s.Expired(expireDate.Add(time.Second))
+		if err != nil || len(ids) != 1 || ids[0] != expiring {
+			t.Fatalf("excepted expired file %s, actual %v, error %v", expiring, ids, err)
+		}
+
+		if err := s.Delete(expiring); err != nil {
+			t.Fatalf("delete failed, error %v", err)
+		}
+
+		ids, _ = s.Expired(expireDate.Add(time.Second))
+		if len(ids) != 0 {
+			t.Fatalf("excepted no expired files after delete, actual %v", ids)
+		}
+	})
+
+	t.Run("reupload-merges-expiry", func(t *testing.T) {
+		save := func(data string, expireDate *time.Time) string {
+			w, err := s.NewObjectWriter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(data))
+			w.SetMeta(storage.Meta{ExpireDate: expireDate})
+			h, err := w.Save()
+			if err != nil {
+				t.Fatalf("save failed, error %v", err)
+			}
+			return h
+		}
+		at := func(d time.Duration) *time.Time {
+			t := time.Now().Add(d).Truncate(time.Second)
+			return &t
+		}
+		expireDate := func(id string) *time.Time {
+			info, err := s.Stat(id)
+			if err != nil {
+				t.Fatalf("stat failed, error %v", err)
+			}
+			return info.ExpireDate
+		}
+
+		// a short ttl must not expire a permanent file
+		mr.HSet(metaKey(h), "download_count", "5")
+		save("hello world", at(time.Minute))
+		if d := expireDate(h); d != nil {
+			t.Fatalf("excepted permanent file, actual expire date %v", d)
+		}
+		if info, _ := s.Stat(h); info.DownloadCount != 5 {
+			t.Fatalf("excepted download count kept, actual %d", info.DownloadCount)
+		}
+
+		hour, twoHours := at(time.Hour), at(2*time.Hour)
+		id := save("merge", hour)
+		save("merge", at(time.Minute))
+		if d := expireDate(id); d == nil || !d.Equal(*hour) {
+			t.Fatalf("excepted the later expire date kept, actual %v", d)
+		}
+		save("merge", twoHours)
+		if d := expireDate(id); d == nil || !d.Equal(*twoHours) {
+			t.Fatalf("excepted the expire date extended, actual %v", d)
+		}
+		save("merge", nil)
+		if ids, _ := s.Expired(time.Now().Add(3 * time.Hour)); len(ids) != 0 || expireDate(id) != nil {
+			t.Fatalf("excepted permanent file after upload without expiry, actual expired %v", ids)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := s.Delete(h); err != nil {
+			t.Fatalf("delete failed, error %v", err)
+		}
+
+		if mr.HGet(metaKey(h), "remove_date") == "" {
+			t.Fatal("remove date not set after delete")
+		}
+
+		if _, err := os.Stat(path.Join(dir, h[:2], h)); !os.IsNotExist(err) {
+			t.Fatalf("file exists after delete, error %v", err)
+		}
+
+		if err := s.Delete(h); err != storage.ErrNotFound {
+			t.Fatalf("excepted not found on second delete, actual %v", err)
+		}
+	})
+}
+
+func TestRedisFileStorageList(t *testing.T) {
+	s, _, _ := newTestStorage(t)
+
+	saved := map[string]bool{}
+	for _, data := range []string{"a", "bb", "ccc", "dddd", "eeeee"} {
+		saved[saveObject(t, s, data)] = true
+	}
+
+	t.Run("scan", func(t *testing.T) {
+		listed := map[string]bool{}
+		opts := storage.ListOptions{Limit: 2}
+		for i := 0; i < 10; i++ {
+			page, err := s.List(opts)
+			if err != nil {
+				t.Fatalf("list failed, error %v", err)
+			}
+			if len(page.Objects) > opts.Limit {
+				t.Fatalf("bad page size, excepted at most %d, actual %d", opts.Limit, len(page.Objects))
+			}
+			for _, info := range page.Objects {
+				if listed[info.ID] {
+					t.Fatalf("%s listed twice", info.ID)
+				}
+				listed[info.ID] = true
+			}
+			if page.Next == "" {
+				break
+			}
+			opts.Cursor = page.Next
+		}
+		if len(listed) != len(saved) {
+			t.Fatalf("listed files mismatch excepted %d actual %d", len(saved), len(listed))
+		}
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		var id string
+		for id = range saved {
+			break
+		}
+
+		page, err := s.List(storage.ListOptions{Prefix: id[:8]})
+		if err != nil {
+			t.Fatalf("list failed, error %v", err)
+		}
+		if len(page.Objects) != 1 || page.Objects[0].ID != id {
+			t.Fatalf("excepted only %s, actual %v", id, page.Objects)
+		}
+	})
+
+	t.Run("sort-size", func(t *testing.T) {
+		page, err := s.List(storage.ListOptions{Sort: storage.SortSize, Desc: true, Limit: 2})
+		if err != nil {
+			t.Fatalf("list failed, error %v", err)
+		}
+		if len(page.Objects) != 2 || page.Objects[0].Size != 5 || page.Objects[1].Size != 4 || page.Next == "" {
+			t.Fatalf("excepted sizes 5 and 4 with next page, actual %v next '%s'", page.Objects, page.Next)
+		}
+	})
+
+	t.Run("bad-cursor", func(t *testing.T) {
+		for _, cursor := range []string{"x", "1", "0:0", "1:-1", "x:1"} {
+			if _, err := s.List(storage.ListOptions{Cursor: cursor}); err != storage.ErrInvalidCursor {
+				t.Fatalf("excepted invalid cursor for '%s', actual %v", cursor, err)
+			}
+		}
+	})
+
+	t.Run("stat-all", func(t *testing.T) {
+		infos, err := s.StatAll()
+		if err != nil {
+			t.Fatalf("stat all failed, error %v", err)
+		}
+		if len(infos) != len(saved) {
+			t.Fatalf("bad count, excepted %d, actual %d", len(saved), len(infos))
+		}
+		for _, info := range infos {
+			if !saved[info.ID] || info.Size == 0 {
+				t.Fatalf("bad info %+v", info)
+			}
+		}
+	})
+}
+
+func TestReconcile(t *testing.T) {
+	s, mr, dir := newTestStorage(t)
+
+	orphanFile := saveObject(t, s, "orphan file")
+	orphanMeta := saveObject(t, s, "orphan meta")
+	kept := saveObject(t, s, "kept")
+
+	// imitate crashes between the redis and the filesystem update
+	mr.HDel(keyLoadedFiles, orphanFile)
+	mr.Del(metaKey(orphanFile))
+	os.Remove(path.Join(dir, orphanMeta[:2], orphanMeta))
+
+	report, err := s.Reconcile()
+	if err != nil {
+		t.Fatalf("reconcile failed, error %v", err)
+	}
+
+	if len(report.Registered) != 1 || report.Registered[0] != orphanFile {
+		t.Fatalf("bad registered files %v", report.Registered)
+	}
+
+	if len(report.Unregistered) != 1 || report.Unregistered[0] != orphanMeta {
+		t.Fatalf("bad unregistered files %v", report.Unregistered)
+	}
+
+	if _, err := s.Stat(orphanFile); err != nil {
+		t.Fatalf("stat of registered file failed, error %v", err)
+	}
+
+	if _, err := s.Stat(orphanMeta); err != storage.ErrNotFound {
+		t.Fatalf("excepted not found for unregistered file, actual %v", err)
+	}
+
+	if _, err := s.Stat(kept); err != nil {
+		t.Fatalf("stat of kept file failed, error %v", err)
+	}
+}
@@ -7,7 +7,12 @@ import (
 type objectWriter struct {
 	storage.ObjectWriter
 
-	postSave func(string, int64) error
+	meta     storage.Meta
+	postSave func(string, int64, storage.Meta) error
+}
+
+func (w *objectWriter) SetMeta(meta storage.Meta) {
+	w.meta = meta
 }
 
 func (w *objectWriter) Save() (string, error) {
@@ -17,10 +22,48 @@ func (w *objectWriter) Save() (string, error) {
 	}
 
 	if w.postSave != nil {
-		if err := w.postSave(h, w.Size()); err != nil {
+		if err := w.postSave(h, w.Size(), w.meta); err != nil {
 			return "", err
 		}
 	}
 
 	return h, nil
 }
+
+type uploadWriter struct {
+	storage.Upload
+
+	meta     storage.Meta
+	postSave func(string, int64, storage.Meta) error
+}
+
+func (w *uploadWriter) SetMeta(meta storage.Meta) {
+	w.meta = meta
+}
+
+func (w *uploadWriter) Save() (string, error) {
+	size := w.Size()
+
+	h, err := w.Upload.Save()
+	if err != nil {
+		return "", err
+	}
+
+	if w.postSave != nil {
+		if err := w.postSave(h, size, w.meta); err != nil {
+			return "", err
+		}
+	}
+
+	return h, nil
+}
+
+type object struct {
+	storage.Object
+
+	info *storage.ObjectInfo
+}
+
+func (o *object) Info() *storage.ObjectInfo {
+	return o.info
+}
@@ -0,0 +1,189 @@
+package s3
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/nameoffnv/httpfiles/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	tempPrefix   = "temp/"
+	metaFilename = "Filename"
+
+	// partSize bounds the memory used to buffer a streamed multipart upload
+	partSize = 16 * 1024 * 1024
+	// maxCopySize is the largest object S3 copies in a single request
+	maxCopySize = 5 * 1024 * 1024 * 1024
+)
+
+type Options struct {
+	// Endpoint is the host and port of the S3 API, e.g. s3.amazonaws.com
+	// or localhost:9000 for a local MinIO
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Region    string
+	Bucket    string
+	UseSSL    bool
+}
+
+type S3Storage struct {
+	client   *minio.Client
+	bucket   string
+	hashFunc func() hash.Hash
+}
+
+func New(opts Options, hashFunc func() hash.Hash) (storage.Storage, error) {
+	client, err := minio.New(opts.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, ""),
+		Region: opts.Region,
+		Secure: opts.UseSSL,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "s3 client")
+	}
+
+	exists, err := client.BucketExists(context.Background(), opts.Bucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "s3 bucket exists")
+	}
+	if !exists {
+		return nil, errors.Errorf("s3 bucket %s not found", opts.Bucket)
+	}
+
+	return &S3Storage{
+		client:   client,
+		bucket:   opts.Bucket,
+		hashFunc: hashFunc,
+	}, nil
+}
+
+// NewObjectWriter streams the object to a temporary key, it is copied to the
+// content hash key on Save.
+func (s *S3Storage) NewObjectWriter() (storage.ObjectWriter, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errors.Wrap(err, "generate temp key")
+	}
+
+	pr, pw := io.Pipe()
+	w := &objectWriter{
+		storage: s,
+		tempKey: fmt.Sprintf("%s%x", tempPrefix, id),
+		hash:    s.hashFunc(),
+		pipe:    pw,
+		done:    make(chan error, 1),
+	}
+
+	go func() {
+		_, err := s.client.PutObject(context.Background(), s.bucket, w.tempKey, pr, -1, minio.PutObjectOptions{
+			PartSize: partSize,
+		})
+		// unblock writes if the upload failed early
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+func (s *S3Storage) Get(id string) (storage.Object, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, id, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "s3 get object")
+	}
+
+	stat, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, statError(err)
+	}
+
+	return &object{Object: obj, info: objectInfo(id, stat)}, nil
+}
+
+func (s *S3Storage) Stat(id string) (*storage.ObjectInfo, error) {
+	stat, err := s.client.StatObject(context.Background(), s.bucket, id, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, statError(err)
+	}
+
+	return objectInfo(id, stat), nil
+}
+
+func (s *S3Storage) Delete(id string) error {
+	if _, err := s.Stat(id); err != nil {
+		return err
+	}
+
+	if err := s.client.RemoveObject(context.Background(), s.bucket, id, minio.RemoveObjectOptions{}); err != nil {
+		return errors.Wrap(err, "s3 remove object")
+	}
+
+	return nil
+}
+
+// SweepTemp deletes temporary objects of unfinished writes older than
+// olderThan.
+func (s *S3Storage) SweepTemp(olderThan time.Duration) (int, error) {
+	// stops the listing when returning early
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	deadline := time.Now().Add(-olderThan)
+
+	removed := 0
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: tempPrefix}) {
+		if obj.Err != nil {
+			return removed, errors.Wrap(obj.Err, "s3 list temp objects")
+		}
+		if !obj.LastModified.Before(deadline) {
+			continue
+		}
+
+		if err := s.client.RemoveObject(ctx, s.bucket, obj.Key, minio.RemoveObjectOptions{}); err != nil {
+			return removed, errors.Wrap(err, "s3 remove temp object")
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+func statError(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return storage.ErrNotFound
+	}
+	return errors.Wrap(err, "s3 stat object")
+}
+
+func objectInfo(id string, stat minio.ObjectInfo) *storage.ObjectInfo {
+	filename, _ := url.QueryUnescape(stat.UserMetadata[metaFilename])
+
+	return &storage.ObjectInfo{
+		Meta: storage.Meta{
+			Filename:    filename,
+			ContentType: stat.ContentType,
+		},
+		ID:         id,
+		Size:       stat.Size,
+		UploadDate: stat.LastModified,
+	}
+}
+
+type object struct {
+	*minio.Object
+	info *storage.ObjectInfo
+}
+
+func (o *object) Info() *storage.ObjectInfo {
+	return o.info
+}
@@ -0,0 +1,469 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nameoffnv/httpfiles/storage"
+)
+
+// TestS3Storage runs against a real S3 compatible server, e.g. a local MinIO:
+// HTTPFILES_S3_ENDPOINT=localhost:9000 HTTPFILES_S3_BUCKET=test go test
+func TestS3Storage(t *testing.T) {
+	endpoint := os.Getenv("HTTPFILES_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("HTTPFILES_S3_ENDPOINT is not set")
+	}
+
+	s, err := New(Options{
+		Endpoint:  endpoint,
+		AccessKey: os.Getenv("HTTPFILES_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("HTTPFILES_S3_SECRET_KEY"),
+		Bucket:    os.Getenv("HTTPFILES_S3_BUCKET"),
+	}, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStorage(t, s)
+}
+
+// TestS3StorageFake runs against an in-process fake of the S3 API.
+func TestS3StorageFake(t *testing.T) {
+	fake := newFakeS3("test")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s, err := New(Options{
+		Endpoint:  strings.TrimPrefix(srv.URL, "http://"),
+		AccessKey: "test",
+		SecretKey: "test",
+		Region:    "us-east-1",
+		Bucket:    "test",
+	}, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("storage", func(t *testing.T) {
+		testStorage(t, s)
+		if keys := fake.keys(tempPrefix); len(keys) != 0 {
+			t.Fatalf("excepted no temp objects, actual %v", keys)
+		}
+	})
+
+	t.Run("failed-copy-removes-temp", func(t *testing.T) {
+		fake.failCopy(true)
+		defer fake.failCopy(false)
+
+		w, err := s.NewObjectWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("failed copy"))
+		if _, err := w.Save(); err == nil {
+			t.Fatal("excepted save error")
+		}
+
+		if keys := fake.keys(""); len(keys) != 0 {
+			t.Fatalf("excepted no objects after failed save, actual %v", keys)
+		}
+	})
+
+	t.Run("removed-write-aborts-upload", func(t *testing.T) {
+		w, err := s.NewObjectWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("removed"))
+		if err := w.Remove(); err != nil {
+			t.Fatalf("remove failed, error %v", err)
+		}
+
+		if keys := fake.keys(""); len(keys) != 0 {
+			t.Fatalf("excepted no objects after remove, actual %v", keys)
+		}
+		if n := fake.pendingUploads(); n != 0 {
+			t.Fatalf("excepted no pending multipart uploads, actual %d", n)
+		}
+	})
+
+	t.Run("sweep-temp", func(t *testing.T) {
+		fake.put(tempPrefix+"stale", []byte("stale"), time.Now().Add(-2*time.Hour))
+		fake.put(tempPrefix+"running", []byte("running"), time.Now())
+
+		removed, err := s.(storage.Sweeper).SweepTemp(time.Hour)
+		if err != nil {
+			t.Fatalf("sweep failed, error %v", err)
+		}
+		if removed != 1 {
+			t.Fatalf("bad removed count, excepted 1 actual %d", removed)
+		}
+		if keys := fake.keys(tempPrefix); len(keys) != 1 || keys[0] != tempPrefix+"running" {
+			t.Fatalf("bad temp objects, excepted running actual %v", keys)
+		}
+	})
+}
+
+// testStorage saves, reads and deletes an object and removes an unfinished
+// write.
+func testStorage(t *testing.T, s storage.Storage) {
+	testObj := []byte("hello world")
+	testHash := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+	w, err := s.NewObjectWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetMeta(storage.Meta{Filename: "hello world.txt", ContentType: "text/plain"})
+	w.Write(testObj)
+
+	h, err := w.Save()
+	if err != nil {
+		t.Fatalf("save failed, error %v", err)
+	}
+	if h != testHash {
+		t.Fatalf("hash mismatch excepted %s actual %s", testHash, h)
+	}
+
+	obj, err := s.Get(h)
+	if err != nil {
+		t.Fatalf("get failed, error %v", err)
+	}
+	b, _ := ioutil.ReadAll(obj)
+	obj.Close()
+	if !bytes.Equal(b, testObj) {
+		t.Fatalf("object mismatch excepted '%s' actual '%s'", testObj, b)
+	}
+
+	info, err := s.Stat(h)
+	if err != nil {
+		t.Fatalf("stat failed, error %v", err)
+	}
+	if info.Filename != "hello world.txt" || info.ContentType != "text/plain" {
+		t.Fatalf("meta mismatch %+v", info.Meta)
+	}
+
+	// a second upload of the same content keeps the first metadata
+	again, err := s.NewObjectWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again.SetMeta(storage.Meta{Filename: "other.bin", ContentType: "application/octet-stream"})
+	again.Write(testObj)
+	if h, err := again.Save(); err != nil || h != testHash {
+		t.Fatalf("save again failed, hash %s, error %v", h, err)
+	}
+	if info, err := s.Stat(testHash); err != nil || info.Filename != "hello world.txt" || info.ContentType != "text/plain" {
+		t.Fatalf("meta replaced by second upload, info %+v, error %v", info, err)
+	}
+
+	aborted, err := s.NewObjectWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aborted.Write(testObj)
+	if err := aborted.Remove(); err != nil {
+		t.Fatalf("remove failed, error %v", err)
+	}
+
+	if err := s.Delete(h); err != nil {
+		t.Fatalf("delete failed, error %v", err)
+	}
+	if _, err := s.Stat(h); err != storage.ErrNotFound {
+		t.Fatalf("excepted not found after delete, actual %v", err)
+	}
+}
+
+type fakeObject struct {
+	data    []byte
+	header  http.Header
+	modTime time.Time
+}
+
+// fakeS3 serves the part of the S3 API used by S3Storage for a single bucket
+// with path style requests, signatures are not checked.
+type fakeS3 struct {
+	bucket string
+
+	lock      sync.Mutex
+	objects   map[string]fakeObject
+	uploads   map[string]map[int][]byte
+	uploadHdr map[string]http.Header
+	nextID    int
+	copyFails bool
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:    bucket,
+		objects:   map[string]fakeObject{},
+		uploads:   map[string]map[int][]byte{},
+		uploadHdr: map[string]http.Header{},
+	}
+}
+
+func (f *fakeS3) failCopy(fail bool) {
+	f.lock.Lock()
+	f.copyFails = fail
+	f.lock.Unlock()
+}
+
+func (f *fakeS3) put(key string, data []byte, modTime time.Time) {
+	f.lock.Lock()
+	f.objects[key] = fakeObject{data: data, header: http.Header{}, modTime: modTime}
+	f.lock.Unlock()
+}
+
+// keys returns the sorted keys with prefix.
+func (f *fakeS3) keys(prefix string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) pendingUploads() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.uploads)
+}
+
+func (f *fakeS3) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if path != f.bucket && !strings.HasPrefix(path, f.bucket+"/") {
+		f.error(rw, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(path, f.bucket), "/")
+	query := req.URL.Query()
+	body, _ := ioutil.ReadAll(req.Body)
+	if strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		body = decodeChunked(body)
+	}
+
+	switch {
+	case key == "" && req.Method == http.MethodHead:
+	case key == "" && req.Method == http.MethodGet:
+		f.list(rw, query.Get("prefix"))
+
+	case req.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		f.uploadHdr[id] = req.Header.Clone()
+		writeXML(rw, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: f.bucket, Key: key, UploadId: id})
+	case req.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.error(rw, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		if req.Header.Get("X-Amz-Copy-Source") == "" {
+			parts[n] = body
+			rw.Header().Set("ETag", etag(body))
+			return
+		}
+
+		src, ok := f.copySource(rw, req)
+		if !ok {
+			return
+		}
+		parts[n] = src.data
+		writeXML(rw, struct {
+			XMLName      xml.Name `xml:"CopyPartResult"`
+			ETag         string
+			LastModified string
+		}{ETag: etag(src.data), LastModified: time.Now().UTC().Format(time.RFC3339)})
+	case req.Method == http.MethodPost && query.Has("uploadId"):
+		id := query.Get("uploadId")
+		parts, ok := f.uploads[id]
+		if !ok {
+			f.error(rw, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		numbers := []int{}
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		data := []byte{}
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+		}
+		f.objects[key] = fakeObject{data: data, header: f.uploadHdr[id], modTime: time.Now()}
+		delete(f.uploads, id)
+		delete(f.uploadHdr, id)
+		writeXML(rw, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: f.bucket, Key: key, ETag: etag(data)})
+	case req.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		delete(f.uploadHdr, query.Get("uploadId"))
+		rw.WriteHeader(http.StatusNoContent)
+
+	case req.Method == http.MethodPut && req.Header.Get("X-Amz-Copy-Source") != "":
+		src, ok := f.copySource(rw, req)
+		if !ok {
+			return
+		}
+		obj := fakeObject{data: src.data, header: req.Header.Clone(), modTime: time.Now()}
+		f.objects[key] = obj
+		writeXML(rw, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified string
+		}{ETag: etag(obj.data), LastModified: obj.modTime.UTC().Format(time.RFC3339)})
+	case req.Method == http.MethodPut:
+		f.objects[key] = fakeObject{data: body, header: req.Header.Clone(), modTime: time.Now()}
+		rw.Header().Set("ETag", etag(body))
+
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			f.error(rw, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for name, values := range obj.header {
+			if strings.HasPrefix(name, "X-Amz-Meta-") {
+				rw.Header()[name] = values
+			}
+		}
+		rw.Header().Set("Content-Type", obj.header.Get("Content-Type"))
+		rw.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		rw.Header().Set("ETag", etag(obj.data))
+		rw.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		if req.Method == http.MethodGet {
+			rw.Write(obj.data)
+		}
+	case req.Method == http.MethodDelete:
+		delete(f.objects, key)
+		rw.WriteHeader(http.StatusNoContent)
+
+	default:
+		f.error(rw, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// copySource returns the source object of a copy request.
+func (f *fakeS3) copySource(rw http.ResponseWriter, req *http.Request) (fakeObject, bool) {
+	if f.copyFails {
+		f.error(rw, http.StatusForbidden, "AccessDenied")
+		return fakeObject{}, false
+	}
+
+	source := strings.TrimPrefix(req.Header.Get("X-Amz-Copy-Source"), "/")
+	obj, ok := f.objects[strings.TrimPrefix(source, f.bucket+"/")]
+	if !ok {
+		f.error(rw, http.StatusNotFound, "NoSuchKey")
+	}
+	return obj, ok
+}
+
+// list answers a ListObjectsV2 request in a single page.
+func (f *fakeS3) list(rw http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		LastModified string
+		Size         int
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: f.bucket, Prefix: prefix}
+
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		obj := f.objects[key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: obj.modTime.UTC().Format(time.RFC3339),
+			Size:         len(obj.data),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+
+	writeXML(rw, result)
+}
+
+func (f *fakeS3) error(rw http.ResponseWriter, status int, code string) {
+	rw.Header().Set("Content-Type", "application/xml")
+	rw.WriteHeader(status)
+	xml.NewEncoder(rw).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+	}{Code: code})
+}
+
+// decodeChunked returns the payload of a signed aws-chunked body, the chunk
+// signatures are not checked.
+func decodeChunked(body []byte) []byte {
+	data := []byte{}
+	for {
+		i := bytes.Index(body, []byte("\r\n"))
+		if i < 0 {
+			return data
+		}
+		header := string(body[:i])
+		if j := strings.Index(header, ";"); j >= 0 {
+			header = header[:j]
+		}
+		size, err := strconv.ParseInt(header, 16, 64)
+		if err != nil || size == 0 || int(size) > len(body)-i-2 {
+			return data
+		}
+		data = append(data, body[i+2:i+2+int(size)]...)
+		body = bytes.TrimPrefix(body[i+2+int(size):], []byte("\r\n"))
+	}
+}
+
+func writeXML(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(rw).Encode(v)
+}
+
+func etag(data []byte) string {
+	return fmt.Sprintf("\"%x\"", sha256.Sum256(data))
+}
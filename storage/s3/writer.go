@@ -0,0 +1,124 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/nameoffnv/httpfiles/storage"
+	"github.com/pkg/errors"
+)
+
+var errAborted = errors.New("upload aborted")
+
+type objectWriter struct {
+	storage *S3Storage
+	tempKey string
+	size    int64
+	meta    storage.Meta
+
+	hash     hash.Hash
+	pipe     *io.PipeWriter
+	done     chan error
+	finished bool
+	err      error
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	n, err := w.pipe.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *objectWriter) Size() int64 {
+	return w.size
+}
+
+func (w *objectWriter) SetMeta(meta storage.Meta) {
+	w.meta = meta
+}
+
+func (w *objectWriter) Save() (string, error) {
+	w.pipe.Close()
+	if err := w.wait(); err != nil {
+		return "", errors.Wrap(err, "s3 put object")
+	}
+	hashSum := fmt.Sprintf("%x", w.hash.Sum(nil))
+
+	ctx := context.Background()
+	// an existing object keeps the metadata and upload date of its first
+	// upload, like the other storages
+	if _, err := w.storage.Stat(hashSum); err == nil {
+		if err := w.storage.client.RemoveObject(ctx, w.storage.bucket, w.tempKey, minio.RemoveObjectOptions{}); err != nil {
+			return "", errors.Wrap(err, "s3 remove temp object")
+		}
+		return hashSum, nil
+	} else if err != storage.ErrNotFound {
+		w.storage.client.RemoveObject(ctx, w.storage.bucket, w.tempKey, minio.RemoveObjectOptions{})
+		return "", err
+	}
+
+	// the s3 storage is not an Expirer, so the meta has no expire date
+	// the content type is passed as metadata, the multipart copy of compose
+	// ignores CopyDestOptions.ContentType
+	dst := minio.CopyDestOptions{
+		Bucket:          w.storage.bucket,
+		Object:          hashSum,
+		ReplaceMetadata: true,
+		UserMetadata:    map[string]string{},
+	}
+	if w.meta.ContentType != "" {
+		dst.UserMetadata["Content-Type"] = w.meta.ContentType
+	}
+	if w.meta.Filename != "" {
+		dst.UserMetadata[metaFilename] = url.QueryEscape(w.meta.Filename)
+	}
+	src := minio.CopySrcOptions{
+		Bucket: w.storage.bucket,
+		Object: w.tempKey,
+	}
+
+	// compose always makes a multipart copy, it is only needed for objects
+	// over the size limit of a single copy
+	var err error
+	if w.size > maxCopySize {
+		_, err = w.storage.client.ComposeObject(ctx, dst, src)
+	} else {
+		_, err = w.storage.client.CopyObject(ctx, dst, src)
+	}
+	if err != nil {
+		// the request does not call Remove after a failed Save
+		w.storage.client.RemoveObject(ctx, w.storage.bucket, w.tempKey, minio.RemoveObjectOptions{})
+		return "", errors.Wrap(err, "s3 copy object")
+	}
+
+	if err := w.storage.client.RemoveObject(ctx, w.storage.bucket, w.tempKey, minio.RemoveObjectOptions{}); err != nil {
+		return "", errors.Wrap(err, "s3 remove temp object")
+	}
+
+	return hashSum, nil
+}
+
+// Remove fails the streamed upload, which makes the client abort the
+// multipart upload, and removes the temporary key if it was completed.
+func (w *objectWriter) Remove() error {
+	w.pipe.CloseWithError(errAborted)
+	if err := w.wait(); err != nil {
+		return nil
+	}
+
+	return w.storage.client.RemoveObject(context.Background(), w.storage.bucket, w.tempKey, minio.RemoveObjectOptions{})
+}
+
+// wait returns the result of the background PutObject call.
+func (w *objectWriter) wait() error {
+	if !w.finished {
+		w.err = <-w.done
+		w.finished = true
+	}
+	return w.err
+}
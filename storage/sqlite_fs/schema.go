@@ -0,0 +1,63 @@
+package sqlite_fs
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// migrations are applied in order, the index of the last applied one is kept
+// in the user_version pragma. Never edit an existing migration, append a new
+// one instead.
+var migrations = []string{
+	`CREATE TABLE files (
+		id             TEXT PRIMARY KEY,
+		filename       TEXT NOT NULL DEFAULT '',
+		content_type   TEXT NOT NULL DEFAULT '',
+		size           INTEGER NOT NULL,
+		upload_date    INTEGER NOT NULL,
+		remove_date    INTEGER,
+		download_count INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX files_upload_date ON files (upload_date) WHERE remove_date IS NULL;
+	CREATE INDEX files_size ON files (size) WHERE remove_date IS NULL;
+	CREATE INDEX files_filename ON files (filename) WHERE remove_date IS NULL;`,
+
+	`ALTER TABLE files ADD COLUMN expire_date INTEGER;
+	CREATE INDEX files_expire_date ON files (expire_date) WHERE remove_date IS NULL AND expire_date IS NOT NULL;`,
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return errors.Wrap(err, "read schema version")
+	}
+
+	if version > len(migrations) {
+		return errors.Errorf("schema version %d is newer than supported %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return errors.Wrap(err, "begin migration")
+		}
+
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "migration %d", i+1)
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "update schema version")
+		}
+
+		if err := tx.Commit(); err != nil {
+			return errors.Wrapf(err, "commit migration %d", i+1)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,436 @@
+package sqlite_fs
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nameoffnv/httpfiles/storage"
+	"github.com/nameoffnv/httpfiles/storage/fs"
+	"github.com/pkg/errors"
+)
+
+type SQLiteFileStorage struct {
+	fs *fs.FileStorage
+	db *sql.DB
+}
+
+// Filter selects and orders files for StatAll, zero values match everything.
+type Filter struct {
+	FilenamePrefix string
+	ContentType    string
+	UploadedAfter  time.Time
+	UploadedBefore time.Time
+
+	// SortBy is one of upload_date (default), size, filename or download_count
+	SortBy string
+	Desc   bool
+
+	Limit  int
+	Offset int
+}
+
+var sortColumns = map[string]string{
+	"":               "upload_date",
+	"upload_date":    "upload_date",
+	"size":           "size",
+	"filename":       "filename",
+	"download_count": "download_count",
+}
+
+const selectColumns = "id, filename, content_type, size, upload_date, expire_date, download_count"
+
+func New(dbPath, path string) (storage.Storage, error) {
+	fileStorage := fs.New(path, sha256.New)
+
+	// immediate transactions take the write lock on BEGIN, so a file rename
+	// and its metadata row are never interleaved with another writer
+	dsn := fmt.Sprintf("file:%s?_txlock=immediate&_busy_timeout=5000&_journal_mode=WAL", dbPath)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "open sqlite")
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "migrate sqlite")
+	}
+
+	return &SQLiteFileStorage{fileStorage.(*fs.FileStorage), db}, nil
+}
+
+func (s *SQLiteFileStorage) Close() error {
+	return s.db.Close()
+}
+
+// SweepTemp deletes stale temporary files of the file storage.
+func (s *SQLiteFileStorage) SweepTemp(olderThan time.Duration) (int, error) {
+	return s.fs.SweepTemp(olderThan)
+}
+
+func (s *SQLiteFileStorage) NewObjectWriter() (storage.ObjectWriter, error) {
+	writer, err := s.fs.NewObjectWriter()
+	if err != nil {
+		return nil, err
+	}
+	return &objectWriter{
+		ObjectWriter: writer,
+		storage:      s,
+	}, nil
+}
+
+func (s *SQLiteFileStorage) NewUpload(info storage.UploadInfo) (storage.Upload, error) {
+	upload, err := s.fs.NewUpload(info)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadWriter{
+		Upload:  upload,
+		storage: s,
+	}, nil
+}
+
+func (s *SQLiteFileStorage) GetUpload(id string) (storage.Upload, error) {
+	upload, err := s.fs.GetUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadWriter{
+		Upload:  upload,
+		storage: s,
+	}, nil
+}
+
+func (s *SQLiteFileStorage) Get(id string) (storage.Object, error) {
+	info, err := s.Stat(id)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := s.fs.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.db.Exec("UPDATE files SET download_count = download_count + 1 WHERE id = ?", id); err != nil {
+		reader.Close()
+		return nil, errors.Wrap(err, "sqlite update download count")
+	}
+	info.DownloadCount++
+
+	return &object{Object: reader, info: info}, nil
+}
+
+func (s *SQLiteFileStorage) Stat(id string) (*storage.ObjectInfo, error) {
+	row := s.db.QueryRow("SELECT "+selectColumns+" FROM files WHERE id = ? AND remove_date IS NULL", id)
+
+	info, err := scanInfo(row)
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrNotFound
+	} else if err != nil {
+		return nil, errors.Wrap(err, "sqlite select")
+	}
+
+	return info, nil
+}
+
+// save runs the rename of the underlying fs writer and the insert of the
+// metadata row in one transaction. The file is removed again if the row can
+// not be written, unless it was already stored before.
+func (s *SQLiteFileStorage) save(saveFile func() (string, error), size int64, meta storage.Meta) (string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", errors.Wrap(err, "sqlite begin")
+	}
+	defer tx.Rollback()
+
+	h, err := saveFile()
+	if err != nil {
+		return "", err
+	}
+
+	var existed bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM files WHERE id = ? AND remove_date IS NULL)", h).Scan(&existed); err != nil {
+		return "", s.abortSave(h, existed, errors.Wrap(err, "sqlite select"))
+	}
+
+	var expireDate *int64
+	if meta.ExpireDate != nil {
+		ts := meta.ExpireDate.Unix()
+		expireDate = &ts
+	}
+
+	// the content of a stored file may be uploaded again, it keeps its meta
+	// and the expiry is only extended, a removed file is replaced
+	_, err = tx.Exec(`INSERT INTO files (id, filename, content_type, size, upload_date, expire_date)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			filename = CASE WHEN files.remove_date IS NULL THEN files.filename ELSE excluded.filename END,
+			content_type = CASE WHEN files.remove_date IS NULL THEN files.content_type ELSE excluded.content_type END,
+			size = excluded.size,
+			upload_date = CASE WHEN files.remove_date IS NULL THEN files.upload_date ELSE excluded.upload_date END,
+			download_count = CASE WHEN files.remove_date IS NULL THEN files.download_count ELSE 0 END,
+			expire_date = CASE
+				WHEN files.remove_date IS NOT NULL THEN excluded.expire_date
+				WHEN files.expire_date IS NULL OR excluded.expire_date IS NULL THEN NULL
+				ELSE max(files.expire_date, excluded.expire_date) END,
+			remove_date = NULL`,
+		h, meta.Filename, meta.ContentType, size, time.Now().Unix(), expireDate)
+	if err != nil {
+		return "", s.abortSave(h, existed, errors.Wrap(err, "sqlite insert"))
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", s.abortSave(h, existed, errors.Wrap(err, "sqlite commit"))
+	}
+
+	return h, nil
+}
+
+func (s *SQLiteFileStorage) abortSave(h string, existed bool, err error) error {
+	if !existed {
+		s.fs.Delete(h)
+	}
+	return err
+}
+
+func (s *SQLiteFileStorage) Delete(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "sqlite begin")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE files SET remove_date = ? WHERE id = ? AND remove_date IS NULL", time.Now().Unix(), id)
+	if err != nil {
+		return errors.Wrap(err, "sqlite update")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return storage.ErrNotFound
+	}
+
+	if err := s.fs.Delete(id); err != nil && err != storage.ErrNotFound {
+		return errors.Wrap(err, "delete file")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "sqlite commit")
+	}
+
+	return nil
+}
+
+func (s *SQLiteFileStorage) Expired(now time.Time) ([]string, error) {
+	rows, err := s.db.Query("SELECT id FROM files WHERE remove_date IS NULL AND expire_date <= ?", now.Unix())
+	if err != nil {
+		return nil, errors.Wrap(err, "sqlite select")
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, errors.Wrap(err, "sqlite scan")
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, errors.Wrap(rows.Err(), "sqlite rows")
+}
+
+// Count sums the stored files in a single query.
+func (s *SQLiteFileStorage) Count() (int64, int64, error) {
+	var objects, size int64
+	err := s.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM files WHERE remove_date IS NULL").Scan(&objects, &size)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "count files")
+	}
+	return objects, size, nil
+}
+
+// StatAll lists stored files using the indexes on upload date, size and
+// filename.
+func (s *SQLiteFileStorage) StatAll(filter Filter) ([]storage.ObjectInfo, error) {
+	column, ok := sortColumns[filter.SortBy]
+	if !ok {
+		return nil, errors.Errorf("unknown sort field %s", filter.SortBy)
+	}
+
+	where := []string{"remove_date IS NULL"}
+	args := []interface{}{}
+
+	if filter.FilenamePrefix != "" {
+		where = append(where, "filename GLOB ?")
+		args = append(args, globEscape(filter.FilenamePrefix)+"*")
+	}
+	if filter.ContentType != "" {
+		where = append(where, "content_type = ?")
+		args = append(args, filter.ContentType)
+	}
+	if !filter.UploadedAfter.IsZero() {
+		where = append(where, "upload_date >= ?")
+		args = append(args, filter.UploadedAfter.Unix())
+	}
+	if !filter.UploadedBefore.IsZero() {
+		where = append(where, "upload_date < ?")
+		args = append(args, filter.UploadedBefore.Unix())
+	}
+
+	order := "ASC"
+	if filter.Desc {
+		order = "DESC"
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM files WHERE %s ORDER BY %s %s, id %s LIMIT ? OFFSET ?",
+		selectColumns, strings.Join(where, " AND "), column, order, order)
+	args = append(args, limit, filter.Offset)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "sqlite select")
+	}
+	defer rows.Close()
+
+	infoList := []storage.ObjectInfo{}
+	for rows.Next() {
+		info, err := scanInfo(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "sqlite scan")
+		}
+		infoList = append(infoList, *info)
+	}
+
+	return infoList, errors.Wrap(rows.Err(), "sqlite rows")
+}
+
+// listColumns are the indexed columns List orders by, ties are broken by id.
+var listColumns = map[storage.ListSort]string{
+	storage.SortDefault: "id",
+	storage.SortSize:    "size",
+	storage.SortDate:    "upload_date",
+}
+
+// List pages through the files with a keyset cursor on the sort column and id,
+// so a page is read from the indexes without skipping the previous ones.
+func (s *SQLiteFileStorage) List(opts storage.ListOptions) (*storage.ListPage, error) {
+	column, ok := listColumns[opts.Sort]
+	if !ok {
+		return nil, errors.Errorf("unknown sort %s", opts.Sort)
+	}
+
+	where := []string{"remove_date IS NULL"}
+	args := []interface{}{}
+
+	if opts.Prefix != "" {
+		where = append(where, "id GLOB ?")
+		args = append(args, globEscape(opts.Prefix)+"*")
+	}
+	if !opts.From.IsZero() {
+		where = append(where, "upload_date >= ?")
+		args = append(args, opts.From.Unix())
+	}
+	if !opts.To.IsZero() {
+		where = append(where, "upload_date < ?")
+		args = append(args, opts.To.Unix())
+	}
+
+	order, cmp := "ASC", ">"
+	if opts.Desc {
+		order, cmp = "DESC", "<"
+	}
+
+	if opts.Cursor != "" {
+		last, err := storage.DecodeCursor(opts.Cursor, opts.Sort)
+		if err != nil {
+			return nil, err
+		}
+
+		switch opts.Sort {
+		case storage.SortDefault:
+			where = append(where, "id "+cmp+" ?")
+			args = append(args, last.ID)
+		case storage.SortSize:
+			where = append(where, "(size, id) "+cmp+" (?, ?)")
+			args = append(args, last.Size, last.ID)
+		case storage.SortDate:
+			where = append(where, "(upload_date, id) "+cmp+" (?, ?)")
+			args = append(args, last.UploadDate.Unix(), last.ID)
+		}
+	}
+
+	// one more row tells if there is a next page
+	limit := -1
+	if opts.Limit > 0 {
+		limit = opts.Limit + 1
+	}
+
+	orderBy := "id " + order
+	if column != "id" {
+		orderBy = fmt.Sprintf("%s %s, id %s", column, order, order)
+	}
+	query := fmt.Sprintf("SELECT %s FROM files WHERE %s ORDER BY %s LIMIT ?",
+		selectColumns, strings.Join(where, " AND "), orderBy)
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "sqlite select")
+	}
+	defer rows.Close()
+
+	page := &storage.ListPage{Objects: []*storage.ObjectInfo{}}
+	for rows.Next() {
+		info, err := scanInfo(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "sqlite scan")
+		}
+		page.Objects = append(page.Objects, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "sqlite rows")
+	}
+
+	if opts.Limit > 0 && len(page.Objects) > opts.Limit {
+		page.Objects = page.Objects[:opts.Limit]
+		page.Next = storage.EncodeCursor(page.Objects[opts.Limit-1], opts.Sort)
+	}
+
+	return page, nil
+}
+
+type scanner interface {
+	Scan(...interface{}) error
+}
+
+func scanInfo(row scanner) (*storage.ObjectInfo, error) {
+	info := &storage.ObjectInfo{}
+	var uploadDate int64
+	var expireDate sql.NullInt64
+
+	err := row.Scan(&info.ID, &info.Filename, &info.ContentType, &info.Size, &uploadDate, &expireDate, &info.DownloadCount)
+	if err != nil {
+		return nil, err
+	}
+	info.UploadDate = time.Unix(uploadDate, 0).UTC()
+	if expireDate.Valid {
+		t := time.Unix(expireDate.Int64, 0).UTC()
+		info.ExpireDate = &t
+	}
+
+	return info, nil
+}
+
+// globEscape quotes the GLOB wildcards of a literal prefix.
+func globEscape(s string) string {
+	r := strings.NewReplacer("*", "[*]", "?", "[?]", "[", "[[]")
+	return r.Replace(s)
+}
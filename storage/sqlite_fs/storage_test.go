@@ -0,0 +1,260 @@
+package sqlite_fs
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nameoffnv/httpfiles/storage"
+)
+
+func TestSQLiteFileStorage(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := New(path.Join(dir, "meta.db"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.(*SQLiteFileStorage).Close()
+
+	save := func(data, filename string) string {
+		w, err := s.NewObjectWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+		w.SetMeta(storage.Meta{Filename: filename, ContentType: "text/plain"})
+		h, err := w.Save()
+		if err != nil {
+			t.Fatalf("save failed, error %v", err)
+		}
+		return h
+	}
+
+	hello := save("hello world", "hello.txt")
+	save("hi", "hi.txt")
+	save("bye", "bye.txt")
+
+	t.Run("stat", func(t *testing.T) {
+		info, err := s.Stat(hello)
+		if err != nil {
+			t.Fatalf("stat failed, error %v", err)
+		}
+
+		if info.Filename != "hello.txt" || info.Size != 11 || info.ContentType != "text/plain" {
+			t.Fatalf("bad info %+v", info)
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		obj, err := s.Get(hello)
+		if err != nil {
+			t.Fatalf("get failed, error %v", err)
+		}
+		obj.Close()
+
+		info, _ := s.Stat(hello)
+		if info.DownloadCount != 1 {
+			t.Fatalf("download count mismatch excepted 1 actual %d", info.DownloadCount)
+		}
+	})
+
+	t.Run("stat-all", func(t *testing.T) {
+		infoList, err := s.(*SQLiteFileStorage).StatAll(Filter{FilenamePrefix: "h", SortBy: "size", Desc: true})
+		if err != nil {
+			t.Fatalf("stat all failed, error %v", err)
+		}
+
+		if len(infoList) != 2 {
+			t.Fatalf("excepted 2 files, actual %d", len(infoList))
+		}
+
+		if infoList[0].Filename != "hello.txt" || infoList[1].Filename != "hi.txt" {
+			t.Fatalf("bad order %s, %s", infoList[0].Filename, infoList[1].Filename)
+		}
+
+		if _, err := s.(*SQLiteFileStorage).StatAll(Filter{SortBy: "id; DROP TABLE files"}); err == nil {
+			t.Fatal("excepted error for unknown sort field")
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		lister := s.(storage.Lister)
+		listAll := func(opts storage.ListOptions) []*storage.ObjectInfo {
+			all := []*storage.ObjectInfo{}
+			for {
+				page, err := lister.List(opts)
+				if err != nil {
+					t.Fatalf("list failed, error %v", err)
+				}
+				if len(page.Objects) > opts.Limit {
+					t.Fatalf("bad page size, excepted at most %d, actual %d", opts.Limit, len(page.Objects))
+				}
+				all = append(all, page.Objects...)
+				if page.Next == "" {
+					return all
+				}
+				opts.Cursor = page.Next
+			}
+		}
+
+		cases := []struct {
+			name     string
+			opts     storage.ListOptions
+			excepted []string
+		}{
+			{"size", storage.ListOptions{Sort: storage.SortSize, Limit: 1}, []string{"hi.txt", "bye.txt", "hello.txt"}},
+			{"size-desc", storage.ListOptions{Sort: storage.SortSize, Desc: true, Limit: 2}, []string{"hello.txt", "bye.txt", "hi.txt"}},
+			{"prefix", storage.ListOptions{Prefix: hello[:8], Limit: 1}, []string{"hello.txt"}},
+			{"to", storage.ListOptions{To: time.Now().Add(-time.Hour), Limit: 1}, []string{}},
+		}
+
+		for _, c := range cases {
+			infos := listAll(c.opts)
+			actual := make([]string, len(infos))
+			for i, info := range infos {
+				actual[i] = info.Filename
+			}
+			if strings.Join(actual, ",") != strings.Join(c.excepted, ",") {
+				t.Fatalf("bad list of %s, excepted %v, actual %v", c.name, c.excepted, actual)
+			}
+		}
+
+		// equal upload dates are ordered by id
+		for _, desc := range []bool{false, true} {
+			infos := listAll(storage.ListOptions{Sort: storage.SortDate, Desc: desc, Limit: 1})
+			if len(infos) != 3 {
+				t.Fatalf("excepted 3 files, actual %d", len(infos))
+			}
+			for i := 1; i < len(infos); i++ {
+				if d := infos[i].UploadDate.Compare(infos[i-1].UploadDate); d == 0 && (infos[i].ID > infos[i-1].ID) == desc {
+					t.Fatalf("bad order of %s and %s", infos[i-1].ID, infos[i].ID)
+				}
+			}
+		}
+
+		page, err := lister.List(storage.ListOptions{Sort: storage.SortSize, Limit: 1})
+		if err != nil {
+			t.Fatalf("list failed, error %v", err)
+		}
+		if _, err := lister.List(storage.ListOptions{Sort: storage.SortDate, Cursor: page.Next}); err != storage.ErrInvalidCursor {
+			t.Fatalf("excepted invalid cursor for another sort, actual %v", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := s.Delete(hello); err != nil {
+			t.Fatalf("delete failed, error %v", err)
+		}
+
+		if _, err := s.Stat(hello); err != storage.ErrNotFound {
+			t.Fatalf("excepted not found after delete, actual %v", err)
+		}
+
+		if _, err := s.Get(hello); err != storage.ErrNotFound {
+			t.Fatalf("excepted not found after delete, actual %v", err)
+		}
+
+		if err := s.Delete(hello); err != storage.ErrNotFound {
+			t.Fatalf("excepted not found on second delete, actual %v", err)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		reopened, err := New(path.Join(dir, "meta.db"), dir)
+		if err != nil {
+			t.Fatalf("reopen failed, error %v", err)
+		}
+		defer reopened.(*SQLiteFileStorage).Close()
+
+		infoList, err := reopened.(*SQLiteFileStorage).StatAll(Filter{})
+		if err != nil {
+			t.Fatalf("stat all failed, error %v", err)
+		}
+
+		if len(infoList) != 2 {
+			t.Fatalf("excepted 2 files, actual %d", len(infoList))
+		}
+	})
+	t.Run("reupload-merges-expiry", func(t *testing.T) {
+		saveExpiring := func(data string, expireDate *time.Time) string {
+			w, err := s.NewObjectWriter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(data))
+			w.SetMeta(storage.Meta{Filename: "other.txt", ExpireDate: expireDate})
+			h, err := w.Save()
+			if err != nil {
+				t.Fatalf("save failed, error %v", err)
+			}
+			return h
+		}
+		expireDate := func(id string) *time.Time {
+			info, err := s.Stat(id)
+			if err != nil {
+				t.Fatalf("stat failed, error %v", err)
+			}
+			return info.ExpireDate
+		}
+		now := time.Now().Truncate(time.Second)
+		minute, hour, twoHours := now.Add(time.Minute), now.Add(time.Hour), now.Add(2*time.Hour)
+
+		// a short ttl must not expire a permanent file
+		permanent := save("permanent", "permanent.txt")
+		saveExpiring("permanent", &minute)
+		if info, _ := s.Stat(permanent); info.ExpireDate != nil || info.Filename != "permanent.txt" {
+			t.Fatalf("excepted permanent.txt kept, actual %+v", info)
+		}
+
+		id := saveExpiring("merge", &hour)
+		saveExpiring("merge", &minute)
+		if d := expireDate(id); d == nil || !d.Equal(hour) {
+			t.Fatalf("excepted the later expire date kept, actual %v", d)
+		}
+		saveExpiring("merge", &twoHours)
+		if d := expireDate(id); d == nil || !d.Equal(twoHours) {
+			t.Fatalf("excepted the expire date extended, actual %v", d)
+		}
+		saveExpiring("merge", nil)
+		if d := expireDate(id); d != nil {
+			t.Fatalf("excepted permanent file after upload without expiry, actual %v", d)
+		}
+	})
+
+	t.Run("sweep-temp", func(t *testing.T) {
+		stale, err := s.NewObjectWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stale.Write([]byte("stale"))
+		fresh, err := s.NewObjectWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fresh.Remove()
+
+		files, _ := os.ReadDir(path.Join(dir, "temp"))
+		if len(files) != 2 {
+			t.Fatalf("excepted 2 temp files, actual %d", len(files))
+		}
+		// one of them was left behind long ago
+		old := time.Now().Add(-2 * time.Hour)
+		for _, f := range files {
+			if err := os.Chtimes(path.Join(dir, "temp", f.Name()), old, old); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+
+		n, err := s.(storage.Sweeper).SweepTemp(time.Hour)
+		if err != nil {
+			t.Fatalf("sweep failed, error %v", err)
+		}
+		if files, _ := os.ReadDir(path.Join(dir, "temp")); n != 1 || len(files) != 1 {
+			t.Fatalf("excepted 1 removed and 1 kept temp file, actual %d removed %d kept", n, len(files))
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package sqlite_fs
+
+import (
+	"github.com/nameoffnv/httpfiles/storage"
+)
+
+type objectWriter struct {
+	storage.ObjectWriter
+
+	meta    storage.Meta
+	storage *SQLiteFileStorage
+}
+
+func (w *objectWriter) SetMeta(meta storage.Meta) {
+	w.meta = meta
+}
+
+func (w *objectWriter) Save() (string, error) {
+	return w.storage.save(w.ObjectWriter.Save, w.Size(), w.meta)
+}
+
+type uploadWriter struct {
+	storage.Upload
+
+	meta    storage.Meta
+	storage *SQLiteFileStorage
+}
+
+func (w *uploadWriter) SetMeta(meta storage.Meta) {
+	w.meta = meta
+}
+
+func (w *uploadWriter) Save() (string, error) {
+	return w.storage.save(w.Upload.Save, w.Size(), w.meta)
+}
+
+type object struct {
+	storage.Object
+
+	info *storage.ObjectInfo
+}
+
+func (o *object) Info() *storage.ObjectInfo {
+	return o.info
+}
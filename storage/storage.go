@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"io"
+	"time"
 )
 
 var (
@@ -11,13 +13,120 @@ var (
 
 type Storage interface {
 	NewObjectWriter() (ObjectWriter, error)
-	Get(string) (io.ReadCloser, error)
+	Get(string) (Object, error)
+	Stat(string) (*ObjectInfo, error)
 	Delete(string) error
 }
 
 type ObjectWriter interface {
 	io.Writer
 	Size() int64
+	SetMeta(Meta)
 	Save() (string, error)
 	Remove() error
 }
+
+// Object is a stored file opened for reading. Seeking is required to serve
+// ranged requests.
+type Object interface {
+	io.ReadSeeker
+	io.Closer
+	Info() *ObjectInfo
+}
+
+// Meta is client supplied information kept along with the object. Storages
+// without a metadata store, like fs, drop it.
+type Meta struct {
+	Filename    string     `json:"filename,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	ExpireDate  *time.Time `json:"expire_date,omitempty"`
+}
+
+// Expired reports whether the object outlived its expire date.
+func (m Meta) Expired(now time.Time) bool {
+	return m.ExpireDate != nil && !now.Before(*m.ExpireDate)
+}
+
+// ObjectInfo describes a stored file without opening it.
+type ObjectInfo struct {
+	Meta
+
+	ID            string    `json:"id"`
+	Size          int64     `json:"size"`
+	UploadDate    time.Time `json:"upload_date"`
+	DownloadCount int       `json:"download_count"`
+}
+
+// Expirer is implemented by storages which can find objects past their expire
+// date, they are removed with Delete.
+type Expirer interface {
+	Expired(now time.Time) ([]string, error)
+}
+
+// Counter is implemented by storages which can total their objects.
+type Counter interface {
+	Count() (objects int64, size int64, err error)
+}
+
+// Sweeper is implemented by storages which write objects to temporary files
+// first. SweepTemp deletes the ones left behind by writes older than
+// olderThan, e.g. after a crash, together with resumable uploads which were
+// abandoned as long, and returns how many were deleted.
+type Sweeper interface {
+	SweepTemp(olderThan time.Duration) (int, error)
+}
+
+// Unwrapper is implemented by storages wrapping another one, e.g. to
+// instrument it.
+type Unwrapper interface {
+	Unwrap() Storage
+}
+
+// Unwrap returns the innermost storage of a chain of wrappers.
+func Unwrap(s Storage) Storage {
+	for {
+		u, ok := s.(Unwrapper)
+		if !ok {
+			return s
+		}
+		s = u.Unwrap()
+	}
+}
+
+// ContextBinder is implemented by storages which make use of the request
+// context, e.g. to trace their calls. FilesHandler binds the storage to every
+// request.
+type ContextBinder interface {
+	WithContext(context.Context) Storage
+}
+
+// Uploader is implemented by storages which support resumable uploads.
+type Uploader interface {
+	NewUpload(UploadInfo) (Upload, error)
+	GetUpload(string) (Upload, error)
+}
+
+// UploadInfo describes a resumable upload, it is persisted together with the
+// partially written data.
+type UploadInfo struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Upload is an ObjectWriter which may be continued by another request after
+// Close. Size reports the number of bytes written so far.
+type Upload interface {
+	ObjectWriter
+	Info() UploadInfo
+	// SetVerifier makes Save pass the content to the verifier while hashing
+	// it, the upload is not stored if Verify fails.
+	SetVerifier(Verifier)
+	Close() error
+}
+
+// Verifier checks the content of an upload before it is stored.
+type Verifier interface {
+	io.Writer
+	Verify() error
+}
@@ -0,0 +1,83 @@
+package storage
+
+// Wrapper decorates the calls of an inner storage, e.g. to instrument them.
+// List and Count of storages without the capability fail with
+// ErrNotSupported or count nothing, WithContext binds the inner storage if it
+// is a ContextBinder.
+type Wrapper interface {
+	Storage
+	Unwrapper
+	Lister
+	Counter
+	ContextBinder
+}
+
+// Hooks wrap the optional capabilities of the inner storage of Wrap, a nil
+// hook passes the capability through.
+type Hooks struct {
+	Expirer  func(Expirer) Expirer
+	Uploader func(Uploader) Uploader
+	Sweeper  func(Sweeper) Sweeper
+}
+
+// Wrap combines base, a Wrapper of inner, with the Expirer, Uploader and
+// Sweeper capabilities of inner. The returned storage implements them only if
+// inner does, so the capability checks of the callers stay the same.
+func Wrap(base Wrapper, inner Storage, hooks Hooks) Storage {
+	expirer, isExpirer := inner.(Expirer)
+	if isExpirer && hooks.Expirer != nil {
+		expirer = hooks.Expirer(expirer)
+	}
+	uploader, isUploader := inner.(Uploader)
+	if isUploader && hooks.Uploader != nil {
+		uploader = hooks.Uploader(uploader)
+	}
+	sweeper, isSweeper := inner.(Sweeper)
+	if isSweeper && hooks.Sweeper != nil {
+		sweeper = hooks.Sweeper(sweeper)
+	}
+
+	switch {
+	case isExpirer && isUploader && isSweeper:
+		return &struct {
+			Wrapper
+			Expirer
+			Uploader
+			Sweeper
+		}{base, expirer, uploader, sweeper}
+	case isExpirer && isUploader:
+		return &struct {
+			Wrapper
+			Expirer
+			Uploader
+		}{base, expirer, uploader}
+	case isExpirer && isSweeper:
+		return &struct {
+			Wrapper
+			Expirer
+			Sweeper
+		}{base, expirer, sweeper}
+	case isUploader && isSweeper:
+		return &struct {
+			Wrapper
+			Uploader
+			Sweeper
+		}{base, uploader, sweeper}
+	case isExpirer:
+		return &struct {
+			Wrapper
+			Expirer
+		}{base, expirer}
+	case isUploader:
+		return &struct {
+			Wrapper
+			Uploader
+		}{base, uploader}
+	case isSweeper:
+		return &struct {
+			Wrapper
+			Sweeper
+		}{base, sweeper}
+	}
+	return base
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type plainStorage struct {
+	Storage
+}
+
+type sweepingStorage struct {
+	plainStorage
+}
+
+func (sweepingStorage) SweepTemp(time.Duration) (int, error) { return 1, nil }
+
+type fullStorage struct {
+	sweepingStorage
+}
+
+func (fullStorage) Expired(time.Time) ([]string, error)  { return []string{"inner"}, nil }
+func (fullStorage) NewUpload(UploadInfo) (Upload, error) { return nil, nil }
+func (fullStorage) GetUpload(string) (Upload, error)     { return nil, nil }
+
+type testWrapper struct {
+	Storage
+}
+
+func (w *testWrapper) Unwrap() Storage                         { return w.Storage }
+func (w *testWrapper) List(ListOptions) (*ListPage, error)     { return nil, ErrNotSupported }
+func (w *testWrapper) Count() (int64, int64, error)            { return 0, 0, nil }
+func (w *testWrapper) WithContext(ctx context.Context) Storage { return w }
+
+type hookedExpirer struct{}
+
+func (hookedExpirer) Expired(time.Time) ([]string, error) { return []string{"hook"}, nil }
+
+func TestWrap(t *testing.T) {
+	hooks := Hooks{
+		Expirer: func(Expirer) Expirer { return hookedExpirer{} },
+	}
+
+	cases := []struct {
+		name  string
+		inner Storage
+	}{
+		{"plain", plainStorage{}},
+		{"sweeper", sweepingStorage{}},
+		{"all", fullStorage{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			wrapped := Wrap(&testWrapper{c.inner}, c.inner, hooks)
+
+			_, innerExpirer := c.inner.(Expirer)
+			_, innerUploader := c.inner.(Uploader)
+			_, innerSweeper := c.inner.(Sweeper)
+			expirer, isExpirer := wrapped.(Expirer)
+			_, isUploader := wrapped.(Uploader)
+			_, isSweeper := wrapped.(Sweeper)
+			if isExpirer != innerExpirer || isUploader != innerUploader || isSweeper != innerSweeper {
+				t.Fatalf("bad capabilities, excepted expirer %v uploader %v sweeper %v, actual %v %v %v",
+					innerExpirer, innerUploader, innerSweeper, isExpirer, isUploader, isSweeper)
+			}
+
+			if isExpirer {
+				if ids, _ := expirer.Expired(time.Now()); len(ids) != 1 || ids[0] != "hook" {
+					t.Fatalf("excepted the expirer hook, actual %v", ids)
+				}
+			}
+
+			if Unwrap(wrapped) != c.inner {
+				t.Fatal("unwrap did not return the inner storage")
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultCheckInterval is how often the files are checked for changes.
+const DefaultCheckInterval = 10 * time.Second
+
+// Reloader serves a certificate read from a cert and key file and reads the
+// files again once they changed, e.g. after a renewal. Use GetCertificate in a
+// tls.Config.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// Option configures a Reloader.
+type Option func(*Reloader)
+
+// CheckInterval sets how often the files are checked for changes, zero checks
+// on every handshake.
+func CheckInterval(d time.Duration) Option {
+	return func(r *Reloader) {
+		r.interval = d
+	}
+}
+
+// New loads the certificate, it fails if the files are missing or invalid.
+func New(certFile, keyFile string, opts ...Option) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: DefaultCheckInterval,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files, on error the current certificate is kept.
+func (r *Reloader) Reload() error {
+	modTime, err := r.modified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "load certificate")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.cert = &cert
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+// GetCertificate returns the current certificate, it reloads the files when
+// they changed since the last check.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	check := time.Since(r.checked) >= r.interval
+	if check {
+		r.checked = time.Now()
+	}
+	r.lock.Unlock()
+
+	if check {
+		if modTime, err := r.modified(); err != nil {
+			log.Printf("tls: %v, keep the current certificate", err)
+		} else if !modTime.Equal(r.modifiedAt()) {
+			if err := r.Reload(); err != nil {
+				log.Printf("tls: %v, keep the current certificate", err)
+			} else {
+				log.Printf("tls: reloaded %s", r.certFile)
+			}
+		}
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.cert, nil
+}
+
+func (r *Reloader) modifiedAt() time.Time {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.modTime
+}
+
+// modified returns the latest modification time of both files.
+func (r *Reloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return latest, errors.Wrap(err, "stat certificate")
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// LoadCertPool reads the PEM encoded certificates of path, e.g. the CA of
+// client certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read certificates")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,110 @@
+package tlscert_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nameoffnv/httpfiles/tlscert"
+)
+
+// writeCert writes a self-signed certificate for name and sets the mtime of
+// both files.
+func writeCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func commonName(t *testing.T, r *tlscert.Reloader) string {
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("get certificate failed, error %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	writeCert(t, certFile, keyFile, "first", now.Add(-time.Minute))
+
+	r, err := tlscert.New(certFile, keyFile, tlscert.CheckInterval(0))
+	if err != nil {
+		t.Fatalf("new failed, error %v", err)
+	}
+
+	t.Run("initial", func(t *testing.T) {
+		if name := commonName(t, r); name != "first" {
+			t.Fatalf("bad certificate, excepted first actual %s", name)
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		writeCert(t, certFile, keyFile, "second", now)
+		if name := commonName(t, r); name != "second" {
+			t.Fatalf("bad certificate, excepted second actual %s", name)
+		}
+	})
+
+	t.Run("invalid-keeps-current", func(t *testing.T) {
+		if err := os.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(certFile, now.Add(time.Minute), now.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if name := commonName(t, r); name != "second" {
+			t.Fatalf("bad certificate, excepted second actual %s", name)
+		}
+		if err := r.Reload(); err == nil {
+			t.Fatal("excepted reload error")
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if _, err := tlscert.New(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+			t.Fatal("excepted error for missing certificate")
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package httpfiles
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nameoffnv/httpfiles/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/nameoffnv/httpfiles"
+
+// propagator reads and writes W3C trace context and baggage headers.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// startRequestSpan starts the server span of a request, continuing the trace
+// of the caller.
+func (s *FilesHandler) startRequestSpan(req *http.Request) (context.Context, trace.Span) {
+	ctx := propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	return s.tracer.Start(ctx, "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.path", req.URL.Path),
+			attribute.String("user_agent.original", req.UserAgent()),
+		),
+	)
+}
+
+// startSpan starts a child span of the request and binds the storage of the
+// request to it, so storage calls are traced as its children.
+func (s *FilesHandler) startSpan(req *http.Request, name string) (*http.Request, trace.Span) {
+	ctx, span := s.tracer.Start(req.Context(), name)
+	return req.WithContext(s.bindStorage(ctx)), span
+}
+
+// bindStorage puts the storage bound to ctx into the context.
+func (s *FilesHandler) bindStorage(ctx context.Context) context.Context {
+	var st storage.Storage = s.storage
+	if binder, ok := st.(storage.ContextBinder); ok {
+		st = binder.WithContext(ctx)
+	}
+	return context.WithValue(ctx, ctxStorageKey, st)
+}
+
+// requestStorage returns the storage bound to the request.
+func (s *FilesHandler) requestStorage(req *http.Request) storage.Storage {
+	if st := s.GetStorage(req); st != nil {
+		return st
+	}
+	return s.storage
+}
+
+func (s *FilesHandler) preSave(req *http.Request) error {
+	if s.PreSave == nil {
+		return nil
+	}
+
+	req, span := s.startSpan(req, "httpfiles.PreSave")
+	defer span.End()
+
+	err := s.PreSave(s.requestStorage(req), req)
+	spanError(span, err)
+	return err
+}
+
+func (s *FilesHandler) postSave(req *http.Request, h string) error {
+	if s.PostSave == nil {
+		return nil
+	}
+
+	req, span := s.startSpan(req, "httpfiles.PostSave")
+	defer span.End()
+	span.SetAttributes(attribute.String("httpfiles.hash", h))
+
+	err := s.PostSave(s.requestStorage(req), req, h)
+	spanError(span, err)
+	return err
+}
+
+func spanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+func defaultTracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
@@ -0,0 +1,224 @@
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"github.com/nameoffnv/httpfiles/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentStorage wraps s to trace its calls. The spans are children of the
+// context the storage is bound to with WithContext, FilesHandler binds it to
+// every request. The Expirer, Uploader, Sweeper and Counter capabilities of s
+// are kept, List fails with storage.ErrNotSupported if s is not a
+// storage.Lister.
+func InstrumentStorage(s storage.Storage, tp trace.TracerProvider, backend string) storage.Storage {
+	return wrap(&tracedStorage{
+		Storage: s,
+		tracer:  tp.Tracer(tracerName),
+		backend: backend,
+		ctx:     context.Background(),
+	})
+}
+
+func wrap(base *tracedStorage) storage.Storage {
+	return storage.Wrap(base, base.Storage, storage.Hooks{
+		Expirer: func(e storage.Expirer) storage.Expirer {
+			return &tracedExpirer{base, e}
+		},
+		Uploader: func(u storage.Uploader) storage.Uploader {
+			return &tracedUploader{base, u}
+		},
+	})
+}
+
+type tracedStorage struct {
+	storage.Storage
+	tracer  trace.Tracer
+	backend string
+	ctx     context.Context
+}
+
+func (s *tracedStorage) Unwrap() storage.Storage {
+	return s.Storage
+}
+
+func (s *tracedStorage) WithContext(ctx context.Context) storage.Storage {
+	bound := *s
+	bound.ctx = ctx
+	return wrap(&bound)
+}
+
+func (s *tracedStorage) start(operation string, attrs ...attribute.KeyValue) trace.Span {
+	attrs = append(attrs, attribute.String("httpfiles.storage.backend", s.backend))
+	_, span := s.tracer.Start(s.ctx, "storage."+operation, trace.WithAttributes(attrs...))
+	return span
+}
+
+func end(span trace.Span, err error) {
+	if err != nil && err != storage.ErrNotFound {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s *tracedStorage) NewObjectWriter() (storage.ObjectWriter, error) {
+	span := s.start("NewObjectWriter")
+	w, err := s.Storage.NewObjectWriter()
+	end(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedWriter{ObjectWriter: w, storage: s, started: time.Now()}, nil
+}
+
+func (s *tracedStorage) Get(id string) (storage.Object, error) {
+	span := s.start("Get", attribute.String("httpfiles.hash", id))
+	o, err := s.Storage.Get(id)
+	end(span, err)
+	return o, err
+}
+
+func (s *tracedStorage) Stat(id string) (*storage.ObjectInfo, error) {
+	span := s.start("Stat", attribute.String("httpfiles.hash", id))
+	info, err := s.Storage.Stat(id)
+	end(span, err)
+	return info, err
+}
+
+func (s *tracedStorage) Delete(id string) error {
+	span := s.start("Delete", attribute.String("httpfiles.hash", id))
+	err := s.Storage.Delete(id)
+	end(span, err)
+	return err
+}
+
+func (s *tracedStorage) Count() (int64, int64, error) {
+	counter, ok := s.Storage.(storage.Counter)
+	if !ok {
+		return 0, 0, nil
+	}
+
+	span := s.start("Count")
+	objects, size, err := counter.Count()
+	end(span, err)
+	return objects, size, err
+}
+
+func (s *tracedStorage) List(opts storage.ListOptions) (*storage.ListPage, error) {
+	lister, ok := s.Storage.(storage.Lister)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+
+	span := s.start("List",
+		attribute.String("httpfiles.list.prefix", opts.Prefix),
+		attribute.String("httpfiles.list.sort", string(opts.Sort)),
+		attribute.Int("httpfiles.list.limit", opts.Limit))
+	page, err := lister.List(opts)
+	if err == nil {
+		span.SetAttributes(attribute.Int("httpfiles.list.objects", len(page.Objects)))
+	}
+	end(span, err)
+	return page, err
+}
+
+// tracedWriter traces Save and Remove, the writes are summarized by a single
+// span from the creation of the writer to Save or Remove, as a span per Write
+// would be too many.
+type tracedWriter struct {
+	storage.ObjectWriter
+	storage *tracedStorage
+	started time.Time
+	writes  int64
+}
+
+func (w *tracedWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.ObjectWriter.Write(p)
+}
+
+func (w *tracedWriter) writeSpan() {
+	_, span := w.storage.tracer.Start(w.storage.ctx, "storage.ObjectWriter.Write",
+		trace.WithTimestamp(w.started),
+		trace.WithAttributes(
+			attribute.String("httpfiles.storage.backend", w.storage.backend),
+			attribute.Int64("httpfiles.size", w.Size()),
+			attribute.Int64("httpfiles.writes", w.writes),
+		))
+	span.End()
+}
+
+func (w *tracedWriter) Save() (string, error) {
+	w.writeSpan()
+
+	span := w.storage.start("ObjectWriter.Save", attribute.Int64("httpfiles.size", w.Size()))
+	h, err := w.ObjectWriter.Save()
+	span.SetAttributes(attribute.String("httpfiles.hash", h))
+	end(span, err)
+	return h, err
+}
+
+func (w *tracedWriter) Remove() error {
+	w.writeSpan()
+
+	span := w.storage.start("ObjectWriter.Remove")
+	err := w.ObjectWriter.Remove()
+	end(span, err)
+	return err
+}
+
+type tracedExpirer struct {
+	storage *tracedStorage
+	expirer storage.Expirer
+}
+
+func (e *tracedExpirer) Expired(now time.Time) ([]string, error) {
+	span := e.storage.start("Expired")
+	ids, err := e.expirer.Expired(now)
+	span.SetAttributes(attribute.Int("httpfiles.expired", len(ids)))
+	end(span, err)
+	return ids, err
+}
+
+type tracedUploader struct {
+	storage  *tracedStorage
+	uploader storage.Uploader
+}
+
+func (u *tracedUploader) NewUpload(info storage.UploadInfo) (storage.Upload, error) {
+	span := u.storage.start("NewUpload", attribute.Int64("httpfiles.size", info.Length))
+	upload, err := u.uploader.NewUpload(info)
+	end(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedUpload{Upload: upload, storage: u.storage}, nil
+}
+
+func (u *tracedUploader) GetUpload(id string) (storage.Upload, error) {
+	span := u.storage.start("GetUpload", attribute.String("httpfiles.upload_id", id))
+	upload, err := u.uploader.GetUpload(id)
+	end(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedUpload{Upload: upload, storage: u.storage}, nil
+}
+
+type tracedUpload struct {
+	storage.Upload
+	storage *tracedStorage
+}
+
+func (u *tracedUpload) Save() (string, error) {
+	span := u.storage.start("Upload.Save", attribute.Int64("httpfiles.size", u.Size()))
+	h, err := u.Upload.Save()
+	span.SetAttributes(attribute.String("httpfiles.hash", h))
+	end(span, err)
+	return h, err
+}
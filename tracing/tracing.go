@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const tracerName = "github.com/nameoffnv/httpfiles/tracing"
+
+// NewProvider returns a tracer provider batching the spans to exporter. It
+// must be shut down to flush the remaining spans.
+func NewProvider(exporter sdktrace.SpanExporter, serviceName string) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+}
+
+// NewOTLPExporter sends spans over OTLP/HTTP to a collector, e.g.
+// "localhost:4318".
+func NewOTLPExporter(ctx context.Context, endpoint string, insecure bool) (sdktrace.SpanExporter, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "create otlp exporter")
+	}
+	return exporter, nil
+}
+
+// NewStdoutExporter writes spans as JSON, it is meant for tests and debugging.
+func NewStdoutExporter(w io.Writer) (sdktrace.SpanExporter, error) {
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		return nil, errors.Wrap(err, "create stdout exporter")
+	}
+	return exporter, nil
+}
@@ -0,0 +1,94 @@
+package tracing_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"crypto/sha256"
+
+	"github.com/nameoffnv/httpfiles"
+	"github.com/nameoffnv/httpfiles/storage/memory"
+	"github.com/nameoffnv/httpfiles/tracing"
+)
+
+type exportedSpan struct {
+	Name        string
+	SpanContext struct {
+		TraceID string
+		SpanID  string
+	}
+	Parent struct {
+		TraceID string
+		SpanID  string
+	}
+}
+
+func TestTracing(t *testing.T) {
+	buf := new(bytes.Buffer)
+	exporter, err := tracing.NewStdoutExporter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := tracing.NewProvider(exporter, "httpfiles-test")
+
+	s := tracing.InstrumentStorage(memory.New(sha256.New), tp, "memory")
+	handler, err := httpfiles.New(s, httpfiles.Tracing(tp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("hello world")))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusCreated, rr.Code)
+	}
+
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]exportedSpan{}
+	dec := json.NewDecoder(buf)
+	for {
+		span := exportedSpan{}
+		if err := dec.Decode(&span); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("json decode span failed, error %v", err)
+		}
+		spans[span.Name] = span
+	}
+
+	parents := map[string]string{
+		"HTTP POST":                  "",
+		"httpfiles.handlePOST":       "HTTP POST",
+		"httpfiles.receive":          "httpfiles.handlePOST",
+		"storage.NewObjectWriter":    "httpfiles.handlePOST",
+		"storage.ObjectWriter.Write": "httpfiles.handlePOST",
+		"storage.ObjectWriter.Save":  "httpfiles.handlePOST",
+	}
+
+	for name, parent := range parents {
+		t.Run(name, func(t *testing.T) {
+			span, ok := spans[name]
+			if !ok {
+				t.Fatalf("span %s not exported", name)
+			}
+			if span.SpanContext.TraceID != traceID {
+				t.Fatalf("bad trace id, excepted %s, actual %s", traceID, span.SpanContext.TraceID)
+			}
+			if parent != "" && span.Parent.SpanID != spans[parent].SpanContext.SpanID {
+				t.Fatalf("bad parent of %s, excepted %s", name, parent)
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+package httpfiles
+
+import (
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nameoffnv/httpfiles/storage"
+)
+
+// UploadsPath is the endpoint of the tus resumable upload protocol.
+const UploadsPath = "/uploads/"
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+	tusMediaType  = "application/offset+octet-stream"
+
+	// metaExpireAt keeps the expire date requested on creation
+	metaExpireAt = "expire_at"
+)
+
+// handleTus implements the core tus 1.0 protocol with the creation and
+// termination extensions, see https://tus.io/protocols/resumable-upload.
+func (s *FilesHandler) handleTus(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Tus-Resumable", tusVersion)
+
+	req, span := s.startSpan(req, "httpfiles.handleTus")
+	defer span.End()
+
+	uploader, ok := s.requestStorage(req).(storage.Uploader)
+	if !ok {
+		http.Error(rw, "resumable uploads not supported by storage", http.StatusNotImplemented)
+		return
+	}
+
+	if req.Method == http.MethodOptions {
+		rw.Header().Set("Tus-Version", tusVersion)
+		rw.Header().Set("Tus-Extension", tusExtensions)
+		if maxFileSize := s.maxFileSize.Load(); maxFileSize > 0 {
+			rw.Header().Set("Tus-Max-Size", strconv.FormatInt(maxFileSize, 10))
+		}
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if req.Header.Get("Tus-Resumable") != tusVersion {
+		rw.Header().Set("Tus-Version", tusVersion)
+		http.Error(rw, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, UploadsPath)
+	if strings.Contains(id, "/") {
+		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if id == "" {
+		if req.Method != http.MethodPost {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleTusCreate(rw, req, uploader)
+		return
+	}
+
+	unlock, ok := s.lockUpload(id)
+	if !ok {
+		http.Error(rw, "upload is in use", http.StatusLocked)
+		return
+	}
+	defer unlock()
+
+	upload, err := uploader.GetUpload(id)
+	if err == storage.ErrNotFound {
+		http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer upload.Close()
+
+	switch req.Method {
+	case http.MethodHead:
+		s.handleTusHead(rw, upload)
+	case http.MethodPatch:
+		s.handleTusPatch(rw, req, upload)
+	case http.MethodDelete:
+		if err := upload.Remove(); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *FilesHandler) handleTusCreate(rw http.ResponseWriter, req *http.Request, uploader storage.Uploader) {
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(rw, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(req.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// hashes passed as url params are verified when the upload is finished
+	for k, v := range expectedHashes(req.URL.Query()) {
+		metadata[k] = v
+	}
+
+	expireDate, err := s.expireDate(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// only the validated date of the url params is kept
+	delete(metadata, metaExpireAt)
+	if expireDate != nil {
+		metadata[metaExpireAt] = expireDate.Format(time.RFC3339)
+	}
+
+	if err := s.preSave(req); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the length is fixed on creation, so the limit holds for every PATCH
+	if maxFileSize := s.requestMaxFileSize(req); maxFileSize > 0 && length > maxFileSize {
+		http.Error(rw, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	upload, err := uploader.NewUpload(storage.UploadInfo{
+		Length:   length,
+		Metadata: metadata,
+	})
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer upload.Close()
+
+	rw.Header().Set("Location", UploadsPath+upload.Info().ID)
+
+	if length == 0 {
+		s.finishUpload(rw, req, upload, http.StatusCreated)
+		return
+	}
+
+	rw.Header().Set("Upload-Offset", "0")
+	rw.WriteHeader(http.StatusCreated)
+}
+
+func (s *FilesHandler) handleTusHead(rw http.ResponseWriter, upload storage.Upload) {
+	info := upload.Info()
+
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Upload-Offset", strconv.FormatInt(upload.Size(), 10))
+	rw.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	if len(info.Metadata) > 0 {
+		rw.Header().Set("Upload-Metadata", formatUploadMetadata(info.Metadata))
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func (s *FilesHandler) handleTusPatch(rw http.ResponseWriter, req *http.Request, upload storage.Upload) {
+	if req.Header.Get("Content-Type") != tusMediaType {
+		http.Error(rw, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(rw, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	if offset != upload.Size() {
+		http.Error(rw, fmt.Sprintf("offset mismatch, %d != %d", offset, upload.Size()), http.StatusConflict)
+		return
+	}
+
+	remaining := upload.Info().Length - offset
+	if req.ContentLength > remaining {
+		http.Error(rw, "body exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// data written before a broken connection is kept, the client resumes
+	// from the offset reported by HEAD
+	if _, err := io.Copy(upload, io.LimitReader(req.Body, remaining)); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// a body of unknown length is only rejected once the upload is full, it
+	// is not finished then
+	if n, _ := req.Body.Read(make([]byte, 1)); n > 0 {
+		http.Error(rw, "body exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if upload.Size() == upload.Info().Length {
+		s.finishUpload(rw, req, upload, http.StatusNoContent)
+		return
+	}
+
+	rw.Header().Set("Upload-Offset", strconv.FormatInt(upload.Size(), 10))
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload verifies and stores a completely received upload the same way
+// handlePOST does.
+func (s *FilesHandler) finishUpload(rw http.ResponseWriter, req *http.Request, upload storage.Upload, status int) {
+	info := upload.Info()
+
+	expected := make(map[string]string)
+	for k, v := range info.Metadata {
+		if _, ok := Hashes[k]; ok {
+			expected[k] = v
+		}
+	}
+
+	// the hashes are verified while Save hashes the upload
+	var verifier *hashVerifier
+	if len(expected) > 0 {
+		verifier = &hashVerifier{expected: expected, hashes: newHashes(expected)}
+		upload.SetVerifier(verifier)
+	}
+
+	// metadata keys commonly sent by tus clients
+	meta := storage.Meta{
+		Filename:    info.Metadata["filename"],
+		ContentType: info.Metadata["filetype"],
+	}
+	if expireDate, err := time.Parse(time.RFC3339, info.Metadata[metaExpireAt]); err == nil {
+		meta.ExpireDate = &expireDate
+	}
+	upload.SetMeta(meta)
+
+	h, err := upload.Save()
+	if verifier != nil && verifier.err != nil {
+		upload.Remove()
+		s.hashMismatch(req, verifier.err)
+		http.Error(rw, verifier.err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setLogHash(req, h)
+
+	if err := s.postSave(req, h); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Upload-Offset", strconv.FormatInt(info.Length, 10))
+	rw.Header().Set("Upload-Hash", h)
+	rw.WriteHeader(status)
+}
+
+// lockUpload guards an upload against concurrent PATCH requests. The entry
+// only lives as long as the request, so ids of abandoned or unknown uploads
+// are not kept.
+func (s *FilesHandler) lockUpload(id string) (func(), bool) {
+	if _, locked := s.uploadLocks.LoadOrStore(id, struct{}{}); locked {
+		return nil, false
+	}
+	return func() { s.uploadLocks.Delete(id) }, true
+}
+
+// hashVerifier checks the hashes passed on creation of an upload.
+type hashVerifier struct {
+	expected map[string]string
+	hashes   map[string]hash.Hash
+	err      *HashMismatchError
+}
+
+func (v *hashVerifier) Write(p []byte) (int, error) {
+	for _, h := range v.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+func (v *hashVerifier) Verify() error {
+	if v.err = verifyHashes(v.expected, v.hashes); v.err != nil {
+		return v.err
+	}
+	return nil
+}
+
+// parseUploadMetadata decodes "key base64value,key2 base64value" pairs.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		switch len(parts) {
+		case 1:
+			metadata[parts[0]] = ""
+		case 2:
+			v, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid Upload-Metadata value for %s", parts[0])
+			}
+			metadata[parts[0]] = string(v)
+		default:
+			return nil, fmt.Errorf("invalid Upload-Metadata pair '%s'", pair)
+		}
+	}
+
+	return metadata, nil
+}
+
+func formatUploadMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for k, v := range metadata {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,350 @@
+package httpfiles_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"crypto/sha256"
+
+	"github.com/nameoffnv/httpfiles"
+	"github.com/nameoffnv/httpfiles/storage"
+	"github.com/nameoffnv/httpfiles/storage/fs"
+	"github.com/nameoffnv/httpfiles/storage/memory"
+)
+
+func tusRequest(method, target string, body []byte) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	return req
+}
+
+func tusPatch(handler http.Handler, location string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	req := tusRequest(http.MethodPatch, location, chunk)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", fmt.Sprint(offset))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTusUpload(t *testing.T) {
+	s := memory.New(sha256.New)
+
+	handler, err := httpfiles.New(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testObj := []byte("hello world")
+	testHash := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+	var location string
+
+	t.Run("options", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodOptions, httpfiles.UploadsPath, nil)
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusNoContent, rr.Code)
+		}
+
+		if rr.Header().Get("Tus-Version") != "1.0.0" {
+			t.Fatalf("bad tus version '%s'", rr.Header().Get("Tus-Version"))
+		}
+	})
+
+	t.Run("create-without-version", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, httpfiles.UploadsPath, nil)
+		req.Header.Set("Upload-Length", fmt.Sprint(len(testObj)))
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusPreconditionFailed {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusPreconditionFailed, rr.Code)
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		req := tusRequest(http.MethodPost, fmt.Sprint(httpfiles.UploadsPath, "?sha256=", testHash), nil)
+		req.Header.Set("Upload-Length", fmt.Sprint(len(testObj)))
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusCreated, rr.Code)
+		}
+
+		location = rr.Header().Get("Location")
+		if location == "" {
+			t.Fatal("not found 'Location' header in response")
+		}
+	})
+
+	t.Run("patch-first-chunk", func(t *testing.T) {
+		rr := tusPatch(handler, location, 0, testObj[:5])
+
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusNoContent, rr.Code)
+		}
+
+		if rr.Header().Get("Upload-Offset") != "5" {
+			t.Fatalf("bad upload offset, excepted 5, actual '%s'", rr.Header().Get("Upload-Offset"))
+		}
+	})
+
+	t.Run("patch-bad-offset", func(t *testing.T) {
+		rr := tusPatch(handler, location, 0, testObj)
+
+		if rr.Code != http.StatusConflict {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusConflict, rr.Code)
+		}
+	})
+
+	t.Run("head", func(t *testing.T) {
+		req := tusRequest(http.MethodHead, location, nil)
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusOK, rr.Code)
+		}
+
+		if rr.Header().Get("Upload-Offset") != "5" {
+			t.Fatalf("bad upload offset, excepted 5, actual '%s'", rr.Header().Get("Upload-Offset"))
+		}
+	})
+
+	t.Run("patch-last-chunk", func(t *testing.T) {
+		rr := tusPatch(handler, location, 5, testObj[5:])
+
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusNoContent, rr.Code)
+		}
+
+		if rr.Header().Get("Upload-Hash") != testHash {
+			t.Fatalf("bad upload hash, excepted %s, actual '%s'", testHash, rr.Header().Get("Upload-Hash"))
+		}
+
+		obj, ok := s.(*memory.MemoryStorage).Objects()[testHash]
+		if !ok {
+			t.Fatalf("not found object in memory storage with key %s", testHash)
+		}
+		if string(obj) != string(testObj) {
+			t.Fatalf("test object not equal object from memory, '%s' != '%s'", string(testObj), string(obj))
+		}
+	})
+
+	t.Run("head-finished", func(t *testing.T) {
+		req := tusRequest(http.MethodHead, location, nil)
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("hash-mismatch", func(t *testing.T) {
+		req := tusRequest(http.MethodPost, fmt.Sprint(httpfiles.UploadsPath, "?md5=aaa"), nil)
+		req.Header.Set("Upload-Length", fmt.Sprint(len(testObj)))
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		rr = tusPatch(handler, rr.Header().Get("Location"), 0, testObj)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("patch-too-long", func(t *testing.T) {
+		for _, contentLength := range []int64{int64(len(testObj)) + 1, -1} {
+			req := tusRequest(http.MethodPost, httpfiles.UploadsPath, nil)
+			req.Header.Set("Upload-Length", fmt.Sprint(len(testObj)))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			loc := rr.Header().Get("Location")
+
+			// -1 is a body of unknown length, e.g. a chunked one
+			req = tusRequest(http.MethodPatch, loc, append(testObj, '!'))
+			req.Header.Set("Content-Type", "application/offset+octet-stream")
+			req.Header.Set("Upload-Offset", "0")
+			req.ContentLength = contentLength
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("bad response status code for length %d, excepted %d, actual %d", contentLength, http.StatusRequestEntityTooLarge, rr.Code)
+			}
+			if rr.Header().Get("Upload-Hash") != "" {
+				t.Fatalf("excepted the upload not to be finished, actual hash %s", rr.Header().Get("Upload-Hash"))
+			}
+		}
+	})
+
+	t.Run("client-expire-at-ignored", func(t *testing.T) {
+		data := []byte("expire at metadata")
+		req := tusRequest(http.MethodPost, httpfiles.UploadsPath, nil)
+		req.Header.Set("Upload-Length", fmt.Sprint(len(data)))
+		req.Header.Set("Upload-Metadata", "expire_at "+base64.StdEncoding.EncodeToString([]byte("2001-01-01T00:00:00Z")))
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		rr = tusPatch(handler, rr.Header().Get("Location"), 0, data)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusNoContent, rr.Code)
+		}
+
+		info, err := s.Stat(rr.Header().Get("Upload-Hash"))
+		if err != nil {
+			t.Fatalf("stat failed, error %v", err)
+		}
+		if info.ExpireDate != nil {
+			t.Fatalf("excepted no expire date from client metadata, actual %v", info.ExpireDate)
+		}
+	})
+
+	t.Run("terminate", func(t *testing.T) {
+		req := tusRequest(http.MethodPost, httpfiles.UploadsPath, nil)
+		req.Header.Set("Upload-Length", fmt.Sprint(len(testObj)))
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+		loc := rr.Header().Get("Location")
+
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, tusRequest(http.MethodDelete, loc, nil))
+
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusNoContent, rr.Code)
+		}
+
+		rr = tusPatch(handler, loc, 0, testObj)
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+func TestTusUploadResume(t *testing.T) {
+	dir := t.TempDir()
+	testObj := []byte("hello world")
+
+	newHandler := func() (storage.Storage, http.Handler) {
+		s := fs.New(dir, sha256.New)
+		handler, err := httpfiles.New(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, handler
+	}
+
+	_, handler := newHandler()
+
+	// the hash is verified while the file storage hashes the upload
+	testHash := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	req := tusRequest(http.MethodPost, fmt.Sprint(httpfiles.UploadsPath, "?sha256=", testHash), nil)
+	req.Header.Set("Upload-Length", fmt.Sprint(len(testObj)))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	location := rr.Header().Get("Location")
+
+	if rr := tusPatch(handler, location, 0, testObj[:5]); rr.Code != http.StatusNoContent {
+		t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusNoContent, rr.Code)
+	}
+
+	// new storage and handler imitate a process restart
+	s, handler := newHandler()
+
+	rr = tusPatch(handler, location, 5, testObj[5:])
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusNoContent, rr.Code)
+	}
+
+	if rr.Header().Get("Upload-Hash") != testHash {
+		t.Fatalf("bad upload hash, excepted %s, actual %s", testHash, rr.Header().Get("Upload-Hash"))
+	}
+
+	reader, err := s.Get(rr.Header().Get("Upload-Hash"))
+	if err != nil {
+		t.Fatalf("get uploaded object failed, error %v", err)
+	}
+	defer reader.Close()
+
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(reader)
+	if buf.String() != string(testObj) {
+		t.Fatalf("test object not equal stored object, '%s' != '%s'", string(testObj), buf.String())
+	}
+}
+
+func TestTusUploadSweep(t *testing.T) {
+	dir := t.TempDir()
+	s := fs.New(dir, sha256.New)
+	sweeper := s.(storage.Sweeper)
+
+	handler, err := httpfiles.New(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := tusRequest(http.MethodPost, httpfiles.UploadsPath, nil)
+	req.Header.Set("Upload-Length", "11")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	location := rr.Header().Get("Location")
+
+	if rr := tusPatch(handler, location, 0, []byte("hello")); rr.Code != http.StatusNoContent {
+		t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusNoContent, rr.Code)
+	}
+
+	t.Run("active-kept", func(t *testing.T) {
+		removed, err := sweeper.SweepTemp(time.Hour)
+		if err != nil {
+			t.Fatalf("sweep failed, error %v", err)
+		}
+		if removed != 0 {
+			t.Fatalf("bad removed count, excepted 0, actual %d", removed)
+		}
+	})
+
+	t.Run("stale-removed", func(t *testing.T) {
+		file := filepath.Join(dir, "uploads", strings.TrimPrefix(location, httpfiles.UploadsPath))
+		old := time.Now().Add(-2 * time.Hour)
+		for _, name := range []string{file, file + ".info"} {
+			if err := os.Chtimes(name, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		removed, err := sweeper.SweepTemp(time.Hour)
+		if err != nil {
+			t.Fatalf("sweep failed, error %v", err)
+		}
+		if removed != 1 {
+			t.Fatalf("bad removed count, excepted 1, actual %d", removed)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, tusRequest(http.MethodHead, location, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("bad response status code, excepted %d, actual %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package httpfiles
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/nameoffnv/httpfiles/storage"
+)
+
+// errWriterRemoved fails the writes of a request whose writer was removed by
+// Close.
+var errWriterRemoved = errors.New("upload removed on shutdown")
+
+// trackedWriter is an ObjectWriter of a running request, Close removes it if
+// the request did not finish it. The lock keeps Close from removing the data
+// while the request writes or saves it.
+type trackedWriter struct {
+	storage.ObjectWriter
+
+	handler *FilesHandler
+	lock    sync.Mutex
+	closed  bool
+}
+
+// newObjectWriter creates an ObjectWriter with the storage of the request
+// and tracks it until it is saved or removed.
+func (s *FilesHandler) newObjectWriter(req *http.Request) (storage.ObjectWriter, error) {
+	w, err := s.requestStorage(req).NewObjectWriter()
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := &trackedWriter{ObjectWriter: w, handler: s}
+	s.writers.Store(tracked, struct{}{})
+	return tracked, nil
+}
+
+func (w *trackedWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return 0, errWriterRemoved
+	}
+	return w.ObjectWriter.Write(p)
+}
+
+func (w *trackedWriter) Save() (string, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return "", errWriterRemoved
+	}
+	w.close()
+	return w.ObjectWriter.Save()
+}
+
+// Remove removes the written data once, the request and Close may both call
+// it.
+func (w *trackedWriter) Remove() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.close()
+	return w.ObjectWriter.Remove()
+}
+
+func (w *trackedWriter) close() {
+	w.closed = true
+	w.handler.writers.Delete(w)
+}
+
+// removeWriters removes the writers of requests which are still running and
+// returns how many there were.
+func (s *FilesHandler) removeWriters() int {
+	removed := 0
+	s.writers.Range(func(key, _ interface{}) bool {
+		key.(*trackedWriter).Remove()
+		removed++
+		return true
+	})
+	return removed
+}